@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// default tolerance of the adherence reports
+var defaultTolerance = database.AdherenceTolerance{Early: time.Minute, Late: 5 * time.Minute, Location: time.UTC}
+
+// FromDatabase aggregates the arrivals by route, by stop and by hour of the day
+func (aa *ApiAdherence) FromDatabase(adherence []*database.Adherence, tolerance *database.AdherenceTolerance) error {
+	aa.Early, aa.Late = tolerance.Early.Seconds(), tolerance.Late.Seconds()
+	routes := map[string]*ApiAdherenceRow{}
+	stops := map[[2]string]*ApiAdherenceRow{}
+	hours := map[string]map[int]*ApiAdherenceRow{}
+	aa.Routes, aa.Stops, aa.Hours = []ApiAdherenceRow{}, []ApiAdherenceRow{}, []ApiAdherenceRow{}
+	for _, a := range adherence {
+		r, ok := routes[a.RouteName]
+		if !ok {
+			r = &ApiAdherenceRow{Route: a.RouteName}
+			routes[a.RouteName] = r
+			hours[a.RouteName] = map[int]*ApiAdherenceRow{}
+		}
+		s, ok := stops[[2]string{a.RouteName, a.StopID}]
+		if !ok {
+			s = &ApiAdherenceRow{Route: a.RouteName, Stop: a.StopID}
+			stops[[2]string{a.RouteName, a.StopID}] = s
+		}
+		h, ok := hours[a.RouteName][a.Hour]
+		if !ok {
+			hour := a.Hour
+			h = &ApiAdherenceRow{Route: a.RouteName, Hour: &hour}
+			hours[a.RouteName][a.Hour] = h
+		}
+		for _, row := range []*ApiAdherenceRow{r, s, h} {
+			// weighted sum of the means, divided once all the arrivals are counted
+			row.MeanDeviation += a.MeanDeviation.Seconds() * float64(a.Arrivals)
+			row.Arrivals += a.Arrivals
+			row.Early += a.Early
+			row.Late += a.Late
+		}
+	}
+	for _, r := range routes {
+		aa.Routes = append(aa.Routes, r.finish())
+		for _, h := range hours[r.Route] {
+			aa.Hours = append(aa.Hours, h.finish())
+		}
+	}
+	for _, s := range stops {
+		aa.Stops = append(aa.Stops, s.finish())
+	}
+	sort.Slice(aa.Routes, func(i, j int) bool { return aa.Routes[i].Route < aa.Routes[j].Route })
+	sort.Slice(aa.Stops, func(i, j int) bool {
+		return aa.Stops[i].Route < aa.Stops[j].Route || (aa.Stops[i].Route == aa.Stops[j].Route && aa.Stops[i].Stop < aa.Stops[j].Stop)
+	})
+	sort.Slice(aa.Hours, func(i, j int) bool {
+		return aa.Hours[i].Route < aa.Hours[j].Route || (aa.Hours[i].Route == aa.Hours[j].Route && *aa.Hours[i].Hour < *aa.Hours[j].Hour)
+	})
+	return nil
+}
+
+// finish computes the averages of the row
+func (row *ApiAdherenceRow) finish() ApiAdherenceRow {
+	row.OnTime = row.Arrivals - row.Early - row.Late
+	if row.Arrivals > 0 {
+		row.OnTimePercent = float64(row.OnTime) / float64(row.Arrivals) * 100
+		row.MeanDeviation /= float64(row.Arrivals)
+	}
+	return *row
+}
+
+// WriteCSV writes the rows of the report with the group they belong to, "route", "stop" or "hour"
+func (aa *ApiAdherence) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"group", "route", "stop", "hour", "arrivals", "on_time", "early", "late", "on_time_percent", "mean_deviation"})
+	groups := []struct {
+		name string
+		rows []ApiAdherenceRow
+	}{{"route", aa.Routes}, {"stop", aa.Stops}, {"hour", aa.Hours}}
+	for _, group := range groups {
+		for _, row := range group.rows {
+			hour := ""
+			if row.Hour != nil {
+				hour = strconv.Itoa(*row.Hour)
+			}
+			writer.Write([]string{group.name, row.Route, row.Stop, hour, strconv.Itoa(row.Arrivals), strconv.Itoa(row.OnTime),
+				strconv.Itoa(row.Early), strconv.Itoa(row.Late), strconv.FormatFloat(row.OnTimePercent, 'f', 1, 64),
+				strconv.FormatFloat(row.MeanDeviation, 'f', 0, 64)})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// alertsFor converts the alerts concerning the route or the stop, either may be empty
+func alertsFor(alerts []*database.ServiceAlert, routeName, stopID string) []ApiServiceAlertMeta {
+	res := []ApiServiceAlertMeta{}
+	for _, a := range alerts {
+		if !a.Affects(routeName, stopID) {
+			continue
+		}
+		alert := ApiServiceAlertMeta{}
+		alert.FromDatabase(a)
+		res = append(res, alert)
+	}
+	return res
+}
@@ -1,13 +1,19 @@
 package api
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/keyboardnerd/yastserver/database"
 	"github.com/keyboardnerd/yastserver/pkg"
 )
 
@@ -16,6 +22,9 @@ const (
 	OK    = "ok"
 )
 
+// largest body accepted by /v1/ingest if it's not configured
+const defaultMaxIngestBytes = 1 << 20
+
 func handleLog(ctx *Context) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -34,6 +43,22 @@ func handleLog(ctx *Context) func(http.ResponseWriter, *http.Request) {
 			if handleErr(w, err) {
 				return
 			}
+			routeName := ar.Route
+			if vehicle, err := ctx.DB.SelectVehicle(id); err == nil {
+				ar.Vehicle = &ApiVehicleMeta{}
+				ar.Vehicle.FromDatabase(vehicle)
+				if routeName == "" {
+					routeName = vehicle.RouteName
+				}
+			}
+			if routeName != "" {
+				if route, _, err := activeRoute(ctx.DB, routeName, time.Now()); err == nil {
+					ar.OnRoute(route)
+				}
+			}
+			if r.URL.Query().Get("extrapolate") == "true" {
+				ar.Extrapolate(res, time.Now())
+			}
 			err = sendResponse(w, ar)
 			if handleErr(w, err) {
 				return
@@ -52,7 +77,7 @@ func handleRoute(ctx *Context) func(http.ResponseWriter, *http.Request) {
 			if handleErr(w, err) {
 				return
 			}
-			res, err := ctx.DB.SelectClosedRoute(id)
+			res, detour, err := activeRoute(ctx.DB, id, time.Now())
 			if handleErr(w, err) {
 				return
 			}
@@ -61,6 +86,15 @@ func handleRoute(ctx *Context) func(http.ResponseWriter, *http.Request) {
 			if handleErr(w, err) {
 				return
 			}
+			if detour != nil {
+				ar.Detour = &ApiDetourMeta{}
+				ar.Detour.FromDatabase(detour)
+			}
+			alerts, err := ctx.DB.SelectServiceAlerts(time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			ar.Alerts = alertsFor(alerts, res.Name, "")
 			err = sendResponse(w, ar)
 			if handleErr(w, err) {
 				return
@@ -68,6 +102,9 @@ func handleRoute(ctx *Context) func(http.ResponseWriter, *http.Request) {
 			pkg.MeasureTime(start, "Get Route")
 			break
 		case "POST":
+			if !requireToken(w, r, ctx) {
+				return
+			}
 			decoder := json.NewDecoder(r.Body)
 			route := &ApiClosedRoute{}
 			err := decoder.Decode(route)
@@ -94,30 +131,1102 @@ func handleRoute(ctx *Context) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func handleErrWithInfo(w http.ResponseWriter, err error, info string) bool {
-	if err != nil {
-		w.Write(Stat(ERROR, err.Error()+info))
-		return true
+func handleIngest(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "POST":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			limit := ctx.MaxIngestBytes
+			if limit <= 0 {
+				limit = defaultMaxIngestBytes
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+			if err != nil && int64(len(body)) >= limit {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				handleErr(w, fmt.Errorf("Body larger than %d bytes", limit))
+				return
+			}
+			if handleErr(w, err) {
+				return
+			}
+			ai := &ApiIngest{}
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+				ai.Received, err = ctx.Ingester.IngestText(body)
+				if handleErr(w, err) {
+					return
+				}
+			} else {
+				// a single log or a batch of logs
+				alogs := []ApiShuttleLog{}
+				if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+					alogs = append(alogs, ApiShuttleLog{})
+					err = json.Unmarshal(trimmed, &alogs[0])
+				} else {
+					err = json.Unmarshal(trimmed, &alogs)
+				}
+				if handleErr(w, err) {
+					return
+				}
+				logs := make([]database.ShuttleLog, len(alogs))
+				for i := range alogs {
+					if handleErrWithInfo(w, alogs[i].checkLocation(), fmt.Sprintf(" at log %d", i)) {
+						return
+					}
+					log, err := alogs[i].ToDatabase()
+					if handleErrWithInfo(w, err, fmt.Sprintf(" at log %d", i)) {
+						return
+					}
+					logs[i] = *log
+				}
+				err = ctx.Ingester.Ingest(logs)
+				if handleErr(w, err) {
+					return
+				}
+				ai.Received = len(logs)
+			}
+			err = sendResponse(w, ai)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "POST Ingest")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
 	}
-	return false
 }
 
-func handleErr(w http.ResponseWriter, err error) bool {
-	return handleErrWithInfo(w, err, "")
+func handleVehicle(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			// a single vehicle or all of them
+			if r.URL.Query().Get("id") == "" {
+				res, err := ctx.DB.ListVehicles()
+				if handleErr(w, err) {
+					return
+				}
+				al := &ApiVehicleList{}
+				err = al.FromDatabase(res)
+				if handleErr(w, err) {
+					return
+				}
+				err = sendResponse(w, al)
+				if handleErr(w, err) {
+					return
+				}
+				pkg.MeasureTime(start, "List Vehicle")
+				return
+			}
+			id, err := getID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectVehicle(id)
+			if handleErr(w, err) {
+				return
+			}
+			av := &ApiVehicle{}
+			err = av.FromDatabase(res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, av)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Vehicle")
+		case "POST", "PUT":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if handleErr(w, err) {
+				return
+			}
+			av := &ApiVehicle{}
+			err = json.Unmarshal(body, av)
+			if handleErr(w, err) {
+				return
+			}
+			// PUT only updates the given fields of a known vehicle
+			if r.Method == "PUT" {
+				known, err := ctx.DB.SelectVehicle(av.VehicleID)
+				if handleErr(w, err) {
+					return
+				}
+				av = &ApiVehicle{}
+				av.FromDatabase(known)
+				err = json.Unmarshal(body, av)
+				if handleErr(w, err) {
+					return
+				}
+			}
+			vehicle, err := av.ToDatabase()
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.UpsertVehicle(vehicle)
+			if handleErr(w, err) {
+				return
+			}
+			av = &ApiVehicle{}
+			av.FromDatabase(vehicle)
+			err = sendResponse(w, av)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, r.Method+" Vehicle")
+		case "DELETE":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			id, err := getID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.DeleteVehicle(id)
+			if handleErr(w, err) {
+				return
+			}
+			w.Write(Stat(OK, ""))
+			pkg.MeasureTime(start, "DELETE Vehicle")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
 }
 
-func getID(r *http.Request, id string) (string, error) {
-	q := r.URL.Query()
-	str := q.Get(id)
-	if str == "" {
-		return "", errors.New("Invalid ID")
+func handleVehicleStates(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			id, err := getID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			now := time.Now()
+			to, err := getTime(r, "to", now)
+			if handleErr(w, err) {
+				return
+			}
+			from, err := getTime(r, "from", to.Add(-24*time.Hour))
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectVehicleStates(id, from, to)
+			if handleErr(w, err) {
+				return
+			}
+			// the current state lasts until now
+			if to.After(now) {
+				to = now
+			}
+			as := &ApiVehicleStates{}
+			err = as.FromDatabase(id, res, from, to)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, as)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Vehicle states")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
 	}
-	return str, nil
 }
 
-func validateToken(r *http.Request, token string) bool {
-	// security feature to validate the token when posting
-	return true
+func handleVehicleAssignments(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			id, err := getID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			to, err := getTime(r, "to", time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			from, err := getTime(r, "from", to.Add(-24*time.Hour))
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectRouteAssignments(id, from, to)
+			if handleErr(w, err) {
+				return
+			}
+			aa := &ApiRouteAssignments{}
+			err = aa.FromDatabase(id, res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, aa)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Vehicle Assignments")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleLeader(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			lease, err := ctx.DB.SelectLease("updater")
+			if handleErr(w, err) {
+				return
+			}
+			al := &ApiLeader{Instance: ctx.InstanceID}
+			// no instance acquired the lease yet
+			if lease != nil {
+				al.Leader = lease.Holder
+				al.AcquiredAt = lease.AcquiredAt
+				al.ExpiresAt = lease.ExpiresAt
+				al.IsLeader = lease.Holder == ctx.InstanceID && lease.ExpiresAt.After(time.Now())
+			}
+			err = sendResponse(w, al)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Leader")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+// handleStream sends the live events as server-sent events until the client disconnects
+func handleStream(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				handleErr(w, errors.New("Streaming not supported"))
+				return
+			}
+			client := ctx.Stream.subscribe()
+			defer ctx.Stream.unsubscribe(client)
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
+			for {
+				select {
+				case event := <-client:
+					if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, event.Data); err != nil {
+						return
+					}
+					flusher.Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleQuarantine(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			to, err := getTime(r, "to", time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			from, err := getTime(r, "from", to.Add(-24*time.Hour))
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectQuarantine(from, to)
+			if handleErr(w, err) {
+				return
+			}
+			aq := &ApiQuarantine{}
+			err = aq.FromDatabase(res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, aq)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Quarantine")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleStop(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			// a single stop or the stops of a route
+			if r.URL.Query().Get("id") == "" {
+				name, err := getID(r, "route")
+				if handleErr(w, err) {
+					return
+				}
+				res, err := ctx.DB.SelectStopOnRoute(name)
+				if handleErr(w, err) {
+					return
+				}
+				al := &ApiStopList{}
+				err = al.FromDatabase(name, res)
+				if handleErr(w, err) {
+					return
+				}
+				alerts, err := ctx.DB.SelectServiceAlerts(time.Now())
+				if handleErr(w, err) {
+					return
+				}
+				for i := range al.Stops {
+					al.Stops[i].Alerts = alertsFor(alerts, name, al.Stops[i].StopID)
+				}
+				err = sendResponse(w, al)
+				if handleErr(w, err) {
+					return
+				}
+				pkg.MeasureTime(start, "List Stop")
+				return
+			}
+			id, err := getID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectStop(id)
+			if handleErr(w, err) {
+				return
+			}
+			as := &ApiStop{}
+			err = as.FromDatabase(res)
+			if handleErr(w, err) {
+				return
+			}
+			alerts, err := ctx.DB.SelectServiceAlerts(time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			as.Alerts = alertsFor(alerts, as.Route, as.StopID)
+			err = sendResponse(w, as)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Stop")
+		case "POST":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			decoder := json.NewDecoder(r.Body)
+			as := &ApiStop{}
+			err := decoder.Decode(as)
+			if handleErr(w, err) {
+				return
+			}
+			stop, err := as.ToDatabase()
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.InsertStop(stop)
+			if handleErr(w, err) {
+				return
+			}
+			w.Write(Stat(OK, ""))
+			pkg.MeasureTime(start, "POST Stop")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleStopEvents(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			id, err := getID(r, "stop")
+			if handleErr(w, err) {
+				return
+			}
+			to, err := getTime(r, "to", time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			from, err := getTime(r, "from", to.Add(-24*time.Hour))
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectStopEvents(id, from, to)
+			if handleErr(w, err) {
+				return
+			}
+			ae := &ApiStopEvents{}
+			err = ae.FromDatabase(id, res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, ae)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Stop events")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleStopPredictions(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			id, err := getID(r, "stop")
+			if handleErr(w, err) {
+				return
+			}
+			stop, err := ctx.DB.SelectStop(id)
+			if handleErr(w, err) {
+				return
+			}
+			res, err := PredictArrivals(ctx, stop, time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			ap := &ApiStopPredictions{StopID: id, Predictions: res}
+			err = sendResponse(w, ap)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Stop predictions")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleRouteTravelTimes(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			name, err := getID(r, "name")
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectSegmentTimes(name)
+			if handleErr(w, err) {
+				return
+			}
+			at := &ApiSegmentTimes{}
+			err = at.FromDatabase(name, res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, at)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Route travel times")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleRouteSchedule(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			name, err := getID(r, "name")
+			if handleErr(w, err) {
+				return
+			}
+			date, err := getDate(r, "date", ctx.Location, time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			midnight := ServiceDay(date, ctx.Location)
+			res, err := TripsOn(ctx.DB, name, midnight)
+			if handleErr(w, err) {
+				return
+			}
+			as := &ApiSchedule{}
+			err = as.FromDatabase(name, midnight, res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, as)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Route schedule")
+		case "POST":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			decoder := json.NewDecoder(r.Body)
+			at := &ApiTrips{}
+			err := decoder.Decode(at)
+			if handleErr(w, err) {
+				return
+			}
+			trips, err := at.ToDatabase()
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.InsertTrips(at.Route, trips)
+			if handleErr(w, err) {
+				return
+			}
+			w.Write(Stat(OK, ""))
+			pkg.MeasureTime(start, "POST Route schedule")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleCalendar(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			id, err := getID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectCalendar(id)
+			if handleErr(w, err) {
+				return
+			}
+			ac := &ApiCalendar{}
+			err = ac.FromDatabase(res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, ac)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Calendar")
+		case "POST":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			decoder := json.NewDecoder(r.Body)
+			ac := &ApiCalendar{}
+			err := decoder.Decode(ac)
+			if handleErr(w, err) {
+				return
+			}
+			calendar, err := ac.ToDatabase()
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.UpsertCalendar(calendar)
+			if handleErr(w, err) {
+				return
+			}
+			w.Write(Stat(OK, ""))
+			pkg.MeasureTime(start, "POST Calendar")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+// handleCalendarImport imports a GTFS calendar.txt or calendar_dates.txt file, the calendars keep their
+// exceptions and the exceptions are merged into the calendars
+func handleCalendarImport(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "POST":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if handleErr(w, err) {
+				return
+			}
+			imported := 0
+			switch file := r.URL.Query().Get("file"); file {
+			case "calendar":
+				calendars, err := ParseGTFSCalendar(body)
+				if handleErr(w, err) {
+					return
+				}
+				for _, calendar := range calendars {
+					if current, err := ctx.DB.SelectCalendar(calendar.ServiceID); err == nil {
+						calendar.Exceptions = current.Exceptions
+					}
+					err = ctx.DB.UpsertCalendar(calendar)
+					if handleErr(w, err) {
+						return
+					}
+					imported++
+				}
+			case "calendar_dates":
+				exceptions, err := ParseGTFSCalendarDates(body)
+				if handleErr(w, err) {
+					return
+				}
+				for serviceID, e := range exceptions {
+					// services may be defined by their dates only
+					calendar, err := ctx.DB.SelectCalendar(serviceID)
+					if err != nil {
+						calendar = &database.ServiceCalendar{ServiceID: serviceID}
+					}
+					mergeExceptions(calendar, e)
+					err = ctx.DB.UpsertCalendar(calendar)
+					if handleErr(w, err) {
+						return
+					}
+					imported++
+				}
+			default:
+				handleErr(w, fmt.Errorf("Invalid file '%s', expected calendar or calendar_dates", file))
+				return
+			}
+			err = sendResponse(w, &ApiImport{Imported: imported})
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Import Calendar")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleRouteAdherence(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			// all the routes without name
+			name := r.URL.Query().Get("name")
+			to, err := getTime(r, "to", time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			from, err := getTime(r, "from", to.Add(-7*24*time.Hour))
+			if handleErr(w, err) {
+				return
+			}
+			tolerance := ctx.Tolerance
+			if tolerance == nil {
+				tolerance = &defaultTolerance
+			}
+			res, err := ctx.DB.SelectAdherence(name, from, to, tolerance)
+			if handleErr(w, err) {
+				return
+			}
+			aa := &ApiAdherence{Route: name, From: from, To: to}
+			err = aa.FromDatabase(res, tolerance)
+			if handleErr(w, err) {
+				return
+			}
+			if r.URL.Query().Get("format") == "csv" {
+				w.Header().Set("Content-Type", "text/csv")
+				w.Header().Set("Content-Disposition", "attachment; filename=adherence.csv")
+				err = aa.WriteCSV(w)
+			} else {
+				err = sendResponse(w, aa)
+			}
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Route adherence")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleRouteHeadways(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			name, err := getID(r, "name")
+			if handleErr(w, err) {
+				return
+			}
+			now := time.Now()
+			route, _, err := activeRoute(ctx.DB, name, now)
+			if handleErr(w, err) {
+				return
+			}
+			positions, err := RoutePositions(ctx.DB, name, now)
+			if handleErr(w, err) {
+				return
+			}
+			alerts, err := ctx.DB.SelectHeadwayAlerts(name, now.Add(-24*time.Hour), now)
+			if handleErr(w, err) {
+				return
+			}
+			ah := &ApiHeadways{Route: name}
+			thresholds := ctx.Headways
+			if thresholds == nil {
+				thresholds = &Headways{}
+			}
+			ah.Headways = ComputeHeadways(routeLength(route), positions, thresholds.Bunching, thresholds.Gap)
+			err = ah.FromDatabase(alerts)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, ah)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Route headways")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleRouteDetour(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			// detours active now or later by default
+			from, err := getTime(r, "from", time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			to, err := getTime(r, "to", time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectDetours(r.URL.Query().Get("name"), from, to)
+			if handleErr(w, err) {
+				return
+			}
+			ad := &ApiDetours{}
+			err = ad.FromDatabase(res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, ad)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Route detours")
+		case "POST":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			decoder := json.NewDecoder(r.Body)
+			ad := &ApiDetour{}
+			err := decoder.Decode(ad)
+			if handleErr(w, err) {
+				return
+			}
+			detour, err := ad.ToDatabase()
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.InsertDetour(detour)
+			if handleErr(w, err) {
+				return
+			}
+			// the id is needed to end the detour early
+			res := &ApiDetour{}
+			err = res.FromDatabase(detour)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, res)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "POST Route detour")
+		case "DELETE":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			id, err := getIntID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.DeleteDetour(id)
+			if handleErr(w, err) {
+				return
+			}
+			w.Write(Stat(OK, ""))
+			pkg.MeasureTime(start, "DELETE Route detour")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleRouteOffRoute(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			name, err := getID(r, "name")
+			if handleErr(w, err) {
+				return
+			}
+			to, err := getTime(r, "to", time.Now())
+			if handleErr(w, err) {
+				return
+			}
+			from, err := getTime(r, "from", to.Add(-24*time.Hour))
+			if handleErr(w, err) {
+				return
+			}
+			res, err := ctx.DB.SelectOffRouteEvents(name, from, to)
+			if handleErr(w, err) {
+				return
+			}
+			ae := &ApiOffRouteEvents{Route: name}
+			err = ae.FromDatabase(res)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, ae)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "Get Route off-route events")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleAlerts(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			q := r.URL.Query()
+			// a single alert or the alerts of a route or a stop
+			if q.Get("id") != "" {
+				id, err := getIntID(r, "id")
+				if handleErr(w, err) {
+					return
+				}
+				res, err := ctx.DB.SelectServiceAlert(id)
+				if handleErr(w, err) {
+					return
+				}
+				aa := &ApiServiceAlert{}
+				err = aa.FromDatabase(res)
+				if handleErr(w, err) {
+					return
+				}
+				err = sendResponse(w, aa)
+				if handleErr(w, err) {
+					return
+				}
+				pkg.MeasureTime(start, "Get Alert")
+				return
+			}
+			// only the active alerts unless all of them are requested
+			at := time.Now()
+			if q.Get("all") == "true" {
+				at = time.Time{}
+			}
+			res, err := ctx.DB.SelectServiceAlerts(at)
+			if handleErr(w, err) {
+				return
+			}
+			aa := &ApiServiceAlerts{}
+			if route, stop := q.Get("route"), q.Get("stop"); route != "" || stop != "" {
+				aa.Alerts = alertsFor(res, route, stop)
+			} else {
+				err = aa.FromDatabase(res)
+				if handleErr(w, err) {
+					return
+				}
+			}
+			err = sendResponse(w, aa)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, "List Alert")
+		case "POST", "PUT":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			decoder := json.NewDecoder(r.Body)
+			aa := &ApiServiceAlert{}
+			err := decoder.Decode(aa)
+			if handleErr(w, err) {
+				return
+			}
+			alert, err := aa.ToDatabase()
+			if handleErr(w, err) {
+				return
+			}
+			alert.UpdatedAt = time.Now()
+			// PUT replaces the alert with the id, POST creates a new alert
+			if r.Method == "PUT" {
+				err = ctx.DB.UpdateServiceAlert(alert)
+			} else {
+				err = ctx.DB.InsertServiceAlert(alert)
+			}
+			if handleErr(w, err) {
+				return
+			}
+			res := &ApiServiceAlert{}
+			err = res.FromDatabase(alert)
+			if handleErr(w, err) {
+				return
+			}
+			err = sendResponse(w, res)
+			if handleErr(w, err) {
+				return
+			}
+			pkg.MeasureTime(start, r.Method+" Alert")
+		case "DELETE":
+			if !requireToken(w, r, ctx) {
+				return
+			}
+			id, err := getIntID(r, "id")
+			if handleErr(w, err) {
+				return
+			}
+			err = ctx.DB.DeleteServiceAlert(id)
+			if handleErr(w, err) {
+				return
+			}
+			w.Write(Stat(OK, ""))
+			pkg.MeasureTime(start, "DELETE Alert")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+// handleGTFSRealtimeAlerts serves the active service alerts as a GTFS Realtime feed in protocol buffers
+func handleGTFSRealtimeAlerts(ctx *Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		switch r.Method {
+		case "GET":
+			alerts, err := ctx.DB.SelectServiceAlerts(start)
+			if handleErr(w, err) {
+				return
+			}
+			routes, err := ctx.DB.ListClosedRoutes()
+			if handleErr(w, err) {
+				return
+			}
+			names := make([]string, len(routes))
+			for i, route := range routes {
+				names[i] = route.Name
+			}
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Write(GTFSRealtimeAlerts(alerts, names, start))
+			pkg.MeasureTime(start, "Get GTFS Realtime Alerts")
+		default:
+			handleErr(w, fmt.Errorf("%s Method not supported", r.Method))
+		}
+	}
+}
+
+func handleErrWithInfo(w http.ResponseWriter, err error, info string) bool {
+	if err != nil {
+		w.Write(Stat(ERROR, err.Error()+info))
+		return true
+	}
+	return false
+}
+
+func handleErr(w http.ResponseWriter, err error) bool {
+	return handleErrWithInfo(w, err, "")
+}
+
+func getID(r *http.Request, id string) (string, error) {
+	q := r.URL.Query()
+	str := q.Get(id)
+	if str == "" {
+		return "", errors.New("Invalid ID")
+	}
+	return str, nil
+}
+
+// getIntID parses a numeric id in the query
+func getIntID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid ID")
+	}
+	return id, nil
+}
+
+// getTime parses an optional RFC3339 time in the query, def is returned if it's missing
+func getTime(r *http.Request, name string, def time.Time) (time.Time, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return t, fmt.Errorf("Invalid time '%s'", name)
+	}
+	return t, nil
+}
+
+// requireToken rejects the request if it's not authenticated, returns true if it is
+func requireToken(w http.ResponseWriter, r *http.Request, ctx *Context) bool {
+	if validateToken(r, ctx.Token) {
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	handleErr(w, errors.New("Invalid token"))
+	return false
+}
+
+// getDate parses the date query formatted as YYYY-MM-DD in the location, def is returned if missing
+func getDate(r *http.Request, name string, loc *time.Location, def time.Time) (time.Time, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", str, loc)
+	if err != nil {
+		return t, fmt.Errorf("Invalid date '%s'", name)
+	}
+	return t, nil
+}
+
+// validateToken checks the token of the request given as "Authorization: Bearer <token>", it's never read
+// from the query which ends up in access logs. Requests are always rejected if no token is configured.
+func validateToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	got := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
 }
 
 func sendResponse(w http.ResponseWriter, obj interface{}) error {
@@ -130,11 +1239,31 @@ func sendResponse(w http.ResponseWriter, obj interface{}) error {
 }
 
 func Run(ctx *Context, config *Config) {
-	fmt.Println("Running Shuttle server\n")
+	fmt.Println("Running Shuttle server")
 	// initialize router
 	http.HandleFunc("/v1/shuttle", handleLog(ctx))
 	http.HandleFunc("/v1/route", handleRoute(ctx))
+	http.HandleFunc("/v1/route/traveltimes", handleRouteTravelTimes(ctx))
+	http.HandleFunc("/v1/route/schedule", handleRouteSchedule(ctx))
+	http.HandleFunc("/v1/route/adherence", handleRouteAdherence(ctx))
+	http.HandleFunc("/v1/route/headways", handleRouteHeadways(ctx))
+	http.HandleFunc("/v1/route/detour", handleRouteDetour(ctx))
+	http.HandleFunc("/v1/route/offroute", handleRouteOffRoute(ctx))
+	http.HandleFunc("/v1/alerts", handleAlerts(ctx))
+	http.HandleFunc("/v1/alerts/gtfs-rt", handleGTFSRealtimeAlerts(ctx))
+	http.HandleFunc("/v1/calendar", handleCalendar(ctx))
+	http.HandleFunc("/v1/calendar/import", handleCalendarImport(ctx))
+	http.HandleFunc("/v1/quarantine", handleQuarantine(ctx))
+	http.HandleFunc("/v1/ingest", handleIngest(ctx))
+	http.HandleFunc("/v1/leader", handleLeader(ctx))
+	http.HandleFunc("/v1/stream", handleStream(ctx))
+	http.HandleFunc("/v1/vehicle", handleVehicle(ctx))
+	http.HandleFunc("/v1/vehicle/assignments", handleVehicleAssignments(ctx))
+	http.HandleFunc("/v1/vehicle/states", handleVehicleStates(ctx))
+	http.HandleFunc("/v1/stop", handleStop(ctx))
+	http.HandleFunc("/v1/stop/events", handleStopEvents(ctx))
+	http.HandleFunc("/v1/stop/predictions", handleStopPredictions(ctx))
 	log.Fatal(http.ListenAndServe(config.LocalURL, nil))
 
-	fmt.Println("End Shuttle server\n")
+	fmt.Println("End Shuttle server")
 }
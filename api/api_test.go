@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// recordingIngester keeps the logs ingested through the api
+type recordingIngester struct {
+	logs []database.ShuttleLog
+}
+
+func (ri *recordingIngester) Ingest(logs []database.ShuttleLog) error {
+	ri.logs = append(ri.logs, logs...)
+	return nil
+}
+
+func (ri *recordingIngester) IngestText(body []byte) (int, error) {
+	return 0, nil
+}
+
+func TestHandleIngest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code int
+		ok   bool
+	}{
+		{"valid", `[{"id": "1", "location": {"x": -73.67, "y": 42.73}}]`, http.StatusOK, true},
+		{"missing location", `{"id": "1"}`, http.StatusOK, false},
+		{"latitude out of range", `[{"id": "1", "location": {"x": -73.67, "y": 42.73}}, {"id": "2", "location": {"x": -73.67, "y": 142.73}}]`, http.StatusOK, false},
+		{"longitude out of range", `{"id": "1", "location": {"x": -273.67, "y": 42.73}}`, http.StatusOK, false},
+		{"too large", `[{"id": "1", "location": {"x": -73.67, "y": 42.73}}` + strings.Repeat(" ", 200) + `]`, http.StatusRequestEntityTooLarge, false},
+	}
+	for _, test := range tests {
+		ingester := &recordingIngester{}
+		ctx := &Context{Ingester: ingester, Token: "token", MaxIngestBytes: 200}
+		r := httptest.NewRequest("POST", "/v1/ingest", strings.NewReader(test.body))
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		handleIngest(ctx)(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.code)
+		}
+		if ok := !strings.Contains(w.Body.String(), `"_stat":"error"`); ok != test.ok {
+			t.Errorf("%s: got response %s", test.name, w.Body.String())
+		}
+		if test.ok != (len(ingester.logs) > 0) {
+			t.Errorf("%s: ingested %d logs", test.name, len(ingester.logs))
+		}
+	}
+}
+
+func TestHandleLeaderWithoutLease(t *testing.T) {
+	ctx := &Context{DB: &database.MockDatabase{}, InstanceID: "a"}
+	w := httptest.NewRecorder()
+	handleLeader(ctx)(w, httptest.NewRequest("GET", "/v1/leader", nil))
+	al := &ApiLeader{}
+	if err := json.Unmarshal(w.Body.Bytes(), al); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || al.Response == ERROR || al.Leader != "" || al.IsLeader || al.Instance != "a" {
+		t.Errorf("got status %d and response %s, want no leader", w.Code, w.Body.String())
+	}
+}
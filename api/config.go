@@ -3,6 +3,9 @@ package api
 import (
 	"encoding/json"
 	"os"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
 )
 
 type Config struct {
@@ -11,6 +14,147 @@ type Config struct {
 	DbSrc           string `json:"db_src"`
 	LocalURL        string `json:"local_url"`
 	UpdaterInterval int    `json:"updater_interval"`
+	APIToken        string `json:"api_token"`
+	// number of workers processing the shuttle logs
+	UpdaterConcurrency int `json:"updater_concurrency"`
+	// write buffer used while the database is unavailable
+	BufferSize       int    `json:"buffer_size"`
+	BufferSpillFile  string `json:"buffer_spill_file"`
+	BufferSpillLimit int    `json:"buffer_spill_limit"`
+	// largest body in bytes accepted by /v1/ingest, defaults to 1 MB
+	MaxIngestBytes int64 `json:"max_ingest_bytes"`
+	// fixes implying a higher speed in mph or outside of the service area are quarantined
+	MaxSpeed    float64 `json:"max_speed"`
+	ServiceArea *Bounds `json:"service_area"`
+	// apply a Kalman filter to the incoming fixes
+	Smoothing bool `json:"smoothing"`
+	// addresses to receive the remote feed records streamed by the devices, empty to disable
+	TCPListen string `json:"tcp_listen"`
+	UDPListen string `json:"udp_listen"`
+	// "strict" fails a whole feed on a malformed record, "lenient" (default) skips the record
+	ParserMode string `json:"parser_mode"`
+	// identity of the instance in the leader election, defaults to hostname and pid
+	InstanceID string `json:"instance_id"`
+	// seconds before the lease of the leader expires if it's not renewed
+	LeaderLease int `json:"leader_lease"`
+	// additional sources polled with remote_url
+	Feeds []Feed `json:"feeds"`
+	// assign the vehicles to the routes matching their fixes, nil to disable
+	RouteMatching *RouteMatching `json:"route_matching"`
+	// detect the arrivals and departures at the stops of the routes of the vehicles, nil to disable
+	StopDetection *StopDetection `json:"stop_detection"`
+	// learn the travel times between the stops to predict the arrivals, nil to predict from the speed
+	TravelTimes *TravelTimes `json:"travel_times"`
+	// time zone of the schedules, e.g. "America/New_York", defaults to UTC
+	TimeZone string `json:"timezone"`
+	// compare the detected arrivals to the schedules, nil to disable
+	Adherence *Adherence `json:"adherence"`
+	// monitor the headways between the vehicles of a route, nil to disable the alerts
+	Headways *Headways `json:"headways"`
+	// record the vehicles away from their route, nil to disable
+	OffRoute *OffRoute `json:"off_route"`
+	// track the state of the vehicles, nil to disable it
+	VehicleStates *VehicleStates `json:"vehicle_states"`
+}
+
+// RouteMatching configures the automatic route assignment
+type RouteMatching struct {
+	// number of recent fixes of a vehicle matched against the routes
+	Window int `json:"window"`
+	// meters from a route for a fix to be on it
+	MaxDistance float64 `json:"max_distance"`
+	// share of the recent fixes on a route required to assign it
+	MinConfidence float64 `json:"min_confidence"`
+	// consecutive fixes a route must be the best fit before it's assigned
+	SwitchAfter int `json:"switch_after"`
+}
+
+// StopDetection configures the geofences of the stops
+type StopDetection struct {
+	// meters from a stop for a vehicle to arrive at it
+	Radius float64 `json:"radius"`
+	// meters from a stop for a vehicle to depart from it, defaults to 1.5 times the radius
+	ExitRadius float64 `json:"exit_radius"`
+}
+
+// TravelTimes configures the model of the travel times between the stops
+type TravelTimes struct {
+	// minutes between two rebuilds of the model
+	Interval int `json:"interval"`
+	// days of shuttle logs used
+	History int `json:"history"`
+	// time zone of the hours and days of the week, defaults to the time zone of the schedules
+	TimeZone string `json:"timezone"`
+}
+
+// Adherence configures the comparison of the arrivals to the schedules
+type Adherence struct {
+	// seconds from a scheduled visit for an arrival to be matched to it
+	Window int `json:"window"`
+	// seconds early and late an arrival is still on time, defaults to 60 and 300
+	Early int `json:"early"`
+	Late  int `json:"late"`
+}
+
+// Tolerance returns when an arrival is on time, hours are in the location
+func (a *Adherence) Tolerance(location *time.Location) *database.AdherenceTolerance {
+	tolerance := defaultTolerance
+	tolerance.Location = location
+	if a.Early > 0 {
+		tolerance.Early = time.Duration(a.Early) * time.Second
+	}
+	if a.Late > 0 {
+		tolerance.Late = time.Duration(a.Late) * time.Second
+	}
+	return &tolerance
+}
+
+// Headways configures the distances between the vehicles of a route raising alerts
+type Headways struct {
+	// meters to the vehicle ahead below which the vehicles are bunching, 0 to disable
+	Bunching float64 `json:"bunching"`
+	// meters to the vehicle ahead above which there is a gap in the service, 0 to disable
+	Gap float64 `json:"gap"`
+}
+
+// OffRoute configures when a vehicle is off its route
+type OffRoute struct {
+	// meters from the route, 0 for the default
+	Distance float64 `json:"distance"`
+	// seconds the vehicle must stay off the route, 0 for the default
+	Duration int `json:"duration"`
+}
+
+// VehicleStates configures the state machine of the vehicles, in seconds, 0 for the defaults
+type VehicleStates struct {
+	// without fix for this time a vehicle is stale
+	StaleAfter int `json:"stale_after"`
+	// stopped away from the stops for this time a vehicle is parked
+	ParkedAfter int `json:"parked_after"`
+	// interval of the checks of the stale and parked vehicles
+	Interval int `json:"interval"`
+}
+
+// Feed is a remote source of shuttle logs
+type Feed struct {
+	Name      string `json:"name"`
+	RemoteURL string `json:"remote_url"`
+	// only breaks ties: the freshest fix of a vehicle wins whatever its feed, the fix of the feed with
+	// the lowest priority wins when two feeds report the vehicle at the same fix time
+	Priority int `json:"priority"`
+}
+
+// Bounds is a rectangle of longitudes (x) and latitudes (y)
+type Bounds struct {
+	MinX float64 `json:"min_x"`
+	MinY float64 `json:"min_y"`
+	MaxX float64 `json:"max_x"`
+	MaxY float64 `json:"max_y"`
+}
+
+// Contains tells if the point is inside of the bounds
+func (b *Bounds) Contains(x, y float64) bool {
+	return x >= b.MinX && x <= b.MaxX && y >= b.MinY && y <= b.MaxY
 }
 
 func Loadconfig(str string) *Config {
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// activeRoute selects the route by name with the points of its detour active at the time, the detour is
+// nil if the route is followed
+func activeRoute(db database.Database, name string, at time.Time) (*database.ClosedRoute, *database.Detour, error) {
+	route, err := db.SelectClosedRoute(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	detours, err := db.SelectDetours(name, at, at)
+	if err != nil {
+		return nil, nil, err
+	}
+	var active *database.Detour
+	for _, d := range detours {
+		if d.ActiveAt(at) && (active == nil || !d.StartsAt.Before(active.StartsAt)) {
+			active = d
+		}
+	}
+	if active == nil {
+		return route, nil, nil
+	}
+	return active.Apply(route), active, nil
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// field numbers of the GTFS Realtime messages, see https://gtfs.org/realtime/reference/
+const (
+	feedMessageHeader        = 1
+	feedMessageEntity        = 2
+	feedHeaderVersion        = 1
+	feedHeaderIncrementality = 2
+	feedHeaderTimestamp      = 3
+	feedEntityID             = 1
+	feedEntityAlert          = 5
+	alertActivePeriod        = 1
+	alertInformedEntity      = 5
+	alertURL                 = 8
+	alertHeaderText          = 10
+	alertDescriptionText     = 11
+	alertSeverityLevel       = 14
+	timeRangeStart           = 1
+	timeRangeEnd             = 2
+	entitySelectorRouteID    = 2
+	entitySelectorStopID     = 5
+	translatedTranslation    = 1
+	translationText          = 1
+)
+
+// values of the GTFS Realtime enums
+const (
+	gtfsrtFullDataset     = 0
+	gtfsrtUnknownSeverity = 1
+	gtfsrtInfo            = 2
+	gtfsrtWarning         = 3
+	gtfsrtSevere          = 4
+)
+
+// protoMessage encodes a protocol buffers message, the fields are written in the order they're added
+type protoMessage []byte
+
+func (m *protoMessage) uvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	*m = append(*m, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// key writes the field number with the wire type, 0 for a varint and 2 for bytes
+func (m *protoMessage) key(field int, wireType uint64) {
+	m.uvarint(uint64(field)<<3 | wireType)
+}
+
+func (m *protoMessage) varint(field int, v uint64) {
+	m.key(field, 0)
+	m.uvarint(v)
+}
+
+func (m *protoMessage) bytes(field int, b []byte) {
+	m.key(field, 2)
+	m.uvarint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// string skips the empty strings, as the unset optional fields
+func (m *protoMessage) string(field int, s string) {
+	if s != "" {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// translated writes a TranslatedString with a single translation, nothing if the text is empty
+func (m *protoMessage) translated(field int, text string) {
+	if text == "" {
+		return
+	}
+	translation := protoMessage{}
+	translation.string(translationText, text)
+	translated := protoMessage{}
+	translated.bytes(translatedTranslation, translation)
+	m.bytes(field, translated)
+}
+
+// GTFSRealtimeAlerts encodes the service alerts as a GTFS Realtime feed message. The routes are identified
+// by name and the stops by external id, an alert of the whole service informs all the routes.
+func GTFSRealtimeAlerts(alerts []*database.ServiceAlert, routes []string, now time.Time) []byte {
+	header := protoMessage{}
+	header.string(feedHeaderVersion, "2.0")
+	header.varint(feedHeaderIncrementality, gtfsrtFullDataset)
+	header.varint(feedHeaderTimestamp, uint64(now.Unix()))
+	feed := protoMessage{}
+	feed.bytes(feedMessageHeader, header)
+	for _, a := range alerts {
+		alert := protoMessage{}
+		for _, p := range a.Periods {
+			period := protoMessage{}
+			period.varint(timeRangeStart, uint64(p.Start.Unix()))
+			if !p.End.IsZero() {
+				period.varint(timeRangeEnd, uint64(p.End.Unix()))
+			}
+			alert.bytes(alertActivePeriod, period)
+		}
+		informed := a.Routes
+		if len(a.Routes) == 0 && len(a.Stops) == 0 {
+			informed = routes
+		}
+		for _, name := range informed {
+			selector := protoMessage{}
+			selector.string(entitySelectorRouteID, name)
+			alert.bytes(alertInformedEntity, selector)
+		}
+		for _, id := range a.Stops {
+			selector := protoMessage{}
+			selector.string(entitySelectorStopID, id)
+			alert.bytes(alertInformedEntity, selector)
+		}
+		alert.translated(alertURL, a.URL)
+		alert.translated(alertHeaderText, a.Header)
+		alert.translated(alertDescriptionText, a.Description)
+		alert.varint(alertSeverityLevel, gtfsrtSeverity(a.Severity))
+		entity := protoMessage{}
+		entity.string(feedEntityID, strconv.FormatInt(a.ID, 10))
+		entity.bytes(feedEntityAlert, alert)
+		feed.bytes(feedMessageEntity, entity)
+	}
+	return feed
+}
+
+// gtfsrtSeverity converts the severity of an alert to the GTFS Realtime severity level
+func gtfsrtSeverity(severity string) uint64 {
+	switch severity {
+	case database.SeverityInfo:
+		return gtfsrtInfo
+	case database.SeverityWarning:
+		return gtfsrtWarning
+	case database.SeveritySevere:
+		return gtfsrtSevere
+	}
+	return gtfsrtUnknownSeverity
+}
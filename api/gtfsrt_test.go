@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// decodeProto decodes the varint and bytes fields of a protocol buffers message by field number
+func decodeProto(t *testing.T, b []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad key in %x", b)
+		}
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad value in %x", b)
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			fields[field] = append(fields[field], v)
+		case 2:
+			fields[field] = append(fields[field], b[:v])
+			b = b[v:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// text returns the text of the first translation of a TranslatedString
+func text(t *testing.T, b interface{}) string {
+	translation := decodeProto(t, b.([]byte))[translatedTranslation][0]
+	return string(decodeProto(t, translation.([]byte))[translationText][0].([]byte))
+}
+
+func TestGTFSRealtimeAlerts(t *testing.T) {
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	alerts := []*database.ServiceAlert{
+		{Model: database.Model{ID: 7}, Severity: database.SeveritySevere, Header: "Route A suspended due to snow",
+			Routes: []string{"A"}, Stops: []string{"s1"},
+			Periods: []database.AlertPeriod{{Start: now.Add(-time.Hour)}}},
+		{Model: database.Model{ID: 8}, Header: "Holiday service", Description: "Reduced frequency"},
+	}
+	feed := decodeProto(t, GTFSRealtimeAlerts(alerts, []string{"A", "B"}, now))
+	header := decodeProto(t, feed[feedMessageHeader][0].([]byte))
+	if string(header[feedHeaderVersion][0].([]byte)) != "2.0" || header[feedHeaderTimestamp][0] != uint64(now.Unix()) {
+		t.Errorf("got header %v", header)
+	}
+	entities := feed[feedMessageEntity]
+	if len(entities) != 2 {
+		t.Fatalf("got %d entities, want 2", len(entities))
+	}
+
+	entity := decodeProto(t, entities[0].([]byte))
+	if string(entity[feedEntityID][0].([]byte)) != "7" {
+		t.Errorf("got entity id %s, want 7", entity[feedEntityID][0])
+	}
+	alert := decodeProto(t, entity[feedEntityAlert][0].([]byte))
+	period := decodeProto(t, alert[alertActivePeriod][0].([]byte))
+	if period[timeRangeStart][0] != uint64(now.Add(-time.Hour).Unix()) || len(period[timeRangeEnd]) != 0 {
+		t.Errorf("got period %v, want an open period from an hour ago", period)
+	}
+	informed := alert[alertInformedEntity]
+	if len(informed) != 2 || string(decodeProto(t, informed[0].([]byte))[entitySelectorRouteID][0].([]byte)) != "A" ||
+		string(decodeProto(t, informed[1].([]byte))[entitySelectorStopID][0].([]byte)) != "s1" {
+		t.Errorf("got informed entities %v, want route A and stop s1", informed)
+	}
+	if got := text(t, alert[alertHeaderText][0]); got != "Route A suspended due to snow" {
+		t.Errorf("got header %q", got)
+	}
+	if alert[alertSeverityLevel][0] != uint64(gtfsrtSevere) || len(alert[alertDescriptionText]) != 0 {
+		t.Errorf("got severity %v and description %v", alert[alertSeverityLevel], alert[alertDescriptionText])
+	}
+
+	// the whole service informs every route
+	alert = decodeProto(t, decodeProto(t, entities[1].([]byte))[feedEntityAlert][0].([]byte))
+	if len(alert[alertInformedEntity]) != 2 || len(alert[alertActivePeriod]) != 0 {
+		t.Errorf("got %d informed entities and %d periods, want 2 and none", len(alert[alertInformedEntity]), len(alert[alertActivePeriod]))
+	}
+	if text(t, alert[alertDescriptionText][0]) != "Reduced frequency" || alert[alertSeverityLevel][0] != uint64(gtfsrtUnknownSeverity) {
+		t.Errorf("got description %v severity %v", alert[alertDescriptionText], alert[alertSeverityLevel])
+	}
+}
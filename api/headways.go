@@ -0,0 +1,79 @@
+package api
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// VehiclePosition is the position of a vehicle along its route
+type VehiclePosition struct {
+	VehicleID string
+	// meters from the start of the route
+	Along float64
+	// meters per second
+	Speed   float64
+	FixTime time.Time
+}
+
+// ComputeHeadways computes the distance of every vehicle to the vehicle ahead of it on a loop of the
+// length, the headway is flagged as bunching below bunching meters and as gap above gap meters, a zero
+// threshold is ignored. A vehicle alone on the loop has no headway.
+func ComputeHeadways(length float64, positions []VehiclePosition, bunching, gap float64) []ApiHeadway {
+	headways := []ApiHeadway{}
+	if len(positions) < 2 || length <= 0 {
+		return headways
+	}
+	sorted := append([]VehiclePosition{}, positions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Along < sorted[j].Along })
+	for i, p := range sorted {
+		ahead := sorted[(i+1)%len(sorted)]
+		distance := math.Mod(ahead.Along-p.Along+length, length)
+		h := ApiHeadway{
+			VehicleID: p.VehicleID,
+			AheadID:   ahead.VehicleID,
+			Distance:  distance,
+			Seconds:   distance / math.Max(p.Speed, minPredictionSpeed),
+			Status:    "ok",
+		}
+		if bunching > 0 && distance < bunching {
+			h.Status = database.HeadwayBunching
+		} else if gap > 0 && distance > gap {
+			h.Status = database.HeadwayGap
+		}
+		headways = append(headways, h)
+	}
+	return headways
+}
+
+// RoutePositions selects the positions of the active vehicles assigned to the route with a recent fix
+func RoutePositions(db database.Database, routeName string, now time.Time) ([]VehiclePosition, error) {
+	vehicles, err := db.ListVehicles()
+	if err != nil {
+		return nil, err
+	}
+	positions := []VehiclePosition{}
+	for _, vehicle := range vehicles {
+		if !vehicle.Active || vehicle.RouteName != routeName {
+			continue
+		}
+		log, err := db.SelectLatestLog(vehicle.VehicleID)
+		if err != nil || log.Snapped == nil || log.RouteName != routeName || now.Sub(log.FixTime) > maxPredictionAge {
+			continue
+		}
+		positions = append(positions, VehiclePosition{vehicle.VehicleID, log.RouteDistance, log.Location.Speed / pkg.MetersPerSecondToMph, log.FixTime})
+	}
+	return positions, nil
+}
+
+// routeLength is the length of the closed path of the route in meters
+func routeLength(route *database.ClosedRoute) float64 {
+	path := make([]pkg.Point, len(route.RoutePoints))
+	for i, v := range route.RoutePoints {
+		path[i] = pkg.Point{X: v.X, Y: v.Y}
+	}
+	return pkg.PathLength(path, true)
+}
@@ -2,8 +2,21 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
 
 	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+const (
+	// positions are not extrapolated further than this from the last fix
+	maxExtrapolation = time.Minute
+	// a fix which wasn't snapped is extrapolated along the route of the vehicle within this many meters
+	maxExtrapolationOffset = 50.0
 )
 
 type ResStat struct {
@@ -12,7 +25,31 @@ type ResStat struct {
 }
 
 type Context struct {
-	DB database.Database
+	DB       database.Database
+	Ingester Ingester
+	// token required by the authenticated requests
+	Token string
+	// identity of this instance in the leader election
+	InstanceID string
+	// usual travel times between the stops, nil to predict the arrivals from the speed only
+	SegmentTimes SegmentTimes
+	// time zone of the schedules
+	Location *time.Location
+	// when an arrival is on time in the adherence reports
+	Tolerance *database.AdherenceTolerance
+	// thresholds of the headways, nil to not flag them
+	Headways *Headways
+	// live events sent to the clients of /v1/stream
+	Stream *Stream
+	// largest body accepted by /v1/ingest, defaults to 1 MB
+	MaxIngestBytes int64
+}
+
+// Ingester takes the shuttle logs pushed to the api through the updater pipeline
+type Ingester interface {
+	Ingest([]database.ShuttleLog) error
+	// ingest logs in the remote feed text format, returns the number of logs
+	IngestText([]byte) (int, error)
 }
 
 type ApiVector struct {
@@ -25,9 +62,324 @@ type ApiVector struct {
 type ApiShuttleLog struct {
 	ResStat
 
+	VehicleID       string     `json:"id"`
+	Location        ApiVector  `json:"location"`
+	Status          string     `json:"stat"`
+	Time            time.Time  `json:"time"`
+	StationarySince *time.Time `json:"stationary_since,omitempty"`
+	Predicted       *ApiVector `json:"predicted,omitempty"`
+	Source          string     `json:"source,omitempty"`
+	// meta data of the vehicle, omitted if the vehicle is not registered
+	Vehicle *ApiVehicleMeta `json:"vehicle,omitempty"`
+	// location snapped to the route of the vehicle, its distance in meters along the route and
+	// the percentage of the route it represents, omitted if the vehicle has no route
+	Route         string     `json:"route,omitempty"`
+	Snapped       *ApiVector `json:"snapped,omitempty"`
+	RouteDistance *float64   `json:"route_distance,omitempty"`
+	Progress      *float64   `json:"progress,omitempty"`
+
+	// points of the route and distance of the fix along it, set by OnRoute
+	path  []pkg.Point
+	along float64
+	start pkg.Point
+}
+
+// ApiStreamChange is the data of the change events of the live stream
+type ApiStreamChange struct {
+	Key string `json:"key"`
+}
+
+// ApiStreamStopEvent is the data of the stop events of the live stream
+type ApiStreamStopEvent struct {
+	StopID string `json:"stop"`
+	ApiStopEvent
+}
+
+type ApiVehicleMeta struct {
+	VehicleID     string   `json:"id"`
+	Name          string   `json:"name"`
+	Capacity      int      `json:"capacity"`
+	Accessibility []string `json:"accessibility"`
+	Plate         string   `json:"plate"`
+	Active        *bool    `json:"active"`
+	Route         string   `json:"route"`
+	// set by the automatic route assignment
+	RouteConfidence float64    `json:"route_confidence"`
+	RouteAssignedAt *time.Time `json:"route_assigned_at,omitempty"`
+	// set by the state machine of the vehicles, ignored in the requests
+	State      string     `json:"state,omitempty"`
+	StateSince *time.Time `json:"state_since,omitempty"`
+}
+
+type ApiRouteAssignment struct {
+	Route      string    `json:"route"`
+	Confidence float64   `json:"confidence"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+type ApiRouteAssignments struct {
+	ResStat
+
+	VehicleID   string               `json:"id"`
+	Assignments []ApiRouteAssignment `json:"assignments"`
+}
+
+type ApiVehicleState struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+type ApiVehicleStates struct {
+	ResStat
+
+	VehicleID   string            `json:"id"`
+	Transitions []ApiVehicleState `json:"transitions"`
+	// seconds spent in each state in the time range, from the first transition
+	Durations map[string]float64 `json:"durations"`
+}
+
+type ApiVehicle struct {
+	ResStat
+	ApiVehicleMeta
+}
+
+type ApiVehicleList struct {
+	ResStat
+
+	Vehicles []ApiVehicleMeta `json:"vehicles"`
+}
+
+type ApiStopMeta struct {
+	StopID   string    `json:"id"`
+	Name     string    `json:"name"`
+	Route    string    `json:"route"`
+	Location ApiVector `json:"location"`
+	// active service alerts of the stop and its route, only in the responses
+	Alerts []ApiServiceAlertMeta `json:"alerts,omitempty"`
+}
+
+type ApiStop struct {
+	ResStat
+	ApiStopMeta
+}
+
+type ApiStopList struct {
+	ResStat
+
+	Route string        `json:"route"`
+	Stops []ApiStopMeta `json:"stops"`
+}
+
+type ApiStopEvent struct {
+	VehicleID  string     `json:"vehicle"`
+	Route      string     `json:"route"`
+	ArrivedAt  time.Time  `json:"arrived_at"`
+	DepartedAt *time.Time `json:"departed_at,omitempty"`
+	// seconds spent at the stop, 0 while the vehicle is at the stop
+	Dwell float64 `json:"dwell"`
+	// scheduled visit matched to the arrival and the seconds the arrival was late, omitted if unscheduled
+	Trip        string     `json:"trip,omitempty"`
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	Deviation   *float64   `json:"deviation,omitempty"`
+}
+
+type ApiStopEvents struct {
+	ResStat
+
+	StopID string         `json:"stop"`
+	Events []ApiStopEvent `json:"events"`
+}
+
+type ApiStopPrediction struct {
+	VehicleID string    `json:"vehicle"`
+	Route     string    `json:"route"`
+	ETA       time.Time `json:"eta"`
+	// seconds and meters along the route to the stop
+	Seconds  float64 `json:"seconds"`
+	Distance float64 `json:"distance"`
+	// confidence in [0, 1] of the prediction and its level, "high", "medium" or "low"
+	Confidence float64 `json:"confidence"`
+	Level      string  `json:"level"`
+	// whether the usual travel times between the stops were used
+	Historical bool `json:"historical"`
+}
+
+type ApiStopPredictions struct {
+	ResStat
+
+	StopID      string              `json:"stop"`
+	Predictions []ApiStopPrediction `json:"predictions"`
+}
+
+type ApiSegmentTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// day of the week from 0 (sunday) to 6 and hour of the departure
+	Weekday int `json:"weekday"`
+	Hour    int `json:"hour"`
+	// median travel time in seconds
+	TravelTime float64   `json:"travel_time"`
+	Samples    int       `json:"samples"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type ApiSegmentTimes struct {
+	ResStat
+
+	Route    string           `json:"route"`
+	Segments []ApiSegmentTime `json:"segments"`
+}
+
+type ApiCalendarException struct {
+	// YYYY-MM-DD
+	Date  string `json:"date"`
+	Added bool   `json:"added"`
+}
+
+type ApiCalendar struct {
+	ResStat
+
+	ServiceID string   `json:"service_id"`
+	Days      []string `json:"days"`
+	// YYYY-MM-DD, empty if unbounded
+	StartDate  string                 `json:"start_date"`
+	EndDate    string                 `json:"end_date"`
+	Exceptions []ApiCalendarException `json:"exceptions"`
+}
+
+type ApiStopTime struct {
+	StopID string `json:"stop"`
+	// HH:MM:SS from the midnight of the service day, may exceed 24:00:00
+	Arrival   string `json:"arrival"`
+	Departure string `json:"departure"`
+}
+
+type ApiTrip struct {
+	TripID    string        `json:"id"`
+	ServiceID string        `json:"service"`
+	Headsign  string        `json:"headsign"`
+	StopTimes []ApiStopTime `json:"stop_times"`
+}
+
+type ApiTrips struct {
+	ResStat
+
+	Route string    `json:"route"`
+	Trips []ApiTrip `json:"trips"`
+}
+
+type ApiScheduledStopTime struct {
+	StopID    string    `json:"stop"`
+	Arrival   time.Time `json:"arrival"`
+	Departure time.Time `json:"departure"`
+}
+
+type ApiScheduledTrip struct {
+	TripID    string                 `json:"id"`
+	ServiceID string                 `json:"service"`
+	Headsign  string                 `json:"headsign"`
+	StopTimes []ApiScheduledStopTime `json:"stop_times"`
+}
+
+type ApiSchedule struct {
+	ResStat
+
+	Route string             `json:"route"`
+	Date  string             `json:"date"`
+	Trips []ApiScheduledTrip `json:"trips"`
+}
+
+type ApiImport struct {
+	ResStat
+
+	Imported int `json:"imported"`
+}
+
+type ApiAdherenceRow struct {
+	Route string `json:"route"`
+	Stop  string `json:"stop,omitempty"`
+	Hour  *int   `json:"hour,omitempty"`
+	// arrivals matched to the schedule and how many were on time, early or late
+	Arrivals      int     `json:"arrivals"`
+	OnTime        int     `json:"on_time"`
+	Early         int     `json:"early"`
+	Late          int     `json:"late"`
+	OnTimePercent float64 `json:"on_time_percent"`
+	// mean deviation from the schedule in seconds, positive when late
+	MeanDeviation float64 `json:"mean_deviation"`
+}
+
+type ApiAdherence struct {
+	ResStat
+
+	Route string    `json:"route"`
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	// seconds early and late an arrival is still on time
+	Early  float64           `json:"early"`
+	Late   float64           `json:"late"`
+	Routes []ApiAdherenceRow `json:"routes"`
+	Stops  []ApiAdherenceRow `json:"stops"`
+	Hours  []ApiAdherenceRow `json:"hours"`
+}
+
+type ApiHeadway struct {
+	VehicleID string `json:"vehicle"`
+	AheadID   string `json:"ahead"`
+	// meters along the route to the vehicle ahead and the seconds to cover them at the speed of the vehicle
+	Distance float64 `json:"distance"`
+	Seconds  float64 `json:"seconds"`
+	// "ok", "bunching" or "gap"
+	Status string `json:"status"`
+}
+
+type ApiHeadwayAlert struct {
+	Kind       string     `json:"kind"`
+	VehicleID  string     `json:"vehicle"`
+	AheadID    string     `json:"ahead"`
+	Distance   float64    `json:"distance"`
+	RaisedAt   time.Time  `json:"raised_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+type ApiHeadways struct {
+	ResStat
+
+	Route    string            `json:"route"`
+	Headways []ApiHeadway      `json:"headways"`
+	Alerts   []ApiHeadwayAlert `json:"alerts"`
+}
+
+type ApiIngest struct {
+	ResStat
+
+	Received int `json:"received"`
+}
+
+type ApiLeader struct {
+	ResStat
+
+	Leader     string    `json:"leader"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Instance   string    `json:"instance"`
+	IsLeader   bool      `json:"is_leader"`
+}
+
+type ApiQuarantinedLog struct {
 	VehicleID string    `json:"id"`
 	Location  ApiVector `json:"location"`
 	Status    string    `json:"stat"`
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ApiQuarantine struct {
+	ResStat
+
+	Logs []ApiQuarantinedLog `json:"logs"`
 }
 
 type ApiClosedRoute struct {
@@ -35,6 +387,74 @@ type ApiClosedRoute struct {
 
 	Locations []ApiVector `json:"location"`
 	Name      string      `json:"name"`
+	// detour replacing the locations of the route and active service alerts, only in the responses
+	Detour *ApiDetourMeta        `json:"detour,omitempty"`
+	Alerts []ApiServiceAlertMeta `json:"alerts,omitempty"`
+}
+
+type ApiDetourMeta struct {
+	ID        int64       `json:"id"`
+	Route     string      `json:"route"`
+	Locations []ApiVector `json:"location"`
+	StartsAt  time.Time   `json:"starts_at"`
+	EndsAt    time.Time   `json:"ends_at"`
+	Reason    string      `json:"reason"`
+}
+
+type ApiDetour struct {
+	ResStat
+	ApiDetourMeta
+}
+
+type ApiDetours struct {
+	ResStat
+
+	Detours []ApiDetourMeta `json:"detours"`
+}
+
+type ApiAlertPeriod struct {
+	Start time.Time `json:"start"`
+	// omitted if the period never ends
+	End *time.Time `json:"end,omitempty"`
+}
+
+type ApiServiceAlertMeta struct {
+	ID          int64  `json:"id"`
+	Severity    string `json:"severity"`
+	Header      string `json:"header"`
+	Description string `json:"description"`
+	URL         string `json:"url,omitempty"`
+	// the whole service if no route and no stop is affected
+	Routes []string `json:"routes"`
+	Stops  []string `json:"stops"`
+	// always active without periods
+	Periods   []ApiAlertPeriod `json:"periods"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+type ApiServiceAlert struct {
+	ResStat
+	ApiServiceAlertMeta
+}
+
+type ApiServiceAlerts struct {
+	ResStat
+
+	Alerts []ApiServiceAlertMeta `json:"alerts"`
+}
+
+type ApiOffRouteEvent struct {
+	VehicleID   string     `json:"vehicle"`
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	MaxDistance float64    `json:"max_distance"`
+}
+
+type ApiOffRouteEvents struct {
+	ResStat
+
+	Route  string             `json:"route"`
+	Events []ApiOffRouteEvent `json:"events"`
 }
 
 func Stat(status, information string) []byte {
@@ -88,8 +508,504 @@ func (p *ApiVector) ToDatabase() (*database.Vector, error) {
 func (alog *ApiShuttleLog) FromDatabase(log *database.ShuttleLog) error {
 	alog.VehicleID = log.VehicleID
 	alog.Status = log.Status
+	alog.Time = log.FixTime
+	alog.Source = log.Source
+	if !log.StationaryUntil.IsZero() {
+		since := log.FixTime
+		alog.StationarySince = &since
+	}
 	av := ApiVector{}
 	av.FromDatabase(log.Location)
 	alog.Location = av
+	if log.Snapped != nil {
+		alog.Route = log.RouteName
+		alog.Snapped = &ApiVector{}
+		alog.Snapped.FromDatabase(log.Snapped)
+		distance := log.RouteDistance
+		alog.RouteDistance = &distance
+	}
+	return nil
+}
+
+// OnRoute computes the progress of the snapped log along its route, the route must be the one of the log
+// or of its vehicle. A log which wasn't snapped is projected on the route for Extrapolate only.
+func (alog *ApiShuttleLog) OnRoute(route *database.ClosedRoute) {
+	path := make([]pkg.Point, len(route.RoutePoints))
+	for i, v := range route.RoutePoints {
+		path[i] = pkg.Point{X: v.X, Y: v.Y}
+	}
+	if len(path) < 2 {
+		return
+	}
+	if alog.RouteDistance == nil {
+		p := pkg.Project(path, true, pkg.Point{X: alog.Location.X, Y: alog.Location.Y})
+		if p.Offset > maxExtrapolationOffset {
+			return
+		}
+		alog.path, alog.along, alog.start = path, p.Along, p.Point
+		return
+	}
+	alog.path, alog.along, alog.start = path, *alog.RouteDistance, pkg.Point{X: alog.Snapped.X, Y: alog.Snapped.Y}
+	if length := pkg.PathLength(path, true); length > 0 {
+		progress := *alog.RouteDistance / length * 100
+		alog.Progress = &progress
+	}
+}
+
+func (aq *ApiQuarantine) FromDatabase(logs []*database.QuarantinedLog) error {
+	aq.Logs = []ApiQuarantinedLog{}
+	for _, q := range logs {
+		al := ApiQuarantinedLog{}
+		al.VehicleID = q.Log.VehicleID
+		al.Location.FromDatabase(q.Log.Location)
+		al.Status = q.Log.Status
+		al.Time = q.Log.FixTime
+		al.Reason = q.Reason
+		al.CreatedAt = q.CreatedAt
+		aq.Logs = append(aq.Logs, al)
+	}
+	return nil
+}
+
+// Extrapolate predicts the position of the shuttle at now by moving it along the route set by OnRoute
+// at the speed of the last fix, or along the heading of the fix if it isn't on a route
+func (alog *ApiShuttleLog) Extrapolate(log *database.ShuttleLog, now time.Time) {
+	p := alog.Location
+	onRoute := alog.path != nil
+	if onRoute {
+		p.X, p.Y = alog.start.X, alog.start.Y
+	}
+	if !log.FixTime.IsZero() && log.StationaryUntil.IsZero() {
+		elapsed := now.Sub(log.FixTime)
+		if elapsed > maxExtrapolation {
+			elapsed = maxExtrapolation
+		}
+		if elapsed > 0 {
+			distance := p.Speed / pkg.MetersPerSecondToMph * elapsed.Seconds()
+			if onRoute {
+				point := pkg.PointAt(alog.path, true, alog.along+distance)
+				p.X, p.Y = point.X, point.Y
+			} else {
+				p.X, p.Y = pkg.Destination(p.X, p.Y, p.Angle, distance)
+			}
+		}
+	}
+	alog.Predicted = &p
+}
+
+// checkLocation rejects a log without location, a location left at 0,0 is taken as missing,
+// or with a longitude x or a latitude y out of range
+func (alog *ApiShuttleLog) checkLocation() error {
+	loc := alog.Location
+	if loc.X == 0 && loc.Y == 0 {
+		return errors.New("Missing location")
+	}
+	if math.IsNaN(loc.X) || math.IsNaN(loc.Y) || loc.X < -180 || loc.X > 180 || loc.Y < -90 || loc.Y > 90 {
+		return fmt.Errorf("Location %g,%g out of range", loc.X, loc.Y)
+	}
+	return nil
+}
+
+func (alog *ApiShuttleLog) ToDatabase() (*database.ShuttleLog, error) {
+	if alog.VehicleID == "" {
+		return nil, errors.New("Missing vehicle id")
+	}
+	log := &database.ShuttleLog{}
+	log.VehicleID = alog.VehicleID
+	log.Status = alog.Status
+	v, err := alog.Location.ToDatabase()
+	if err != nil {
+		return nil, err
+	}
+	log.Location = v
+	log.FixTime = alog.Time
+	if log.FixTime.IsZero() {
+		log.FixTime = time.Now()
+	}
+	return log, nil
+}
+
+func (av *ApiVehicleMeta) FromDatabase(v *database.Vehicle) error {
+	av.VehicleID = v.VehicleID
+	av.Name = v.Name
+	av.Capacity = v.Capacity
+	av.Accessibility = v.Accessibility
+	if av.Accessibility == nil {
+		av.Accessibility = []string{}
+	}
+	av.Plate = v.Plate
+	active := v.Active
+	av.Active = &active
+	av.Route = v.RouteName
+	av.RouteConfidence = v.RouteConfidence
+	if !v.RouteAssignedAt.IsZero() {
+		assignedAt := v.RouteAssignedAt
+		av.RouteAssignedAt = &assignedAt
+	}
+	av.State = v.State
+	if !v.StateSince.IsZero() {
+		since := v.StateSince
+		av.StateSince = &since
+	}
+	return nil
+}
+
+func (av *ApiVehicleMeta) ToDatabase() (*database.Vehicle, error) {
+	if av.VehicleID == "" {
+		return nil, errors.New("Missing vehicle id")
+	}
+	if av.Capacity < 0 {
+		return nil, errors.New("Invalid capacity")
+	}
+	v := &database.Vehicle{}
+	v.VehicleID = av.VehicleID
+	v.Name = av.Name
+	v.Capacity = av.Capacity
+	v.Accessibility = av.Accessibility
+	v.Plate = av.Plate
+	// vehicles are active unless told otherwise
+	v.Active = av.Active == nil || *av.Active
+	v.RouteName = av.Route
+	return v, nil
+}
+
+func (al *ApiVehicleList) FromDatabase(vehicles []*database.Vehicle) error {
+	al.Vehicles = []ApiVehicleMeta{}
+	for _, v := range vehicles {
+		av := ApiVehicleMeta{}
+		av.FromDatabase(v)
+		al.Vehicles = append(al.Vehicles, av)
+	}
+	return nil
+}
+
+// FromDatabase lists the transitions made in [from, to) and sums the time spent in each state until to,
+// the state before the first transition is the one it left
+func (as *ApiVehicleStates) FromDatabase(vehicleID string, states []*database.VehicleState, from, to time.Time) error {
+	as.VehicleID = vehicleID
+	as.Transitions = []ApiVehicleState{}
+	as.Durations = make(map[string]float64)
+	for i, s := range states {
+		as.Transitions = append(as.Transitions, ApiVehicleState{s.Previous, s.State, s.At})
+		if i == 0 && s.Previous != "" {
+			as.Durations[s.Previous] += s.At.Sub(from).Seconds()
+		}
+		end := to
+		if i+1 < len(states) {
+			end = states[i+1].At
+		}
+		as.Durations[s.State] += end.Sub(s.At).Seconds()
+	}
+	return nil
+}
+
+func (aa *ApiRouteAssignments) FromDatabase(vehicleID string, assignments []*database.RouteAssignment) error {
+	aa.VehicleID = vehicleID
+	aa.Assignments = []ApiRouteAssignment{}
+	for _, a := range assignments {
+		aa.Assignments = append(aa.Assignments, ApiRouteAssignment{a.RouteName, a.Confidence, a.AssignedAt})
+	}
+	return nil
+}
+
+func (as *ApiStopMeta) FromDatabase(stop *database.Stop) error {
+	as.StopID = stop.StopID
+	as.Name = stop.Name
+	if stop.Route != nil {
+		as.Route = stop.Route.Name
+	}
+	as.Location.FromDatabase(stop.Location)
+	return nil
+}
+
+func (as *ApiStopMeta) ToDatabase() (*database.Stop, error) {
+	if as.StopID == "" || as.Route == "" {
+		return nil, errors.New("Missing stop id or route")
+	}
+	v, err := as.Location.ToDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return &database.Stop{StopID: as.StopID, Name: as.Name, Route: &database.ClosedRoute{Name: as.Route}, Location: v}, nil
+}
+
+func (al *ApiStopList) FromDatabase(routeName string, stops []*database.Stop) error {
+	al.Route = routeName
+	al.Stops = []ApiStopMeta{}
+	for _, s := range stops {
+		as := ApiStopMeta{}
+		as.FromDatabase(s)
+		al.Stops = append(al.Stops, as)
+	}
+	return nil
+}
+
+func (ae *ApiStopEvents) FromDatabase(stopID string, events []*database.StopEvent) error {
+	ae.StopID = stopID
+	ae.Events = []ApiStopEvent{}
+	for _, e := range events {
+		event := ApiStopEvent{}
+		event.FromDatabase(e)
+		ae.Events = append(ae.Events, event)
+	}
+	return nil
+}
+
+func (ae *ApiStopEvent) FromDatabase(e *database.StopEvent) error {
+	*ae = ApiStopEvent{VehicleID: e.VehicleID, Route: e.RouteName, ArrivedAt: e.ArrivedAt, Dwell: e.Dwell.Seconds()}
+	if !e.DepartedAt.IsZero() {
+		departedAt := e.DepartedAt
+		ae.DepartedAt = &departedAt
+	}
+	if e.TripID != "" {
+		scheduledAt, deviation := e.ScheduledAt, e.Deviation.Seconds()
+		ae.Trip, ae.ScheduledAt, ae.Deviation = e.TripID, &scheduledAt, &deviation
+	}
+	return nil
+}
+
+func (at *ApiSegmentTimes) FromDatabase(routeName string, times []*database.SegmentTime) error {
+	at.Route = routeName
+	at.Segments = []ApiSegmentTime{}
+	for _, t := range times {
+		at.Segments = append(at.Segments, ApiSegmentTime{t.FromStop, t.ToStop, int(t.Weekday), t.Hour, t.TravelTime.Seconds(), t.Samples, t.UpdatedAt})
+	}
+	return nil
+}
+
+func (ac *ApiCalendar) FromDatabase(c *database.ServiceCalendar) error {
+	ac.ServiceID = c.ServiceID
+	ac.Days = []string{}
+	for day, on := range c.Weekdays {
+		if on {
+			ac.Days = append(ac.Days, weekdayNames[day])
+		}
+	}
+	if !c.StartDate.IsZero() {
+		ac.StartDate = c.StartDate.Format("2006-01-02")
+	}
+	if !c.EndDate.IsZero() {
+		ac.EndDate = c.EndDate.Format("2006-01-02")
+	}
+	ac.Exceptions = []ApiCalendarException{}
+	for _, e := range c.Exceptions {
+		ac.Exceptions = append(ac.Exceptions, ApiCalendarException{e.Date.Format("2006-01-02"), e.Added})
+	}
+	return nil
+}
+
+func (ac *ApiCalendar) ToDatabase() (*database.ServiceCalendar, error) {
+	if ac.ServiceID == "" {
+		return nil, errors.New("Missing service id")
+	}
+	c := &database.ServiceCalendar{ServiceID: ac.ServiceID}
+	for _, name := range ac.Days {
+		found := false
+		for day, n := range weekdayNames {
+			if strings.EqualFold(name, n) {
+				c.Weekdays[day] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Invalid day '%s'", name)
+		}
+	}
+	var err error
+	if ac.StartDate != "" {
+		if c.StartDate, err = time.Parse("2006-01-02", ac.StartDate); err != nil {
+			return nil, fmt.Errorf("Invalid start date '%s'", ac.StartDate)
+		}
+	}
+	if ac.EndDate != "" {
+		if c.EndDate, err = time.Parse("2006-01-02", ac.EndDate); err != nil {
+			return nil, fmt.Errorf("Invalid end date '%s'", ac.EndDate)
+		}
+	}
+	for _, e := range ac.Exceptions {
+		date, err := time.Parse("2006-01-02", e.Date)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exception date '%s'", e.Date)
+		}
+		c.Exceptions = append(c.Exceptions, database.CalendarException{Date: date, Added: e.Added})
+	}
+	return c, nil
+}
+
+func (at *ApiTrips) ToDatabase() ([]*database.Trip, error) {
+	if at.Route == "" {
+		return nil, errors.New("Missing route")
+	}
+	trips := []*database.Trip{}
+	for _, t := range at.Trips {
+		if t.TripID == "" || t.ServiceID == "" {
+			return nil, errors.New("Missing trip id or service")
+		}
+		trip := &database.Trip{TripID: t.TripID, RouteName: at.Route, ServiceID: t.ServiceID, Headsign: t.Headsign}
+		for i, st := range t.StopTimes {
+			arrival, err := parseClock(st.Arrival)
+			if err != nil {
+				return nil, err
+			}
+			departure := arrival
+			if st.Departure != "" {
+				if departure, err = parseClock(st.Departure); err != nil {
+					return nil, err
+				}
+			}
+			trip.StopTimes = append(trip.StopTimes, &database.StopTime{StopID: st.StopID, Sequence: i, Arrival: arrival, Departure: departure})
+		}
+		trips = append(trips, trip)
+	}
+	return trips, nil
+}
+
+// FromDatabase sets the trips running on the service day starting at midnight
+func (as *ApiSchedule) FromDatabase(routeName string, midnight time.Time, trips []*database.Trip) error {
+	as.Route = routeName
+	as.Date = midnight.Format("2006-01-02")
+	as.Trips = []ApiScheduledTrip{}
+	for _, t := range trips {
+		trip := ApiScheduledTrip{TripID: t.TripID, ServiceID: t.ServiceID, Headsign: t.Headsign, StopTimes: []ApiScheduledStopTime{}}
+		for _, st := range t.StopTimes {
+			trip.StopTimes = append(trip.StopTimes, ApiScheduledStopTime{st.StopID, ScheduledAt(midnight, st.Arrival), ScheduledAt(midnight, st.Departure)})
+		}
+		as.Trips = append(as.Trips, trip)
+	}
+	return nil
+}
+
+func (ah *ApiHeadways) FromDatabase(alerts []*database.HeadwayAlert) error {
+	ah.Alerts = []ApiHeadwayAlert{}
+	for _, a := range alerts {
+		alert := ApiHeadwayAlert{Kind: a.Kind, VehicleID: a.VehicleID, AheadID: a.AheadID, Distance: a.Distance, RaisedAt: a.RaisedAt}
+		if !a.ResolvedAt.IsZero() {
+			resolvedAt := a.ResolvedAt
+			alert.ResolvedAt = &resolvedAt
+		}
+		ah.Alerts = append(ah.Alerts, alert)
+	}
+	return nil
+}
+
+func (ad *ApiDetourMeta) FromDatabase(d *database.Detour) error {
+	ad.ID = d.ID
+	ad.Route = d.RouteName
+	ad.Locations = []ApiVector{}
+	for _, p := range d.Points {
+		av := ApiVector{}
+		av.FromDatabase(p)
+		ad.Locations = append(ad.Locations, av)
+	}
+	ad.StartsAt = d.StartsAt
+	ad.EndsAt = d.EndsAt
+	ad.Reason = d.Reason
+	return nil
+}
+
+func (ad *ApiDetourMeta) ToDatabase() (*database.Detour, error) {
+	if ad.Route == "" {
+		return nil, errors.New("Detour requires a route")
+	}
+	if len(ad.Locations) < 2 {
+		return nil, errors.New("Detour requires at least 2 locations")
+	}
+	if !ad.EndsAt.After(ad.StartsAt) {
+		return nil, errors.New("Detour must end after it starts")
+	}
+	d := &database.Detour{RouteName: ad.Route, StartsAt: ad.StartsAt, EndsAt: ad.EndsAt, Reason: ad.Reason}
+	for _, loc := range ad.Locations {
+		v, err := loc.ToDatabase()
+		if err != nil {
+			return nil, err
+		}
+		d.Points = append(d.Points, v)
+	}
+	return d, nil
+}
+
+func (ad *ApiDetours) FromDatabase(detours []*database.Detour) error {
+	ad.Detours = []ApiDetourMeta{}
+	for _, d := range detours {
+		detour := ApiDetourMeta{}
+		if err := detour.FromDatabase(d); err != nil {
+			return err
+		}
+		ad.Detours = append(ad.Detours, detour)
+	}
+	return nil
+}
+
+func (ae *ApiOffRouteEvents) FromDatabase(events []*database.OffRouteEvent) error {
+	ae.Events = []ApiOffRouteEvent{}
+	for _, e := range events {
+		event := ApiOffRouteEvent{VehicleID: e.VehicleID, StartedAt: e.StartedAt, MaxDistance: e.MaxDistance}
+		if !e.EndedAt.IsZero() {
+			endedAt := e.EndedAt
+			event.EndedAt = &endedAt
+		}
+		ae.Events = append(ae.Events, event)
+	}
+	return nil
+}
+
+func (aa *ApiServiceAlertMeta) FromDatabase(a *database.ServiceAlert) error {
+	aa.ID = a.ID
+	aa.Severity = a.Severity
+	aa.Header = a.Header
+	aa.Description = a.Description
+	aa.URL = a.URL
+	aa.Routes = append([]string{}, a.Routes...)
+	aa.Stops = append([]string{}, a.Stops...)
+	aa.Periods = []ApiAlertPeriod{}
+	for _, p := range a.Periods {
+		period := ApiAlertPeriod{Start: p.Start}
+		if !p.End.IsZero() {
+			end := p.End
+			period.End = &end
+		}
+		aa.Periods = append(aa.Periods, period)
+	}
+	aa.UpdatedAt = a.UpdatedAt
+	return nil
+}
+
+func (aa *ApiServiceAlertMeta) ToDatabase() (*database.ServiceAlert, error) {
+	if aa.Header == "" {
+		return nil, errors.New("Alert requires a header")
+	}
+	a := &database.ServiceAlert{Severity: aa.Severity, Header: aa.Header, Description: aa.Description, URL: aa.URL}
+	a.ID = aa.ID
+	switch a.Severity {
+	case "":
+		a.Severity = database.SeverityInfo
+	case database.SeverityInfo, database.SeverityWarning, database.SeveritySevere:
+	default:
+		return nil, fmt.Errorf("Invalid severity '%s'", a.Severity)
+	}
+	a.Routes = aa.Routes
+	a.Stops = aa.Stops
+	for _, p := range aa.Periods {
+		period := database.AlertPeriod{Start: p.Start}
+		if p.End != nil {
+			if !p.End.After(p.Start) {
+				return nil, errors.New("Alert period must end after it starts")
+			}
+			period.End = *p.End
+		}
+		a.Periods = append(a.Periods, period)
+	}
+	return a, nil
+}
+
+func (aa *ApiServiceAlerts) FromDatabase(alerts []*database.ServiceAlert) error {
+	aa.Alerts = []ApiServiceAlertMeta{}
+	for _, a := range alerts {
+		alert := ApiServiceAlertMeta{}
+		if err := alert.FromDatabase(a); err != nil {
+			return err
+		}
+		aa.Alerts = append(aa.Alerts, alert)
+	}
 	return nil
 }
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+const (
+	// vehicles without a fix for this long are not predicted
+	maxPredictionAge = 5 * time.Minute
+	// fixes older than this lower the confidence of a prediction
+	freshFixAge = 30 * time.Second
+	// meters per second assumed for the vehicles slower than it, e.g. waiting at a stop
+	minPredictionSpeed = 4.5
+)
+
+// SegmentTimes gives the usual travel time between two consecutive stops of a route at a time
+type SegmentTimes interface {
+	SegmentTime(route, from, to string, at time.Time) (time.Duration, bool)
+}
+
+// routeStop is a stop with its distance along the route
+type routeStop struct {
+	stop  *database.Stop
+	along float64
+}
+
+// PredictArrivals predicts when the vehicles currently on the route of the stop will arrive at it,
+// sorted by arrival
+func PredictArrivals(ctx *Context, stop *database.Stop, now time.Time) ([]ApiStopPrediction, error) {
+	predictions := []ApiStopPrediction{}
+	route, _, err := activeRoute(ctx.DB, stop.Route.Name, now)
+	if err != nil {
+		return nil, err
+	}
+	path := make([]pkg.Point, len(route.RoutePoints))
+	for i, v := range route.RoutePoints {
+		path[i] = pkg.Point{X: v.X, Y: v.Y}
+	}
+	length := pkg.PathLength(path, true)
+	if len(path) < 2 || length == 0 {
+		return predictions, nil
+	}
+	stops, err := ctx.DB.SelectStopOnRoute(route.Name)
+	if err != nil {
+		return nil, err
+	}
+	ordered := make([]routeStop, len(stops))
+	for i, s := range stops {
+		ordered[i] = routeStop{s, pkg.Project(path, true, pkg.Point{X: s.Location.X, Y: s.Location.Y}).Along}
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].along < ordered[j].along })
+	target := pkg.Project(path, true, pkg.Point{X: stop.Location.X, Y: stop.Location.Y}).Along
+	vehicles, err := ctx.DB.ListVehicles()
+	if err != nil {
+		return nil, err
+	}
+	for _, vehicle := range vehicles {
+		if !vehicle.Active || vehicle.RouteName != route.Name {
+			continue
+		}
+		log, err := ctx.DB.SelectLatestLog(vehicle.VehicleID)
+		if err != nil || log.Snapped == nil || log.RouteName != route.Name {
+			continue
+		}
+		age := now.Sub(log.FixTime)
+		if log.FixTime.IsZero() || age > maxPredictionAge {
+			continue
+		}
+		if age < 0 {
+			age = 0
+		}
+		distance := math.Mod(target-log.RouteDistance+length, length)
+		speed := log.Location.Speed / pkg.MetersPerSecondToMph
+		travel, historical := travelTime(ctx.SegmentTimes, route.Name, ordered, log.RouteDistance, distance, length, log.FixTime)
+		if !historical {
+			travel = time.Duration(distance / math.Max(speed, minPredictionSpeed) * float64(time.Second))
+		}
+		// the vehicle kept moving since its fix
+		travel -= age
+		if travel < 0 {
+			travel = 0
+		}
+		confidence := vehicle.RouteConfidence
+		if confidence == 0 {
+			// assigned manually
+			confidence = 1
+		}
+		if age > freshFixAge {
+			confidence *= 1 - 0.5*float64(age-freshFixAge)/float64(maxPredictionAge-freshFixAge)
+		}
+		if !historical {
+			confidence *= 0.8
+		}
+		predictions = append(predictions, ApiStopPrediction{
+			VehicleID:  vehicle.VehicleID,
+			Route:      route.Name,
+			ETA:        now.Add(travel),
+			Seconds:    travel.Seconds(),
+			Distance:   distance,
+			Confidence: confidence,
+			Level:      confidenceLevel(confidence),
+			Historical: historical,
+		})
+	}
+	sort.Slice(predictions, func(i, j int) bool { return predictions[i].ETA.Before(predictions[j].ETA) })
+	return predictions, nil
+}
+
+// travelTime sums the usual travel times of the segments between the vehicle and the target, the
+// segment the vehicle is on is counted for its remaining share. It returns false if a segment has
+// no usual travel time.
+func travelTime(times SegmentTimes, routeName string, stops []routeStop, along, distance, length float64, at time.Time) (time.Duration, bool) {
+	if times == nil || len(stops) < 2 {
+		return 0, false
+	}
+	// the segment the vehicle is on ends at the first stop after it
+	next := sort.Search(len(stops), func(i int) bool { return stops[i].along > along }) % len(stops)
+	total := time.Duration(0)
+	covered := 0.0
+	// stops are reached within a meter of rounding
+	for i := next; covered < distance-1; i = (i + 1) % len(stops) {
+		prev := stops[(i-1+len(stops))%len(stops)]
+		segment := math.Mod(stops[i].along-prev.along+length, length)
+		if segment == 0 {
+			segment = length
+		}
+		t, ok := times.SegmentTime(routeName, prev.stop.StopID, stops[i].stop.StopID, at.Add(total))
+		if !ok {
+			return 0, false
+		}
+		share := 1.0
+		if i == next && covered == 0 {
+			// remaining share of the current segment
+			share = math.Mod(stops[i].along-along+length, length) / segment
+		}
+		total += time.Duration(float64(t) * share)
+		covered += segment * share
+	}
+	return total, true
+}
+
+func confidenceLevel(confidence float64) string {
+	switch {
+	case confidence >= 0.75:
+		return "high"
+	case confidence >= 0.4:
+		return "medium"
+	}
+	return "low"
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// fixedSegmentTimes takes the same time to travel every segment
+type fixedSegmentTimes time.Duration
+
+func (t fixedSegmentTimes) SegmentTime(route, from, to string, at time.Time) (time.Duration, bool) {
+	return time.Duration(t), true
+}
+
+// predictionRoute inserts a closed route around a square of about 1.1 km with a stop on each side,
+// the stops are at about 278, 834, 1668 and 2780 meters along the route
+func predictionRoute(t *testing.T, db *database.MockDatabase) []pkg.Point {
+	route := &database.ClosedRoute{Name: "loop", RoutePoints: []*database.Vector{
+		{X: 0, Y: 0}, {X: 0.01, Y: 0}, {X: 0.01, Y: 0.01}, {X: 0, Y: 0.01},
+	}}
+	if err := db.InsertClosedRoute(route); err != nil {
+		t.Fatal(err)
+	}
+	stops := map[string][2]float64{"s1": {0.0025, 0}, "s2": {0.0075, 0}, "s3": {0.01, 0.005}, "s4": {0.005, 0.01}}
+	for id, p := range stops {
+		stop := &database.Stop{StopID: id, Route: route, Location: &database.Vector{X: p[0], Y: p[1]}}
+		if err := db.InsertStop(stop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := make([]pkg.Point, len(route.RoutePoints))
+	for i, v := range route.RoutePoints {
+		path[i] = pkg.Point{X: v.X, Y: v.Y}
+	}
+	return path
+}
+
+// feedTrace stores the snapped fixes of a vehicle driving east along the first side of the route at a
+// constant speed in m/s, one fix every 10 seconds from x to the last fix at end
+func feedTrace(t *testing.T, db *database.MockDatabase, path []pkg.Point, vehicleID string, x, speed float64, end time.Time) float64 {
+	const interval = 10 * time.Second
+	step := speed * interval.Seconds() / pkg.Distance(0, 0, 0.01, 0) * 0.01
+	fixes := 6
+	along := 0.0
+	for i := 0; i < fixes; i++ {
+		location := &database.Vector{X: x + float64(i)*step, Y: 0, Speed: speed * pkg.MetersPerSecondToMph}
+		p := pkg.Project(path, true, pkg.Point{X: location.X, Y: location.Y})
+		log := &database.ShuttleLog{VehicleID: vehicleID, RouteName: "loop", Location: location,
+			Snapped: &database.Vector{X: p.Point.X, Y: p.Point.Y, Speed: location.Speed}, RouteDistance: p.Along,
+			FixTime: end.Add(-time.Duration(fixes-1-i) * interval)}
+		if err := db.InsertShuttleLog(log); err != nil {
+			t.Fatal(err)
+		}
+		along = p.Along
+	}
+	return along
+}
+
+func TestPredictArrivals(t *testing.T) {
+	db := &database.MockDatabase{}
+	db.Open()
+	path := predictionRoute(t, db)
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	vehicles := []struct {
+		id         string
+		confidence float64
+		x          float64
+		age        time.Duration
+	}{
+		// matched automatically, fresh fix
+		{"fresh", 0.9, 0.001, 0},
+		// assigned manually, its fix is halfway from fresh to too old
+		{"stale", 0, 0.0005, 165 * time.Second},
+		// too old to be predicted
+		{"lost", 0.9, 0.002, 6 * time.Minute},
+	}
+	along := map[string]float64{}
+	for _, v := range vehicles {
+		if err := db.UpsertVehicle(&database.Vehicle{VehicleID: v.id, Active: true, RouteName: "loop"}); err != nil {
+			t.Fatal(err)
+		}
+		if v.confidence > 0 {
+			db.AssignRoute(&database.RouteAssignment{VehicleID: v.id, RouteName: "loop", Confidence: v.confidence, AssignedAt: now})
+		}
+		along[v.id] = feedTrace(t, db, path, v.id, v.x, 5, now.Add(-v.age))
+	}
+	stop, err := db.SelectStop("s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := pkg.Project(path, true, pkg.Point{X: stop.Location.X, Y: stop.Location.Y}).Along
+
+	// from the speed of the vehicles
+	predictions, err := PredictArrivals(&Context{DB: db}, stop, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(predictions) != 2 {
+		t.Fatalf("got %d predictions, want 2", len(predictions))
+	}
+	byVehicle := map[string]ApiStopPrediction{}
+	for _, p := range predictions {
+		byVehicle[p.VehicleID] = p
+	}
+	want := map[string]struct {
+		seconds, confidence float64
+		level               string
+	}{
+		"fresh": {(target - along["fresh"]) / 5, 0.9 * 0.8, "medium"},
+		"stale": {(target-along["stale"])/5 - 165, 0.75 * 0.8, "medium"},
+	}
+	for id, w := range want {
+		p, ok := byVehicle[id]
+		if !ok {
+			t.Fatalf("no prediction for %s", id)
+		}
+		if math.Abs(p.Seconds-w.seconds) > 1 || !p.ETA.Equal(now.Add(time.Duration(p.Seconds*float64(time.Second)))) {
+			t.Errorf("%s: got eta in %.1fs at %s, want %.1fs", id, p.Seconds, p.ETA, w.seconds)
+		}
+		if math.Abs(p.Confidence-w.confidence) > 1e-9 || p.Level != w.level || p.Historical {
+			t.Errorf("%s: got confidence %.3f %s historical %v, want %.3f %s", id, p.Confidence, p.Level, p.Historical, w.confidence, w.level)
+		}
+	}
+	if predictions[0].ETA.After(predictions[1].ETA) {
+		t.Errorf("predictions not sorted by arrival")
+	}
+
+	// from the usual travel times, a minute between two stops
+	predictions, err = PredictArrivals(&Context{DB: db, SegmentTimes: fixedSegmentTimes(time.Minute)}, stop, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range predictions {
+		if p.VehicleID != "fresh" {
+			continue
+		}
+		// s1 is 278 m along and s2 834 m, the rest of the current segment then s2 to s3
+		share := (834 - along["fresh"]) / (834 - 278)
+		seconds := 60*share + 60
+		if math.Abs(p.Seconds-seconds) > 1 {
+			t.Errorf("got eta in %.1fs, want %.1fs", p.Seconds, seconds)
+		}
+		if math.Abs(p.Confidence-0.9) > 1e-9 || p.Level != "high" || !p.Historical {
+			t.Errorf("got confidence %.3f %s historical %v, want 0.900 high", p.Confidence, p.Level, p.Historical)
+		}
+	}
+}
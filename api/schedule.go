@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// names of the days in the calendars, indexed by time.Weekday
+var weekdayNames = [7]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// TripsOn selects the trips of the route running on the day of the date
+func TripsOn(db database.Database, routeName string, date time.Time) ([]*database.Trip, error) {
+	trips, err := db.SelectTrips(routeName)
+	if err != nil {
+		return nil, err
+	}
+	active := map[string]bool{}
+	running := []*database.Trip{}
+	for _, trip := range trips {
+		on, ok := active[trip.ServiceID]
+		if !ok {
+			calendar, err := db.SelectCalendar(trip.ServiceID)
+			if err != nil {
+				return nil, err
+			}
+			on = calendar.ActiveOn(date)
+			active[trip.ServiceID] = on
+		}
+		if on {
+			running = append(running, trip)
+		}
+	}
+	return running, nil
+}
+
+// ServiceDay returns the midnight starting the day of the date in the location
+func ServiceDay(date time.Time, loc *time.Location) time.Time {
+	y, m, d := date.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// ScheduledAt returns the time of a stop time on the service day. As in GTFS the stop times are relative
+// to noon minus 12 hours, which is not midnight on the days the clocks change.
+func ScheduledAt(day time.Time, stopTime time.Duration) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, 12, 0, 0, 0, day.Location()).Add(-12 * time.Hour).Add(stopTime)
+}
+
+// parseClock parses a time of the day formatted as HH:MM:SS, the hours may exceed a day
+func parseClock(s string) (time.Duration, error) {
+	var h, m, sec int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d:%d", &h, &m, &sec); err != nil {
+		return 0, fmt.Errorf("Invalid time of the day '%s'", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second, nil
+}
+
+func formatClock(d time.Duration) string {
+	s := int(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// readGTFS reads a GTFS file as records keyed by the columns of its header
+func readGTFS(body []byte) ([]map[string]string, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	records := []map[string]string{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := map[string]string{}
+		for i, column := range header {
+			if i < len(row) {
+				record[strings.TrimSpace(column)] = strings.TrimSpace(row[i])
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ParseGTFSCalendar parses the calendars of a GTFS calendar.txt file
+func ParseGTFSCalendar(body []byte) ([]*database.ServiceCalendar, error) {
+	records, err := readGTFS(body)
+	if err != nil {
+		return nil, err
+	}
+	calendars := []*database.ServiceCalendar{}
+	for i, record := range records {
+		c := &database.ServiceCalendar{ServiceID: record["service_id"]}
+		if c.ServiceID == "" {
+			return nil, fmt.Errorf("Missing service_id on line %d", i+2)
+		}
+		for day, name := range weekdayNames {
+			c.Weekdays[day] = record[name] == "1"
+		}
+		if c.StartDate, err = time.Parse("20060102", record["start_date"]); err != nil {
+			return nil, fmt.Errorf("Invalid start_date on line %d", i+2)
+		}
+		if c.EndDate, err = time.Parse("20060102", record["end_date"]); err != nil {
+			return nil, fmt.Errorf("Invalid end_date on line %d", i+2)
+		}
+		calendars = append(calendars, c)
+	}
+	return calendars, nil
+}
+
+// ParseGTFSCalendarDates parses the exceptions of a GTFS calendar_dates.txt file by service id
+func ParseGTFSCalendarDates(body []byte) (map[string][]database.CalendarException, error) {
+	records, err := readGTFS(body)
+	if err != nil {
+		return nil, err
+	}
+	exceptions := map[string][]database.CalendarException{}
+	for i, record := range records {
+		serviceID := record["service_id"]
+		if serviceID == "" {
+			return nil, fmt.Errorf("Missing service_id on line %d", i+2)
+		}
+		date, err := time.Parse("20060102", record["date"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date on line %d", i+2)
+		}
+		// 1 adds the date, 2 removes it
+		switch record["exception_type"] {
+		case "1", "2":
+		default:
+			return nil, fmt.Errorf("Invalid exception_type on line %d", i+2)
+		}
+		exceptions[serviceID] = append(exceptions[serviceID], database.CalendarException{Date: date, Added: record["exception_type"] == "1"})
+	}
+	return exceptions, nil
+}
+
+// mergeExceptions replaces the exceptions of the calendar on the same dates
+func mergeExceptions(calendar *database.ServiceCalendar, exceptions []database.CalendarException) {
+	for _, e := range exceptions {
+		replaced := false
+		for i, current := range calendar.Exceptions {
+			if current.Date.Equal(e.Date) {
+				calendar.Exceptions[i] = e
+				replaced = true
+			}
+		}
+		if !replaced {
+			calendar.Exceptions = append(calendar.Exceptions, e)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+const (
+	// events buffered for a client of the live stream, a client falling further behind misses events
+	streamClientBuffer = 64
+)
+
+// StreamEvent is an event of the live stream
+type StreamEvent struct {
+	// name of the event
+	Name string
+	// json data of the event
+	Data []byte
+}
+
+// Stream broadcasts the live events to the connected clients
+type Stream struct {
+	sync.Mutex
+
+	// reads the logs stored by the other instances
+	Database database.Database
+
+	clients map[chan StreamEvent]bool
+}
+
+// NewStream creates a stream without clients
+func NewStream(db database.Database) *Stream {
+	return &Stream{Database: db, clients: make(map[chan StreamEvent]bool)}
+}
+
+// PublishNotification broadcasts a change made by any instance. The logs stored by this instance are
+// published by its pipeline, the logs of the other instances are read from the database and sent as
+// "shuttle" events. The arrivals and departures are read from the database and sent as "stop_event"
+// events. The other changes are sent as an event named after the channel without its "yast_" prefix,
+// e.g. "headway", with the key of the changed record.
+func (s *Stream) PublishNotification(n database.Notification) {
+	if n.Channel == database.StopEventChannel {
+		s.publishStopEvent(n.Key)
+		return
+	}
+	if n.Channel == database.LogChannel {
+		if n.Local {
+			return
+		}
+		log, err := s.Database.SelectLatestLog(n.Key)
+		if err != nil {
+			fmt.Printf("Unable to stream the shuttle log of vehicle %s: %s\n", n.Key, err.Error())
+			return
+		}
+		s.PublishLog(log)
+		return
+	}
+	data, err := json.Marshal(ApiStreamChange{Key: n.Key})
+	if err != nil {
+		return
+	}
+	s.Publish(StreamEvent{Name: strings.TrimPrefix(n.Channel, "yast_"), Data: data})
+}
+
+// publishStopEvent broadcasts the stop event by id as a "stop_event" event
+func (s *Stream) publishStopEvent(key string) {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return
+	}
+	event, err := s.Database.SelectStopEvent(id)
+	if err != nil {
+		fmt.Printf("Unable to stream the stop event %s: %s\n", key, err.Error())
+		return
+	}
+	ae := ApiStreamStopEvent{StopID: event.StopID}
+	ae.FromDatabase(event)
+	data, err := json.Marshal(ae)
+	if err != nil {
+		return
+	}
+	s.Publish(StreamEvent{Name: "stop_event", Data: data})
+}
+
+// PublishLog broadcasts a stored shuttle log as a "shuttle" event
+func (s *Stream) PublishLog(log *database.ShuttleLog) {
+	alog := &ApiShuttleLog{}
+	if err := alog.FromDatabase(log); err != nil {
+		return
+	}
+	data, err := json.Marshal(alog)
+	if err != nil {
+		fmt.Printf("Unable to marshal the shuttle log of vehicle %s: %s\n", log.VehicleID, err.Error())
+		return
+	}
+	s.Publish(StreamEvent{Name: "shuttle", Data: data})
+}
+
+// Publish sends the event to every client without waiting for the slow ones
+func (s *Stream) Publish(event StreamEvent) {
+	s.Lock()
+	defer s.Unlock()
+	for client := range s.clients {
+		select {
+		case client <- event:
+		default:
+			pkg.Count("stream_dropped", 1)
+		}
+	}
+}
+
+// subscribe registers a client, it receives the events until unsubscribe
+func (s *Stream) subscribe() chan StreamEvent {
+	s.Lock()
+	defer s.Unlock()
+	client := make(chan StreamEvent, streamClientBuffer)
+	s.clients[client] = true
+	return client
+}
+
+func (s *Stream) unsubscribe(client chan StreamEvent) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.clients, client)
+}
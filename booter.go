@@ -1,6 +1,10 @@
 package yast
 
 import (
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/keyboardnerd/yastserver/api"
 	"github.com/keyboardnerd/yastserver/database"
 )
@@ -11,11 +15,120 @@ func Boot(config *api.Config) {
 	database.Open()
 	defer database.Close()
 	// initialize
-	fetcher := Fetcher{RemoteSite: config.RemoteURL}
-	updater := Updater{Fetcher: fetcher, Database: database, Interval: config.UpdaterInterval}
+	strict := config.ParserMode == "strict"
+	location := loadLocation(config.TimeZone, time.UTC)
+	fetchers := []Fetcher{}
+	if config.RemoteURL != "" {
+		fetchers = append(fetchers, Fetcher{Name: "default", RemoteSite: config.RemoteURL, Strict: strict})
+	}
+	for _, feed := range config.Feeds {
+		fetchers = append(fetchers, Fetcher{Name: feed.Name, RemoteSite: feed.RemoteURL, Priority: feed.Priority, Strict: strict})
+	}
+	buffer := NewWriteBuffer(database, config.BufferSize, config.BufferSpillFile, config.BufferSpillLimit)
+	updater := Updater{Fetchers: fetchers, Database: database, Buffer: buffer, Interval: config.UpdaterInterval, StrictParsing: strict}
+	updater.Concurrency = config.UpdaterConcurrency
+	updater.Filter = OutlierFilter{MaxSpeed: config.MaxSpeed, Area: config.ServiceArea}
+	// register the processors of the shuttle logs
+	var machine *VehicleStateMachine
+	if s := config.VehicleStates; s != nil {
+		machine = NewVehicleStateMachine(database, nil, time.Duration(s.StaleAfter)*time.Second,
+			time.Duration(s.ParkedAfter)*time.Second, time.Duration(s.Interval)*time.Second)
+		database.Subscribe(machine.Notify)
+	}
+	if config.Smoothing {
+		updater.RegisterProcessor("smoother", orderSmoother, &Smoother{})
+	}
+	// the routes and the stops are reloaded when any instance changes them
+	routes := &RouteCache{Database: database}
+	database.Subscribe(routes.Notify)
+	// the vehicles assigned manually are snapped without the route matching
+	updater.RegisterProcessor("route_snapper", orderRouteSnapper, &RouteSnapper{Routes: routes})
+	if m := config.RouteMatching; m != nil {
+		matcher := NewRouteMatcher(database, routes, m.Window, m.MaxDistance, m.MinConfidence, m.SwitchAfter)
+		database.Subscribe(matcher.Notify)
+		updater.RegisterProcessor("route_matcher", orderRouteMatcher, matcher)
+	}
+	// the following features follow the route of the vehicles, matched or assigned manually
+	if o := config.OffRoute; o != nil {
+		detector := NewOffRouteDetector(database, routes, o.Distance, time.Duration(o.Duration)*time.Second)
+		updater.RegisterObserver("off_route_detector", orderOffRouteDetector, detector)
+		if machine != nil {
+			machine.OffRoute = detector
+		}
+	}
+	if d := config.StopDetection; d != nil {
+		detector := NewStopDetector(database, routes, d.Radius, d.ExitRadius)
+		if a := config.Adherence; a != nil {
+			window := time.Duration(a.Window) * time.Second
+			detector.Schedule = NewScheduleMatcher(database, location, window)
+		}
+		updater.RegisterObserver("stop_detector", orderStopDetector, detector)
+		if machine != nil {
+			machine.Stops = detector
+		}
+	}
+	if h := config.Headways; h != nil {
+		monitor := &HeadwayMonitor{Database: database, Routes: routes, Bunching: h.Bunching, Gap: h.Gap}
+		updater.RegisterObserver("headway_monitor", orderHeadwayMonitor, monitor)
+	}
+	if machine != nil {
+		updater.RegisterObserver("state_machine", orderStateMachine, machine)
+	}
+	// only the elected instance polls the remote feeds
+	instanceID := config.InstanceID
+	if instanceID == "" {
+		hostname, _ := os.Hostname()
+		instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	leaderLease := config.LeaderLease
+	if leaderLease <= 0 {
+		leaderLease = 30
+	}
+	elector := &Elector{Database: database, Holder: instanceID, TTL: time.Duration(leaderLease) * time.Second}
+	updater.Elector = elector
+	elector.Elect()
+	go elector.Run()
+	if machine != nil {
+		machine.Elector = elector
+		go machine.Run()
+	}
+	// the stored logs and the changes made by every instance are sent to the live stream
+	stream := api.NewStream(database)
+	updater.Subscribe(stream.PublishLog)
+	database.Subscribe(stream.PublishNotification)
 	// run updater async
 	go updater.RunUpdate()
+	// receive the devices streaming their logs
+	listener := &Listener{TCPAddr: config.TCPListen, UDPAddr: config.UDPListen, Updater: &updater}
+	if err := listener.Listen(); err != nil {
+		panic(err.Error())
+	}
+	defer listener.Close()
 	// run api server
-	ctx := &api.Context{database}
+	ctx := &api.Context{DB: database, Ingester: &updater, Token: config.APIToken, InstanceID: instanceID, Stream: stream}
+	ctx.Location = location
+	if a := config.Adherence; a != nil {
+		ctx.Tolerance = a.Tolerance(location)
+	}
+	ctx.Headways = config.Headways
+	ctx.MaxIngestBytes = config.MaxIngestBytes
+	if t := config.TravelTimes; t != nil {
+		model := NewTravelTimeModel(database, elector, time.Duration(t.Interval)*time.Minute, time.Duration(t.History)*24*time.Hour,
+			loadLocation(t.TimeZone, location))
+		go model.Run()
+		ctx.SegmentTimes = model
+	}
 	api.Run(ctx, config)
 }
+
+// loadLocation loads the time zone by name, def if the name is empty
+func loadLocation(name string, def *time.Location) *time.Location {
+	if name == "" {
+		return def
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err.Error())
+	}
+	return location
+}
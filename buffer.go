@@ -0,0 +1,291 @@
+package yast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// default bounds of the write buffer
+const (
+	defaultBufferSize       = 1000
+	defaultBufferSpillLimit = 100000
+)
+
+// WriteBuffer holds the shuttle logs which could not be written while the database is unavailable
+// and replays them in order once it recovers. Once more than Size logs are buffered, the oldest are
+// spilled to SpillFile up to SpillLimit, the next ones are kept in memory up to Size and the newest,
+// beyond both bounds, are dropped: the replayed logs are always the oldest. The stationary spans
+// extended while a log waits in the buffer are written once the log is stored.
+type WriteBuffer struct {
+	sync.Mutex
+
+	Database   database.Database
+	Size       int
+	SpillFile  string
+	SpillLimit int
+
+	queue   []*database.ShuttleLog
+	spilled int
+	// logs whose stationary span has to be written, by vehicle and fix time
+	extended map[extendedKey]*database.ShuttleLog
+	// logs stored by the current write
+	stored []*database.ShuttleLog
+}
+
+type extendedKey struct {
+	vehicleID string
+	fixTime   time.Time
+}
+
+func keyOf(log *database.ShuttleLog) extendedKey {
+	return extendedKey{log.VehicleID, log.FixTime.UTC()}
+}
+
+// NewWriteBuffer creates a buffer and picks up the logs left in the spill file by a previous run, zero
+// bounds take the default bounds
+func NewWriteBuffer(db database.Database, size int, spillFile string, spillLimit int) *WriteBuffer {
+	buffer := &WriteBuffer{Database: db, Size: size, SpillFile: spillFile, SpillLimit: spillLimit,
+		extended: make(map[extendedKey]*database.ShuttleLog)}
+	// the buffer is always bounded
+	if buffer.Size <= 0 {
+		buffer.Size = defaultBufferSize
+	}
+	if buffer.SpillLimit <= 0 {
+		buffer.SpillLimit = defaultBufferSpillLimit
+	}
+	if logs, err := buffer.readSpill(); err != nil {
+		fmt.Printf("Unable to read spill file %s: %s\n", spillFile, err.Error())
+	} else {
+		buffer.spilled = len(logs)
+	}
+	buffer.measure()
+	return buffer
+}
+
+// Write queues the logs behind the buffered ones and flushes the buffer to the database, returns the
+// logs stored by this call in order, the replayed ones included
+func (buffer *WriteBuffer) Write(logs []*database.ShuttleLog) []*database.ShuttleLog {
+	buffer.Lock()
+	defer buffer.Unlock()
+	buffer.stored = nil
+	buffer.queue = append(buffer.queue, logs...)
+	if err := buffer.flush(); err != nil {
+		fmt.Printf("Database unavailable, buffering %d shuttle logs: %s\n", buffer.depth(), err.Error())
+		buffer.overflow()
+	} else {
+		buffer.extend()
+	}
+	buffer.measure()
+	stored := buffer.stored
+	buffer.stored = nil
+	return stored
+}
+
+// Extend writes the stationary spans of the stored logs in one batch, the spans of the logs which are
+// still buffered are written after the logs
+func (buffer *WriteBuffer) Extend(logs []*database.ShuttleLog) {
+	buffer.Lock()
+	defer buffer.Unlock()
+	for _, log := range logs {
+		buffer.extended[keyOf(log)] = log
+	}
+	buffer.extend()
+}
+
+// extend writes the spans of the logs which have an id, the others wait while they are buffered
+func (buffer *WriteBuffer) extend() {
+	stored := []*database.ShuttleLog{}
+	for key, log := range buffer.extended {
+		if log.ID != 0 {
+			stored = append(stored, log)
+		} else if buffer.depth() == 0 {
+			// the log was rejected by the database
+			delete(buffer.extended, key)
+		}
+	}
+	if len(stored) == 0 {
+		return
+	}
+	if err := buffer.Database.ExtendStationary(stored); err != nil {
+		fmt.Printf("Unable to extend stationary span of %d shuttle logs: %s\n", len(stored), err.Error())
+		return
+	}
+	for _, log := range stored {
+		delete(buffer.extended, keyOf(log))
+	}
+}
+
+func (buffer *WriteBuffer) depth() int {
+	return len(buffer.queue) + buffer.spilled
+}
+
+func (buffer *WriteBuffer) measure() {
+	pkg.Gauge("buffer_queue_depth", int64(buffer.depth()))
+}
+
+// flush writes the spilled logs first then the queue, stops at the first failed transaction
+func (buffer *WriteBuffer) flush() error {
+	if buffer.spilled > 0 {
+		logs, err := buffer.readSpill()
+		if err != nil {
+			return err
+		}
+		n, err := buffer.insert(logs)
+		buffer.adopt(logs[:n])
+		if err != nil {
+			if n > 0 {
+				if err := buffer.writeSpill(logs[n:], false); err != nil {
+					fmt.Printf("Unable to rewrite spill file %s: %s\n", buffer.SpillFile, err.Error())
+				}
+				buffer.spilled = len(logs) - n
+			}
+			return err
+		}
+		if err = os.Remove(buffer.SpillFile); err != nil {
+			return err
+		}
+		buffer.spilled = 0
+	}
+	n, err := buffer.insert(buffer.queue)
+	buffer.queue = buffer.queue[n:]
+	return err
+}
+
+// adopt gives the replayed logs' ids to the logs waiting for their span, the spilled logs were
+// read back from the file and are not the logs the deduplicator extended
+func (buffer *WriteBuffer) adopt(logs []*database.ShuttleLog) {
+	for _, log := range logs {
+		if extended, ok := buffer.extended[keyOf(log)]; ok && extended.ID == 0 {
+			extended.ID = log.ID
+		}
+	}
+}
+
+// insert writes the logs in chunks of Size and returns the number of logs written
+// rows rejected by the database are dropped since replaying them can't succeed
+func (buffer *WriteBuffer) insert(logs []*database.ShuttleLog) (int, error) {
+	size := buffer.Size
+	for start := 0; start < len(logs); start += size {
+		end := start + size
+		if end > len(logs) {
+			end = len(logs)
+		}
+		errs, err := buffer.Database.InsertShuttleLogs(logs[start:end])
+		if err != nil {
+			return start, err
+		}
+		for i, err := range errs {
+			if err != nil {
+				fmt.Printf("Dropped shuttle log of vehicle %s: %s\n", logs[start+i].VehicleID, err.Error())
+				pkg.Count("buffer_rejected", 1)
+				continue
+			}
+			buffer.stored = append(buffer.stored, logs[start+i])
+		}
+	}
+	return len(logs), nil
+}
+
+// overflow moves the oldest logs of the queue to the spill file once it exceeds Size and drops the
+// newest logs which fit neither in the spill file nor in memory
+func (buffer *WriteBuffer) overflow() {
+	if len(buffer.queue) <= buffer.Size {
+		return
+	}
+	if buffer.SpillFile != "" {
+		spill := buffer.queue
+		if room := buffer.SpillLimit - buffer.spilled; len(spill) > room {
+			if room < 0 {
+				room = 0
+			}
+			spill = spill[:room]
+		}
+		if err := buffer.writeSpill(spill, true); err != nil {
+			fmt.Printf("Unable to write spill file %s: %s\n", buffer.SpillFile, err.Error())
+		} else {
+			buffer.spilled += len(spill)
+			buffer.queue = buffer.queue[len(spill):]
+		}
+	}
+	if dropped := len(buffer.queue) - buffer.Size; dropped > 0 {
+		buffer.queue = buffer.queue[:buffer.Size]
+		fmt.Printf("Write buffer is full, dropped %d shuttle logs\n", dropped)
+		pkg.Count("buffer_dropped", int64(dropped))
+	}
+}
+
+func (buffer *WriteBuffer) readSpill() ([]*database.ShuttleLog, error) {
+	if buffer.SpillFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(buffer.SpillFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	logs := []*database.ShuttleLog{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		log := &database.ShuttleLog{}
+		if err = json.Unmarshal(scanner.Bytes(), log); err != nil {
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+	return logs, scanner.Err()
+}
+
+// writeSpill appends the logs to the spill file, or replaces its content if append is false. A failed
+// write leaves the file as it was, so that it can still be read: an append is truncated back to the
+// previous size and a replacement is written to a temporary file renamed over the spill file.
+func (buffer *WriteBuffer) writeSpill(logs []*database.ShuttleLog, append bool) error {
+	if !append {
+		tmp := buffer.SpillFile + ".tmp"
+		if err := writeLogs(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, logs); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, buffer.SpillFile)
+	}
+	return writeLogs(buffer.SpillFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, logs)
+}
+
+// writeLogs writes the logs to the file as json lines, the file is truncated back to its size on error
+func writeLogs(name string, flag int, logs []*database.ShuttleLog) error {
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, log := range logs {
+		if err = encoder.Encode(log); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Truncate(info.Size())
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
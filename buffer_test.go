@@ -0,0 +1,171 @@
+package yast
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// outageDatabase fails every write while it's down
+type outageDatabase struct {
+	*database.MockDatabase
+
+	down     bool
+	inserted []string
+	extended map[int64]time.Time
+	lastID   int64
+}
+
+func (db *outageDatabase) InsertShuttleLogs(logs []*database.ShuttleLog) ([]error, error) {
+	if db.down {
+		return make([]error, len(logs)), errors.New("database is down")
+	}
+	for _, log := range logs {
+		db.lastID++
+		log.ID = db.lastID
+		db.inserted = append(db.inserted, log.Status)
+	}
+	return make([]error, len(logs)), nil
+}
+
+func (db *outageDatabase) ExtendStationary(logs []*database.ShuttleLog) error {
+	if db.down {
+		return errors.New("database is down")
+	}
+	if db.extended == nil {
+		db.extended = make(map[int64]time.Time)
+	}
+	for _, log := range logs {
+		db.extended[log.ID] = log.StationaryUntil
+	}
+	return nil
+}
+
+func bufferLogs(from, to int) []*database.ShuttleLog {
+	logs := []*database.ShuttleLog{}
+	for i := from; i <= to; i++ {
+		fixTime := time.Date(2020, 1, 1, 8, 0, i, 0, time.UTC)
+		logs = append(logs, &database.ShuttleLog{VehicleID: "1", Status: fmt.Sprint(i), FixTime: fixTime, Location: &database.Vector{}})
+	}
+	return logs
+}
+
+func TestWriteBufferDefaultSize(t *testing.T) {
+	buffer := NewWriteBuffer(&outageDatabase{}, 0, "", 0)
+	if buffer.Size != defaultBufferSize || buffer.SpillLimit != defaultBufferSpillLimit {
+		t.Fatalf("unbounded buffer: size %d, spill limit %d", buffer.Size, buffer.SpillLimit)
+	}
+}
+
+func TestWriteBufferOverflow(t *testing.T) {
+	db := &outageDatabase{down: true}
+	buffer := NewWriteBuffer(db, 3, "", 0)
+	if stored := buffer.Write(bufferLogs(1, 5)); len(stored) != 0 {
+		t.Fatalf("expected no stored log, got %d", len(stored))
+	}
+	if buffer.depth() != 3 {
+		t.Fatalf("expected 3 buffered logs, got %d", buffer.depth())
+	}
+	db.down = false
+	if stored := buffer.Write(nil); len(stored) != 3 || stored[0].Status != "1" {
+		t.Fatalf("expected the 3 replayed logs to be stored, got %d", len(stored))
+	}
+	// the oldest logs are kept in memory
+	if fmt.Sprint(db.inserted) != "[1 2 3]" {
+		t.Fatalf("expected [1 2 3], got %v", db.inserted)
+	}
+	if buffer.depth() != 0 {
+		t.Fatalf("expected an empty buffer, got %d", buffer.depth())
+	}
+}
+
+func TestWriteBufferReplay(t *testing.T) {
+	spill := filepath.Join(t.TempDir(), "spill.jsonl")
+	db := &outageDatabase{down: true}
+	buffer := NewWriteBuffer(db, 2, spill, 4)
+	// spilled once the queue exceeds the size
+	buffer.Write(bufferLogs(1, 3))
+	buffer.Write(bufferLogs(4, 4))
+	// only one log fits in the spill file, two in memory and the newest is dropped
+	buffer.Write(bufferLogs(5, 7))
+	if buffer.depth() != 6 {
+		t.Fatalf("expected 6 buffered logs, got %d", buffer.depth())
+	}
+	// a restart picks up the spill file, the logs in memory are lost
+	buffer = NewWriteBuffer(db, 2, spill, 4)
+	if buffer.depth() != 4 {
+		t.Fatalf("expected 4 spilled logs after restart, got %d", buffer.depth())
+	}
+	db.down = false
+	buffer.Write(bufferLogs(8, 8))
+	if fmt.Sprint(db.inserted) != "[1 2 3 4 8]" {
+		t.Fatalf("expected the logs in order, got %v", db.inserted)
+	}
+	if buffer.depth() != 0 {
+		t.Fatalf("expected an empty buffer, got %d", buffer.depth())
+	}
+}
+
+func TestWriteBufferExtendSpilled(t *testing.T) {
+	spill := filepath.Join(t.TempDir(), "spill.jsonl")
+	db := &outageDatabase{down: true}
+	buffer := NewWriteBuffer(db, 1, spill, 10)
+	logs := bufferLogs(1, 2)
+	buffer.Write(logs)
+	// the first log is in the spill file, its span is extended before it's stored
+	until := logs[0].FixTime.Add(time.Minute)
+	logs[0].StationaryUntil = until
+	buffer.Extend(logs[:1])
+	if len(db.extended) != 0 {
+		t.Fatalf("extended a log which isn't stored: %v", db.extended)
+	}
+	db.down = false
+	buffer.Write(nil)
+	if logs[0].ID != 1 {
+		t.Fatalf("expected the replayed id 1, got %d", logs[0].ID)
+	}
+	if !db.extended[1].Equal(until) {
+		t.Fatalf("expected the span of log 1 to end at %v, got %v", until, db.extended)
+	}
+	if len(buffer.extended) != 0 {
+		t.Fatalf("expected no pending span, got %d", len(buffer.extended))
+	}
+}
+
+func TestWriteBufferExtendBatch(t *testing.T) {
+	db := &outageDatabase{}
+	buffer := NewWriteBuffer(db, 10, "", 0)
+	logs := bufferLogs(1, 3)
+	buffer.Write(logs)
+	for _, log := range logs {
+		log.StationaryUntil = log.FixTime.Add(time.Minute)
+	}
+	buffer.Extend(logs)
+	if len(db.extended) != 3 {
+		t.Fatalf("expected 3 spans in one batch, got %v", db.extended)
+	}
+}
+
+func TestWriteBufferFailedSpill(t *testing.T) {
+	spill := filepath.Join(t.TempDir(), "spill.jsonl")
+	db := &outageDatabase{down: true}
+	buffer := NewWriteBuffer(db, 1, spill, 1000)
+	buffer.Write(bufferLogs(1, 2))
+	// the encoder fails on the last log after writing the others past the write buffer
+	logs := bufferLogs(3, 60)
+	logs[len(logs)-1].Location.X = math.NaN()
+	buffer.Write(logs)
+	if buffer.spilled != 2 || len(buffer.queue) != 1 || buffer.queue[0].Status != "3" {
+		t.Fatalf("expected 2 spilled logs and log 3 in memory, got %d and %d", buffer.spilled, len(buffer.queue))
+	}
+	db.down = false
+	buffer.Write(nil)
+	if fmt.Sprint(db.inserted) != "[1 2 3]" {
+		t.Fatalf("expected [1 2 3], got %v", db.inserted)
+	}
+}
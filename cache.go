@@ -0,0 +1,144 @@
+package yast
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+const (
+	// cached routes, stops, schedules and travel times are reloaded from the database after this time
+	routeRefreshInterval = time.Minute
+)
+
+// timedCache keeps the values loaded from the database for routeRefreshInterval
+type timedCache struct {
+	sync.Mutex
+
+	entries map[interface{}]*cacheEntry
+}
+
+type cacheEntry struct {
+	value    interface{}
+	loadedAt time.Time
+}
+
+// get returns the value of the key, loaded again once it's older than routeRefreshInterval. A failed
+// load returns its error along with the previous value, nil if the key was never loaded.
+func (c *timedCache) get(key interface{}, load func() (interface{}, error)) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[interface{}]*cacheEntry)
+	}
+	cached, ok := c.entries[key]
+	if ok && time.Since(cached.loadedAt) < routeRefreshInterval {
+		return cached.value, nil
+	}
+	value, err := load()
+	if err != nil {
+		if ok {
+			return cached.value, err
+		}
+		return nil, err
+	}
+	c.entries[key] = &cacheEntry{value, time.Now()}
+	return value, nil
+}
+
+// forget drops the keys matching, they are loaded again on their next use
+func (c *timedCache) forget(match func(key interface{}) bool) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.entries {
+		if match(key) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// RouteCache holds the routes, the stops and the vehicles shared by the processors. The routes have
+// the active detours applied. A change notified by any instance reloads them on their next use.
+type RouteCache struct {
+	Database database.Database
+
+	routes   timedCache // a single entry
+	stops    timedCache // route name -> stops
+	vehicles timedCache // vehicle id -> vehicle
+}
+
+// Routes returns the routes with their active detours
+func (c *RouteCache) Routes() []*database.ClosedRoute {
+	routes, err := c.routes.get("", func() (interface{}, error) {
+		routes, err := c.Database.ListClosedRoutes()
+		if err != nil {
+			return nil, err
+		}
+		// the vehicles follow the detours of their route
+		now := time.Now()
+		if detours, err := c.Database.SelectDetours("", now, now); err == nil {
+			routes = database.ApplyDetours(routes, detours, now)
+		}
+		return routes, nil
+	})
+	if err != nil {
+		fmt.Printf("Unable to load the routes: %s\n", err.Error())
+	}
+	if routes == nil {
+		return nil
+	}
+	return routes.([]*database.ClosedRoute)
+}
+
+// Route returns the route by name, nil if it's unknown
+func (c *RouteCache) Route(name string) *database.ClosedRoute {
+	for _, route := range c.Routes() {
+		if route.Name == name {
+			return route
+		}
+	}
+	return nil
+}
+
+// Stops returns the stops of the route, none without route
+func (c *RouteCache) Stops(routeName string) []*database.Stop {
+	if routeName == "" {
+		return nil
+	}
+	stops, err := c.stops.get(routeName, func() (interface{}, error) {
+		return c.Database.SelectStopOnRoute(routeName)
+	})
+	if err != nil {
+		fmt.Printf("Unable to load the stops of route %s: %s\n", routeName, err.Error())
+	}
+	if stops == nil {
+		return nil
+	}
+	return stops.([]*database.Stop)
+}
+
+// Vehicle returns the vehicle with its assigned route, nil until the vehicle is registered
+func (c *RouteCache) Vehicle(vehicleID string) *database.Vehicle {
+	vehicle, err := c.vehicles.get(vehicleID, func() (interface{}, error) {
+		return c.Database.SelectVehicle(vehicleID)
+	})
+	if err != nil || vehicle == nil {
+		return nil
+	}
+	return vehicle.(*database.Vehicle)
+}
+
+// Notify drops the routes, the stops of a route or the vehicle changed by any instance
+func (c *RouteCache) Notify(n database.Notification) {
+	switch n.Channel {
+	case database.RouteChannel:
+		// the detours are notified on the route channel too
+		c.routes.forget(func(interface{}) bool { return true })
+	case database.StopChannel:
+		c.stops.forget(func(key interface{}) bool { return key == n.Key })
+	case database.VehicleChannel:
+		c.vehicles.forget(func(key interface{}) bool { return key == n.Key })
+	}
+}
@@ -7,18 +7,113 @@ type Database interface {
 	Open()
 	// Insert a shuttle log into database
 	InsertShuttleLog(*ShuttleLog) error
+	// Insert a batch of shuttle logs in a single transaction, returns the error of each row
+	// and the error of the transaction
+	InsertShuttleLogs([]*ShuttleLog) ([]error, error)
+	// Update the end of the stationary span of stored shuttle logs in one transaction
+	ExtendStationary([]*ShuttleLog) error
 	// return the latest log of a shuttle by shuttle name
 	SelectLatestLog(string) (*ShuttleLog, error)
+	// Insert a rejected shuttle log into the quarantine
+	InsertQuarantine(*QuarantinedLog) error
+	// Select the quarantined logs created in a time range
+	SelectQuarantine(time.Time, time.Time) ([]*QuarantinedLog, error)
+	// Insert or update a vehicle by its remote id
+	UpsertVehicle(*Vehicle) error
+	// Select a vehicle by its remote id
+	SelectVehicle(string) (*Vehicle, error)
+	// Select all the vehicles
+	ListVehicles() ([]*Vehicle, error)
+	// Retire a vehicle by its remote id, it's kept inactive with its history
+	DeleteVehicle(string) error
+	// Assign a route to a vehicle and record it in the history of its assignments
+	AssignRoute(*RouteAssignment) error
+	// Select the history of route assignments of a vehicle in a time range
+	SelectRouteAssignments(string, time.Time, time.Time) ([]*RouteAssignment, error)
+	// Change the state of a vehicle and record the transition
+	UpdateVehicleState(*VehicleState) error
+	// Select the state transitions of a vehicle by vehicle id made in a time range
+	SelectVehicleStates(string, time.Time, time.Time) ([]*VehicleState, error)
 	// Insert a closed route to database
 	InsertClosedRoute(*ClosedRoute) error
 	// Select a closed route to database by route name
 	SelectClosedRoute(string) (*ClosedRoute, error)
-	// Insert a stop to database
+	// Select all closed routes
+	ListClosedRoutes() ([]*ClosedRoute, error)
+	// Insert a stop to database or update the stop with the same remote id
 	InsertStop(*Stop) error
-	// Select a stop from database by stop name
+	// Select a stop from database by its remote id
 	SelectStop(string) (*Stop, error)
 	// Select all stops on a route by route name
 	SelectStopOnRoute(string) ([]*Stop, error)
+	// Insert the arrival of a shuttle at a stop, with its departure if it's known
+	InsertStopEvent(*StopEvent) error
+	// Record the departure of a shuttle from a stop, the event must have been inserted
+	UpdateStopEvent(*StopEvent) error
+	// Record the departure of a shuttle, if not nil, and insert its next arrivals in one transaction
+	RecordStopEvents(*StopEvent, []*StopEvent) error
+	// Select the events of a stop by its remote id with an arrival in a time range
+	SelectStopEvents(string, time.Time, time.Time) ([]*StopEvent, error)
+	// Select a stop event by its id
+	SelectStopEvent(int64) (*StopEvent, error)
+	// Select the arrivals compared to the schedule of a route by route name, or of all the routes if
+	// empty, scheduled in a time range
+	SelectAdherence(string, time.Time, time.Time, *AdherenceTolerance) ([]*Adherence, error)
+	// Select the shuttle logs with a route and a fix time in a time range, ordered by fix time
+	SelectRouteLogs(time.Time, time.Time) ([]*ShuttleLog, error)
+	// Insert the travels of the vehicles between two consecutive stops
+	InsertSegmentSamples([]*SegmentSample) error
+	// Select the end of the latest segment sample, zero if there is none
+	SelectLatestSegmentSample() (time.Time, error)
+	// Rebuild the segment travel times from the samples since a time, bucketed in a time zone, the older
+	// samples are deleted
+	UpdateSegmentTimes(time.Time, *time.Location) error
+	// Select the segment travel times of a route by route name
+	SelectSegmentTimes(string) ([]*SegmentTime, error)
+	// Insert a service calendar or replace the calendar with the same service id
+	UpsertCalendar(*ServiceCalendar) error
+	// Select a service calendar by its service id
+	SelectCalendar(string) (*ServiceCalendar, error)
+	// Replace the trips of a route by route name
+	InsertTrips(string, []*Trip) error
+	// Select the trips of a route by route name with their stop times
+	SelectTrips(string) ([]*Trip, error)
+	// Insert a headway alert
+	InsertHeadwayAlert(*HeadwayAlert) error
+	// Record the end of a headway alert, the alert must have been inserted
+	ResolveHeadwayAlert(*HeadwayAlert) error
+	// Select the headway alerts of a route by route name raised in a time range or still open
+	SelectHeadwayAlerts(string, time.Time, time.Time) ([]*HeadwayAlert, error)
+	// Select the headway alerts of every route that are not resolved
+	SelectOpenHeadwayAlerts() ([]*HeadwayAlert, error)
+	// Insert a detour of a route
+	InsertDetour(*Detour) error
+	// Delete a detour by id
+	DeleteDetour(int64) error
+	// Select the detours of a route by route name overlapping a time range, of all the routes without name
+	SelectDetours(string, time.Time, time.Time) ([]*Detour, error)
+	// Insert an off-route event
+	InsertOffRouteEvent(*OffRouteEvent) error
+	// Update the end and the distance of an off-route event, the event must have been inserted
+	UpdateOffRouteEvent(*OffRouteEvent) error
+	// Select the off-route events of a route by route name started in a time range or still going on
+	SelectOffRouteEvents(string, time.Time, time.Time) ([]*OffRouteEvent, error)
+	// Insert a service alert with its routes, stops and periods
+	InsertServiceAlert(*ServiceAlert) error
+	// Replace a service alert by id
+	UpdateServiceAlert(*ServiceAlert) error
+	// Delete a service alert by id
+	DeleteServiceAlert(int64) error
+	// Select a service alert by id
+	SelectServiceAlert(int64) (*ServiceAlert, error)
+	// Select the service alerts active at a time, all of them with the zero time
+	SelectServiceAlerts(time.Time) ([]*ServiceAlert, error)
+	// Acquire or renew a lease for the holder, returns true if the holder owns the lease
+	AcquireLease(*Lease) (bool, error)
+	// Select a lease by its name, nil if it was never acquired
+	SelectLease(string) (*Lease, error)
+	// Register a function called on every change made by any instance
+	Subscribe(func(Notification))
 	// close
 	Close()
 }
@@ -46,6 +141,83 @@ type ShuttleLog struct {
 	Location  *Vector
 	Name      string
 	CreatedAt time.Time
+	// time of the fix reported by the device
+	FixTime time.Time
+	// set when later fixes reported the same position, the log then spans FixTime to StationaryUntil
+	StationaryUntil time.Time
+	// name of the feed which reported the log
+	Source string
+	// route assigned to the vehicle at the time of the log, empty if none
+	RouteName string
+	// location snapped to the route and its distance in meters from the start of the route, nil if no route
+	Snapped       *Vector
+	RouteDistance float64
+}
+
+// Vehicle is the meta data of a shuttle identified by its remote id
+type Vehicle struct {
+	Model
+
+	VehicleID     string
+	Name          string
+	Capacity      int
+	Accessibility []string
+	Plate         string
+	Active        bool
+	// name of the assigned route, empty if none
+	RouteName string
+	// confidence of the automatic route assignment in [0, 1], 0 if assigned manually
+	RouteConfidence float64
+	RouteAssignedAt time.Time
+	// current state of the vehicle, empty until it's known
+	State      string
+	StateSince time.Time
+}
+
+// states of the vehicles
+const (
+	// moving on its route, or briefly stopped
+	StateInService = "in_service"
+	// stopped at a stop of its route
+	StateIdleAtStop = "idle_at_stop"
+	// stopped for a long time away from the stops
+	StateParked = "parked"
+	// no recent fix
+	StateStale = "stale"
+	// away from its route
+	StateOffRoute = "off_route"
+	// inactive, or moving without a route
+	StateOutOfService = "out_of_service"
+)
+
+// VehicleState is a transition of a vehicle from the Previous state to State
+type VehicleState struct {
+	Model
+
+	VehicleID string
+	Previous  string
+	State     string
+	At        time.Time
+}
+
+// RouteAssignment assigns a route to a vehicle
+type RouteAssignment struct {
+	Model
+
+	VehicleID string
+	// empty if the vehicle was unassigned
+	RouteName  string
+	Confidence float64
+	AssignedAt time.Time
+}
+
+// QuarantinedLog is a shuttle log rejected by the updater with the reason of the rejection
+type QuarantinedLog struct {
+	Model
+
+	Log       *ShuttleLog
+	Reason    string
+	CreatedAt time.Time
 }
 
 // ClosedRoute contains a list of vectors in the database with well defined ordering
@@ -62,7 +234,290 @@ type Stop struct {
 	Model
 
 	Location *Vector
-	Route    *ClosedRoute
-	StopID   string
-	Name     string
+	// only the name of the route is selected with the stop
+	Route  *ClosedRoute
+	StopID string
+	Name   string
+}
+
+// StopEvent is the visit of a shuttle at a stop, from its arrival to its departure
+type StopEvent struct {
+	Model
+
+	StopID    string
+	VehicleID string
+	RouteName string
+	ArrivedAt time.Time
+	// zero while the shuttle is at the stop
+	DepartedAt time.Time
+	Dwell      time.Duration
+	// scheduled visit matched to the arrival and how late the arrival was, empty if unscheduled
+	TripID      string
+	ScheduledAt time.Time
+	Deviation   time.Duration
+}
+
+// AdherenceTolerance tells when an arrival is on time, hours are in the location
+type AdherenceTolerance struct {
+	Early    time.Duration
+	Late     time.Duration
+	Location *time.Location
+}
+
+// Adherence counts the arrivals at a stop scheduled at an hour of the day
+type Adherence struct {
+	RouteName string
+	StopID    string
+	Hour      int
+	Arrivals  int
+	Early     int
+	Late      int
+	// average of the deviations from the schedule
+	MeanDeviation time.Duration
+}
+
+// SegmentSample is the travel of a vehicle between two consecutive stops of a route, from its arrival at
+// the first stop to its arrival at the next one so that the dwell at the first stop is included
+type SegmentSample struct {
+	RouteName string
+	FromStop  string
+	ToStop    string
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// SegmentTime is the median travel time between two consecutive stops of a route at an hour of a day
+// of the week
+type SegmentTime struct {
+	RouteName  string
+	FromStop   string
+	ToStop     string
+	Weekday    time.Weekday
+	Hour       int
+	TravelTime time.Duration
+	Samples    int
+	UpdatedAt  time.Time
+}
+
+// ServiceCalendar tells the days a service runs
+type ServiceCalendar struct {
+	Model
+
+	ServiceID string
+	// days of the week the service runs, indexed by time.Weekday
+	Weekdays [7]bool
+	// first and last days of the service, zero if unbounded
+	StartDate time.Time
+	EndDate   time.Time
+	// dates added to or removed from the service
+	Exceptions []CalendarException
+}
+
+// CalendarException adds or removes a date from a service
+type CalendarException struct {
+	Date  time.Time
+	Added bool
+}
+
+// ActiveOn tells if the service runs on the date, only the year, month and day of the date are used
+func (c *ServiceCalendar) ActiveOn(date time.Time) bool {
+	y, m, d := date.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	for _, e := range c.Exceptions {
+		ey, em, ed := e.Date.Date()
+		if ey == y && em == m && ed == d {
+			return e.Added
+		}
+	}
+	if !c.StartDate.IsZero() {
+		sy, sm, sd := c.StartDate.Date()
+		if day.Before(time.Date(sy, sm, sd, 0, 0, 0, 0, time.UTC)) {
+			return false
+		}
+	}
+	if !c.EndDate.IsZero() {
+		ey, em, ed := c.EndDate.Date()
+		if day.After(time.Date(ey, em, ed, 0, 0, 0, 0, time.UTC)) {
+			return false
+		}
+	}
+	return c.Weekdays[day.Weekday()]
+}
+
+// Trip is a scheduled run of a vehicle along a route
+type Trip struct {
+	Model
+
+	TripID    string
+	RouteName string
+	ServiceID string
+	Headsign  string
+	StopTimes []*StopTime
+}
+
+// StopTime is the scheduled visit of a trip at a stop, times are from noon minus 12 hours of the service day as in GTFS
+// and may exceed a day
+type StopTime struct {
+	StopID    string
+	Sequence  int
+	Arrival   time.Duration
+	Departure time.Duration
+}
+
+// kinds of the headway alerts
+const (
+	// the vehicle is too close to the vehicle ahead
+	HeadwayBunching = "bunching"
+	// the vehicle is too far from the vehicle ahead
+	HeadwayGap = "gap"
+)
+
+// HeadwayAlert tells that the distance of a vehicle to the vehicle ahead of it on the route is out of bounds
+type HeadwayAlert struct {
+	Model
+
+	RouteName string
+	Kind      string
+	VehicleID string
+	AheadID   string
+	// meters along the route to the vehicle ahead when the alert was raised
+	Distance float64
+	RaisedAt time.Time
+	// zero while the alert is open
+	ResolvedAt time.Time
+}
+
+// Detour is a temporary path of a route, it replaces the points of the route from StartsAt to EndsAt
+type Detour struct {
+	Model
+
+	RouteName string
+	Points    []*Vector
+	StartsAt  time.Time
+	EndsAt    time.Time
+	Reason    string
+}
+
+// ActiveAt tells whether the detour overrides its route at the time
+func (d *Detour) ActiveAt(t time.Time) bool {
+	return !t.Before(d.StartsAt) && t.Before(d.EndsAt)
+}
+
+// Apply returns a copy of the route following the detour
+func (d *Detour) Apply(route *ClosedRoute) *ClosedRoute {
+	return &ClosedRoute{Model: route.Model, Name: route.Name, RoutePoints: d.Points}
+}
+
+// ApplyDetours returns the routes following their detour active at the time, the detour starting last
+// wins when several overlap
+func ApplyDetours(routes []*ClosedRoute, detours []*Detour, at time.Time) []*ClosedRoute {
+	active := make(map[string]*Detour)
+	for _, d := range detours {
+		if d.ActiveAt(at) && (active[d.RouteName] == nil || !d.StartsAt.Before(active[d.RouteName].StartsAt)) {
+			active[d.RouteName] = d
+		}
+	}
+	if len(active) == 0 {
+		return routes
+	}
+	applied := make([]*ClosedRoute, len(routes))
+	for i, route := range routes {
+		applied[i] = route
+		if d, ok := active[route.Name]; ok {
+			applied[i] = d.Apply(route)
+		}
+	}
+	return applied
+}
+
+// OffRouteEvent tells that a vehicle stayed away from its route
+type OffRouteEvent struct {
+	Model
+
+	VehicleID string
+	RouteName string
+	StartedAt time.Time
+	// zero while the vehicle is off its route
+	EndedAt time.Time
+	// meters of the farthest fix from the route
+	MaxDistance float64
+}
+
+// severities of the service alerts
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeveritySevere  = "severe"
+)
+
+// ServiceAlert tells the riders about a disruption of the service
+type ServiceAlert struct {
+	Model
+
+	Severity    string
+	Header      string
+	Description string
+	URL         string
+	// names of the affected routes and ids of the affected stops, the whole service if both are empty
+	Routes []string
+	Stops  []string
+	// the alert is active during its periods, always if it has none
+	Periods   []AlertPeriod
+	UpdatedAt time.Time
+}
+
+// AlertPeriod is a time range of a service alert, it never ends if End is zero
+type AlertPeriod struct {
+	Start time.Time
+	End   time.Time
+}
+
+// ActiveAt tells whether the alert is active at the time
+func (a *ServiceAlert) ActiveAt(t time.Time) bool {
+	if len(a.Periods) == 0 {
+		return true
+	}
+	for _, p := range a.Periods {
+		if !t.Before(p.Start) && (p.End.IsZero() || t.Before(p.End)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Affects tells whether the alert concerns the route or the stop, either may be empty
+func (a *ServiceAlert) Affects(routeName, stopID string) bool {
+	if len(a.Routes) == 0 && len(a.Stops) == 0 {
+		return true
+	}
+	for _, r := range a.Routes {
+		if routeName != "" && r == routeName {
+			return true
+		}
+	}
+	for _, s := range a.Stops {
+		if stopID != "" && s == stopID {
+			return true
+		}
+	}
+	return false
+}
+
+// Lease is held by one instance at a time until it expires, used to elect a leader
+type Lease struct {
+	Name       string
+	Holder     string
+	TTL        time.Duration
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// Notification tells that a record was changed by an instance
+type Notification struct {
+	// kind of the record, e.g. LogChannel
+	Channel string
+	// key of the record, e.g. the vehicle id of a shuttle log
+	Key string
+	// the change was made by this instance
+	Local bool
 }
@@ -63,4 +63,353 @@ var migrations = []migrate.Migration{
 			`DROP TABLE IF EXISTS shuttle_log, shuttle_meta, route, route_path, stop, stop_meta, map_point`,
 		}),
 	},
+	{
+		ID: 2,
+		Up: migrate.Queries([]string{
+			`ALTER TABLE shuttle_log ADD COLUMN IF NOT EXISTS fix_time TIMESTAMP WITH TIME ZONE`,
+			`ALTER TABLE shuttle_log ADD COLUMN IF NOT EXISTS stationary_until TIMESTAMP WITH TIME ZONE`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE shuttle_log DROP COLUMN IF EXISTS fix_time, DROP COLUMN IF EXISTS stationary_until`,
+		}),
+	},
+	{
+		ID: 3,
+		Up: migrate.Queries([]string{
+			// shuttle logs rejected by the updater
+			`CREATE TABLE IF NOT EXISTS shuttle_quarantine(
+					id SERIAL PRIMARY KEY,
+					remote_shuttle_id VARCHAR(64) NOT NULL,
+					longitude FLOAT,
+					latitude FLOAT,
+					angle FLOAT,
+					speed FLOAT,
+					status VARCHAR(64),
+					fix_time TIMESTAMP WITH TIME ZONE,
+					reason VARCHAR(256),
+					created_at TIMESTAMP WITH TIME ZONE
+				)`,
+			`CREATE INDEX ON shuttle_quarantine(created_at)`,
+			// the parser stored the latitude in x and the longitude in y until this version, the
+			// positions of the shuttle logs are swapped once along with the parser fix
+			`UPDATE map_point SET longitude = latitude, latitude = longitude
+				WHERE id IN (SELECT map_point_id FROM shuttle_log)`,
+		}),
+		Down: migrate.Queries([]string{
+			`UPDATE map_point SET longitude = latitude, latitude = longitude
+				WHERE id IN (SELECT map_point_id FROM shuttle_log)`,
+			`DROP TABLE IF EXISTS shuttle_quarantine`,
+		}),
+	},
+	{
+		ID: 4,
+		Up: migrate.Queries([]string{
+			`ALTER TABLE shuttle_log ADD COLUMN IF NOT EXISTS source VARCHAR(64)`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE shuttle_log DROP COLUMN IF EXISTS source`,
+		}),
+	},
+	{
+		ID: 5,
+		Up: migrate.Queries([]string{
+			// leases held by a single instance
+			`CREATE TABLE IF NOT EXISTS lease(
+					name VARCHAR(64) PRIMARY KEY,
+					holder VARCHAR(256) NOT NULL,
+					acquired_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+				)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS lease`,
+		}),
+	},
+	{
+		ID: 6,
+		Up: migrate.Queries([]string{
+			`ALTER TABLE shuttle_meta
+					ADD COLUMN IF NOT EXISTS capacity INT,
+					ADD COLUMN IF NOT EXISTS accessibility VARCHAR(64)[],
+					ADD COLUMN IF NOT EXISTS plate VARCHAR(32),
+					ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE shuttle_meta
+					DROP COLUMN IF EXISTS capacity,
+					DROP COLUMN IF EXISTS accessibility,
+					DROP COLUMN IF EXISTS plate,
+					DROP COLUMN IF EXISTS active`,
+		}),
+	},
+	{
+		ID: 7,
+		Up: migrate.Queries([]string{
+			`ALTER TABLE shuttle_meta
+					ADD COLUMN IF NOT EXISTS route_confidence FLOAT,
+					ADD COLUMN IF NOT EXISTS route_assigned_at TIMESTAMP WITH TIME ZONE`,
+			// history of the route assignments
+			`CREATE TABLE IF NOT EXISTS route_assignment(
+					id SERIAL PRIMARY KEY,
+					shuttle_meta_id INT REFERENCES shuttle_meta(id) ON DELETE CASCADE,
+					route_id INT NULL REFERENCES route(id) ON DELETE SET NULL,
+					confidence FLOAT,
+					assigned_at TIMESTAMP WITH TIME ZONE
+				)`,
+			`CREATE INDEX ON route_assignment(shuttle_meta_id, assigned_at)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS route_assignment`,
+			`ALTER TABLE shuttle_meta DROP COLUMN IF EXISTS route_confidence, DROP COLUMN IF EXISTS route_assigned_at`,
+		}),
+	},
+	{
+		ID: 8,
+		Up: migrate.Queries([]string{
+			// location of the log snapped to its route
+			`ALTER TABLE shuttle_log
+					ADD COLUMN IF NOT EXISTS route_id INT NULL REFERENCES route(id) ON DELETE SET NULL,
+					ADD COLUMN IF NOT EXISTS snapped_longitude FLOAT,
+					ADD COLUMN IF NOT EXISTS snapped_latitude FLOAT,
+					ADD COLUMN IF NOT EXISTS route_distance FLOAT`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE shuttle_log
+					DROP COLUMN IF EXISTS route_id,
+					DROP COLUMN IF EXISTS snapped_longitude,
+					DROP COLUMN IF EXISTS snapped_latitude,
+					DROP COLUMN IF EXISTS route_distance`,
+		}),
+	},
+	{
+		ID: 9,
+		Up: migrate.Queries([]string{
+			// stops are identified by their remote id and belong to one route
+			`ALTER TABLE stop_meta ADD COLUMN IF NOT EXISTS remote_stop_id VARCHAR(64) UNIQUE`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS stop_stop_meta_id ON stop(stop_meta_id)`,
+			// arrivals and departures of the shuttles at the stops
+			`CREATE TABLE IF NOT EXISTS stop_event(
+					id SERIAL PRIMARY KEY,
+					stop_id INT REFERENCES stop(id) ON DELETE CASCADE,
+					shuttle_meta_id INT NULL REFERENCES shuttle_meta(id) ON DELETE SET NULL,
+					route_id INT NULL REFERENCES route(id) ON DELETE SET NULL,
+					arrived_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					departed_at TIMESTAMP WITH TIME ZONE,
+					dwell FLOAT
+				)`,
+			`CREATE INDEX ON stop_event(stop_id, arrived_at)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS stop_event`,
+			`DROP INDEX IF EXISTS stop_stop_meta_id`,
+			`ALTER TABLE stop_meta DROP COLUMN IF EXISTS remote_stop_id`,
+		}),
+	},
+	{
+		ID: 10,
+		Up: migrate.Queries([]string{
+			// usual travel times between consecutive stops by day of the week and hour
+			`CREATE TABLE IF NOT EXISTS segment_time(
+					route_id INT REFERENCES route(id) ON DELETE CASCADE,
+					from_stop_id INT REFERENCES stop(id) ON DELETE CASCADE,
+					to_stop_id INT REFERENCES stop(id) ON DELETE CASCADE,
+					day_of_week INT,
+					hour INT,
+					travel_time FLOAT NOT NULL,
+					samples INT NOT NULL,
+					updated_at TIMESTAMP WITH TIME ZONE,
+					PRIMARY KEY (route_id, from_stop_id, to_stop_id, day_of_week, hour)
+				)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS segment_time`,
+		}),
+	},
+	{
+		ID: 11,
+		Up: migrate.Queries([]string{
+			// service calendars, the weekdays are indexed from sunday
+			`CREATE TABLE IF NOT EXISTS service_calendar(
+					id SERIAL PRIMARY KEY,
+					service_id VARCHAR(64) UNIQUE NOT NULL,
+					CONSTRAINT service_id CHECK(char_length(service_id) > 0),
+					weekdays BOOLEAN[],
+					start_date DATE,
+					end_date DATE
+				)`,
+			// dates added to or removed from a service
+			`CREATE TABLE IF NOT EXISTS service_calendar_date(
+					calendar_id INT REFERENCES service_calendar(id) ON DELETE CASCADE,
+					date DATE,
+					added BOOLEAN NOT NULL,
+					PRIMARY KEY (calendar_id, date)
+				)`,
+			// scheduled trips of the routes
+			`CREATE TABLE IF NOT EXISTS trip(
+					id SERIAL PRIMARY KEY,
+					trip_id VARCHAR(64) UNIQUE NOT NULL,
+					route_id INT REFERENCES route(id) ON DELETE CASCADE,
+					calendar_id INT REFERENCES service_calendar(id) ON DELETE CASCADE,
+					headsign VARCHAR(64)
+				)`,
+			`CREATE INDEX ON trip(route_id)`,
+			// times in seconds from the midnight of the service day, may exceed a day
+			`CREATE TABLE IF NOT EXISTS stop_time(
+					trip_id INT REFERENCES trip(id) ON DELETE CASCADE,
+					stop_id INT REFERENCES stop(id) ON DELETE CASCADE,
+					sequence INT,
+					arrival INT,
+					departure INT,
+					PRIMARY KEY (trip_id, sequence)
+				)`,
+			`CREATE INDEX ON stop_time(stop_id)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS stop_time, trip, service_calendar_date, service_calendar`,
+		}),
+	},
+	{
+		ID: 12,
+		Up: migrate.Queries([]string{
+			// scheduled visit matched to the arrival and how late the arrival was, in seconds
+			`ALTER TABLE stop_event
+					ADD COLUMN IF NOT EXISTS trip_id INT NULL REFERENCES trip(id) ON DELETE SET NULL,
+					ADD COLUMN IF NOT EXISTS scheduled_at TIMESTAMP WITH TIME ZONE,
+					ADD COLUMN IF NOT EXISTS deviation FLOAT`,
+			`CREATE INDEX ON stop_event(route_id, scheduled_at)`,
+		}),
+		Down: migrate.Queries([]string{
+			`ALTER TABLE stop_event
+					DROP COLUMN IF EXISTS trip_id,
+					DROP COLUMN IF EXISTS scheduled_at,
+					DROP COLUMN IF EXISTS deviation`,
+		}),
+	},
+	{
+		ID: 13,
+		Up: migrate.Queries([]string{
+			// vehicles too close to or too far from the vehicle ahead of them on a route
+			`CREATE TABLE IF NOT EXISTS headway_alert(
+					id SERIAL PRIMARY KEY,
+					route_id INT REFERENCES route(id) ON DELETE CASCADE,
+					kind VARCHAR(16) NOT NULL,
+					shuttle_meta_id INT NULL REFERENCES shuttle_meta(id) ON DELETE SET NULL,
+					ahead_shuttle_meta_id INT NULL REFERENCES shuttle_meta(id) ON DELETE SET NULL,
+					distance FLOAT,
+					raised_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					resolved_at TIMESTAMP WITH TIME ZONE
+				)`,
+			`CREATE INDEX ON headway_alert(route_id, raised_at)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS headway_alert`,
+		}),
+	},
+	{
+		ID: 14,
+		Up: migrate.Queries([]string{
+			// temporary geometries overriding their route for a time window
+			`CREATE TABLE IF NOT EXISTS route_detour(
+					id SERIAL PRIMARY KEY,
+					route_id INT REFERENCES route(id) ON DELETE CASCADE,
+					starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					reason TEXT NOT NULL DEFAULT ''
+				)`,
+			`CREATE INDEX ON route_detour(route_id, ends_at)`,
+			`CREATE TABLE IF NOT EXISTS detour_path(
+					id SERIAL PRIMARY KEY,
+					route_detour_id INT REFERENCES route_detour(id) ON DELETE CASCADE,
+					map_point_id INT REFERENCES map_point(id) ON DELETE CASCADE,
+					ordering INT
+				)`,
+			// vehicles away from their route
+			`CREATE TABLE IF NOT EXISTS off_route_event(
+					id SERIAL PRIMARY KEY,
+					shuttle_meta_id INT REFERENCES shuttle_meta(id) ON DELETE CASCADE,
+					route_id INT REFERENCES route(id) ON DELETE CASCADE,
+					started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					ended_at TIMESTAMP WITH TIME ZONE,
+					max_distance FLOAT
+				)`,
+			`CREATE INDEX ON off_route_event(route_id, started_at)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS detour_path, route_detour, off_route_event`,
+		}),
+	},
+	{
+		ID: 15,
+		Up: migrate.Queries([]string{
+			// current state of the vehicles and its history
+			`ALTER TABLE shuttle_meta
+					ADD COLUMN IF NOT EXISTS state VARCHAR(16) NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS state_since TIMESTAMP WITH TIME ZONE`,
+			`CREATE TABLE IF NOT EXISTS vehicle_state_transition(
+					id SERIAL PRIMARY KEY,
+					shuttle_meta_id INT REFERENCES shuttle_meta(id) ON DELETE CASCADE,
+					from_state VARCHAR(16) NOT NULL,
+					to_state VARCHAR(16) NOT NULL,
+					at TIMESTAMP WITH TIME ZONE NOT NULL
+				)`,
+			`CREATE INDEX ON vehicle_state_transition(shuttle_meta_id, at)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS vehicle_state_transition`,
+			`ALTER TABLE shuttle_meta
+					DROP COLUMN IF EXISTS state,
+					DROP COLUMN IF EXISTS state_since`,
+		}),
+	},
+	{
+		ID: 16,
+		Up: migrate.Queries([]string{
+			// service alerts shown to the riders
+			`CREATE TABLE IF NOT EXISTS service_alert(
+					id SERIAL PRIMARY KEY,
+					severity VARCHAR(16) NOT NULL,
+					header TEXT NOT NULL,
+					description TEXT NOT NULL DEFAULT '',
+					url TEXT NOT NULL DEFAULT '',
+					updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+				)`,
+			`CREATE TABLE IF NOT EXISTS service_alert_route(
+					service_alert_id INT REFERENCES service_alert(id) ON DELETE CASCADE,
+					route_id INT REFERENCES route(id) ON DELETE CASCADE
+				)`,
+			`CREATE TABLE IF NOT EXISTS service_alert_stop(
+					service_alert_id INT REFERENCES service_alert(id) ON DELETE CASCADE,
+					stop_meta_id INT REFERENCES stop_meta(id) ON DELETE CASCADE
+				)`,
+			`CREATE TABLE IF NOT EXISTS service_alert_period(
+					service_alert_id INT REFERENCES service_alert(id) ON DELETE CASCADE,
+					starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					ends_at TIMESTAMP WITH TIME ZONE
+				)`,
+			`CREATE INDEX ON service_alert_period(service_alert_id)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS service_alert_period, service_alert_stop, service_alert_route, service_alert`,
+		}),
+	},
+	{
+		ID: 17,
+		Up: migrate.Queries([]string{
+			// travels of the vehicles between consecutive stops derived from the shuttle logs
+			`CREATE TABLE IF NOT EXISTS segment_sample(
+					route_id INT REFERENCES route(id) ON DELETE CASCADE,
+					from_stop_id INT REFERENCES stop(id) ON DELETE CASCADE,
+					to_stop_id INT REFERENCES stop(id) ON DELETE CASCADE,
+					started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+					ended_at TIMESTAMP WITH TIME ZONE NOT NULL
+				)`,
+			`CREATE INDEX ON segment_sample(started_at)`,
+			`CREATE INDEX ON segment_sample(ended_at)`,
+			`CREATE INDEX ON shuttle_log(fix_time)`,
+		}),
+		Down: migrate.Queries([]string{
+			`DROP TABLE IF EXISTS segment_sample`,
+			`DROP INDEX IF EXISTS shuttle_log_fix_time_idx`,
+		}),
+	},
 }
@@ -3,17 +3,40 @@ package database
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 // MockDatabase for testing
 type MockDatabase struct {
 	sync.Mutex
 
-	LogTabel    []ShuttleLog           // ( mock main database table)
-	LatestTabel map[string]*ShuttleLog // contains reference to logtabel ( mock foreign key )
-	RouteTabel  map[string]*ClosedRoute
-	RouteID     int
+	LogTabel     []ShuttleLog           // ( mock main database table)
+	LatestTabel  map[string]*ShuttleLog // contains reference to logtabel ( mock foreign key )
+	RouteTabel   map[string]*ClosedRoute
+	RouteID      int
+	Quarantine   []*QuarantinedLog
+	LeaseTabel   map[string]Lease
+	Subscribers  []func(Notification)
+	VehicleTabel map[string]*Vehicle
+	Assignments  []*RouteAssignment
+	StopTabel    map[string]*Stop
+	StopEvents   []*StopEvent
+	SegmentTimes []*SegmentTime
+	Calendars    map[string]*ServiceCalendar
+	Trips        map[string][]*Trip // route name -> trips
+	Headways     []*HeadwayAlert
+	Detours      []*Detour
+	States       []*VehicleState
+	Alerts       map[int64]*ServiceAlert
+	AlertID      int64
+	OffRoutes    []*OffRouteEvent
+
+	// travels between the stops, aggregated into SegmentTimes
+	SegmentSamples []*SegmentSample
+
+	pending []Notification // notifications sent once the lock is released
 }
 
 func (db *MockDatabase) Open() {
@@ -21,16 +44,61 @@ func (db *MockDatabase) Open() {
 	defer db.Unlock()
 	db.LogTabel = make([]ShuttleLog, 100)
 	db.LatestTabel = make(map[string]*ShuttleLog)
+	db.RouteTabel = make(map[string]*ClosedRoute)
 	db.RouteID = 0
 }
 
 func (db *MockDatabase) InsertShuttleLog(log *ShuttleLog) error {
 	db.Lock()
-	defer db.Unlock()
+	defer db.unlock()
 	fmt.Printf("Insert shuttle log %#v\n", log)
+	log.ID = int64(len(db.LogTabel) + 1)
 	db.LogTabel = append(db.LogTabel, *log)
 	db.LatestTabel[log.VehicleID] = &db.LogTabel[len(db.LogTabel)-1]
+	db.notify(LogChannel, log.VehicleID)
+	return nil
+}
+
+func (db *MockDatabase) Subscribe(subscriber func(Notification)) {
+	db.Lock()
+	defer db.Unlock()
+	db.Subscribers = append(db.Subscribers, subscriber)
+}
+
+// notify queues a notification, the lock must be held and released with unlock
+func (db *MockDatabase) notify(channel, key string) {
+	db.pending = append(db.pending, Notification{Channel: channel, Key: key, Local: true})
+}
+
+// unlock releases the lock then sends the queued notifications, so that a subscriber can read the database
+func (db *MockDatabase) unlock() {
+	pending := db.pending
+	subscribers := append([]func(Notification){}, db.Subscribers...)
+	db.pending = nil
+	db.Unlock()
+	for _, n := range pending {
+		for _, subscriber := range subscribers {
+			subscriber(n)
+		}
+	}
+}
+
+func (db *MockDatabase) InsertShuttleLogs(logs []*ShuttleLog) ([]error, error) {
+	errs := make([]error, len(logs))
+	for i, log := range logs {
+		errs[i] = db.InsertShuttleLog(log)
+	}
+	return errs, nil
+}
 
+func (db *MockDatabase) ExtendStationary(logs []*ShuttleLog) error {
+	db.Lock()
+	defer db.Unlock()
+	for _, log := range logs {
+		if latest, ok := db.LatestTabel[log.VehicleID]; ok && latest.FixTime.Equal(log.FixTime) {
+			latest.StationaryUntil = log.StationaryUntil
+		}
+	}
 	return nil
 }
 
@@ -38,17 +106,120 @@ func (db *MockDatabase) SelectLatestLog(vid string) (*ShuttleLog, error) {
 	db.Lock()
 	defer db.Unlock()
 	if log, ok := db.LatestTabel[vid]; ok {
-		return log, nil
+		latest := *log
+		return &latest, nil
 	}
 
 	return nil, fmt.Errorf("vehicle key (%s) not found in database\n", vid)
 }
 
+func (db *MockDatabase) InsertQuarantine(q *QuarantinedLog) error {
+	db.Lock()
+	defer db.Unlock()
+	q.CreatedAt = time.Now()
+	db.Quarantine = append(db.Quarantine, q)
+	q.ID = int64(len(db.Quarantine))
+	return nil
+}
+
+func (db *MockDatabase) SelectQuarantine(from, to time.Time) ([]*QuarantinedLog, error) {
+	db.Lock()
+	defer db.Unlock()
+	r := []*QuarantinedLog{}
+	for _, q := range db.Quarantine {
+		if !q.CreatedAt.Before(from) && q.CreatedAt.Before(to) {
+			r = append(r, q)
+		}
+	}
+	return r, nil
+}
+
+func (db *MockDatabase) AcquireLease(lease *Lease) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.LeaseTabel == nil {
+		db.LeaseTabel = make(map[string]Lease)
+	}
+	now := time.Now()
+	current, ok := db.LeaseTabel[lease.Name]
+	if ok && current.Holder != lease.Holder && current.ExpiresAt.After(now) {
+		return false, nil
+	}
+	lease.AcquiredAt = now
+	if ok && current.Holder == lease.Holder {
+		lease.AcquiredAt = current.AcquiredAt
+	}
+	lease.ExpiresAt = now.Add(lease.TTL)
+	db.LeaseTabel[lease.Name] = *lease
+	return true, nil
+}
+
+func (db *MockDatabase) SelectLease(name string) (*Lease, error) {
+	db.Lock()
+	defer db.Unlock()
+	if lease, ok := db.LeaseTabel[name]; ok {
+		return &lease, nil
+	}
+	return nil, nil
+}
+
+func (db *MockDatabase) UpsertVehicle(vehicle *Vehicle) error {
+	db.Lock()
+	defer db.unlock()
+	if db.VehicleTabel == nil {
+		db.VehicleTabel = make(map[string]*Vehicle)
+	}
+	if vehicle.RouteName != "" {
+		if _, ok := db.RouteTabel[vehicle.RouteName]; !ok {
+			return fmt.Errorf("Route '%s' not found", vehicle.RouteName)
+		}
+	}
+	// the state is only changed by the state machine
+	if v, ok := db.VehicleTabel[vehicle.VehicleID]; ok {
+		vehicle.State, vehicle.StateSince = v.State, v.StateSince
+	}
+	db.VehicleTabel[vehicle.VehicleID] = vehicle
+	db.notify(VehicleChannel, vehicle.VehicleID)
+	return nil
+}
+
+func (db *MockDatabase) SelectVehicle(vid string) (*Vehicle, error) {
+	db.Lock()
+	defer db.Unlock()
+	if v, ok := db.VehicleTabel[vid]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("Vehicle '%s' not found", vid)
+}
+
+func (db *MockDatabase) ListVehicles() ([]*Vehicle, error) {
+	db.Lock()
+	defer db.Unlock()
+	vehicles := []*Vehicle{}
+	for _, v := range db.VehicleTabel {
+		vehicles = append(vehicles, v)
+	}
+	return vehicles, nil
+}
+
+func (db *MockDatabase) DeleteVehicle(vid string) error {
+	db.Lock()
+	defer db.unlock()
+	v, ok := db.VehicleTabel[vid]
+	if !ok {
+		return fmt.Errorf("Vehicle '%s' not found", vid)
+	}
+	v.Active = false
+	db.notify(VehicleChannel, vid)
+	return nil
+}
+
 func (db *MockDatabase) InsertClosedRoute(route *ClosedRoute) error {
 	db.Lock()
 	defer db.Unlock()
-	db.RouteTabel[string(db.RouteID)] = route
 	db.RouteID++
+	route.ID = int64(db.RouteID)
+	db.RouteTabel[route.Name] = route
 	return nil
 }
 
@@ -61,6 +232,79 @@ func (db *MockDatabase) SelectClosedRoute(rid string) (*ClosedRoute, error) {
 	return nil, errors.New("route not found")
 }
 
+func (db *MockDatabase) ListClosedRoutes() ([]*ClosedRoute, error) {
+	db.Lock()
+	defer db.Unlock()
+	routes := []*ClosedRoute{}
+	for _, r := range db.RouteTabel {
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (db *MockDatabase) AssignRoute(assignment *RouteAssignment) error {
+	db.Lock()
+	defer db.unlock()
+	if db.VehicleTabel == nil {
+		db.VehicleTabel = make(map[string]*Vehicle)
+	}
+	v, ok := db.VehicleTabel[assignment.VehicleID]
+	if !ok {
+		v = &Vehicle{VehicleID: assignment.VehicleID, Active: true}
+		db.VehicleTabel[assignment.VehicleID] = v
+	}
+	v.RouteName = assignment.RouteName
+	v.RouteConfidence = assignment.Confidence
+	v.RouteAssignedAt = assignment.AssignedAt
+	db.Assignments = append(db.Assignments, assignment)
+	assignment.ID = int64(len(db.Assignments))
+	db.notify(VehicleChannel, assignment.VehicleID)
+	return nil
+}
+
+func (db *MockDatabase) UpdateVehicleState(state *VehicleState) error {
+	db.Lock()
+	defer db.unlock()
+	if db.VehicleTabel == nil {
+		db.VehicleTabel = make(map[string]*Vehicle)
+	}
+	v, ok := db.VehicleTabel[state.VehicleID]
+	if !ok {
+		v = &Vehicle{VehicleID: state.VehicleID, Active: true}
+		db.VehicleTabel[state.VehicleID] = v
+	}
+	v.State = state.State
+	v.StateSince = state.At
+	db.States = append(db.States, state)
+	state.ID = int64(len(db.States))
+	db.notify(VehicleChannel, state.VehicleID)
+	return nil
+}
+
+func (db *MockDatabase) SelectVehicleStates(vid string, from, to time.Time) ([]*VehicleState, error) {
+	db.Lock()
+	defer db.Unlock()
+	states := []*VehicleState{}
+	for _, s := range db.States {
+		if s.VehicleID == vid && !s.At.Before(from) && s.At.Before(to) {
+			states = append(states, s)
+		}
+	}
+	return states, nil
+}
+
+func (db *MockDatabase) SelectRouteAssignments(vid string, from, to time.Time) ([]*RouteAssignment, error) {
+	db.Lock()
+	defer db.Unlock()
+	assignments := []*RouteAssignment{}
+	for _, a := range db.Assignments {
+		if a.VehicleID == vid && !a.AssignedAt.Before(from) && a.AssignedAt.Before(to) {
+			assignments = append(assignments, a)
+		}
+	}
+	return assignments, nil
+}
+
 func (db *MockDatabase) Close() {
 	db.Lock()
 	defer db.Unlock()
@@ -71,19 +315,423 @@ func (db *MockDatabase) Close() {
 }
 
 // Insert a stop to database
-func (db *MockDatabase) InsertStop(*Stop) error {
-	panic("The thing is not implemented ")
+func (db *MockDatabase) InsertStop(stop *Stop) error {
+	db.Lock()
+	defer db.unlock()
+	if stop.Route == nil || stop.Location == nil {
+		return fmt.Errorf("Stop '%s' requires a route and a location", stop.StopID)
+	}
+	if _, ok := db.RouteTabel[stop.Route.Name]; !ok {
+		return fmt.Errorf("Route '%s' not found", stop.Route.Name)
+	}
+	if db.StopTabel == nil {
+		db.StopTabel = make(map[string]*Stop)
+	}
+	db.StopTabel[stop.StopID] = stop
+	stop.ID = int64(len(db.StopTabel))
+	db.notify(StopChannel, stop.Route.Name)
 	return nil
 }
 
-// Select a stop from database by stop name
-func (db *MockDatabase) SelectStop(string) (*Stop, error) {
-	panic("The thing is not implemented ")
-	return nil, nil
+// Select a stop from database by its remote id
+func (db *MockDatabase) SelectStop(sid string) (*Stop, error) {
+	db.Lock()
+	defer db.Unlock()
+	if s, ok := db.StopTabel[sid]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("Stop '%s' not found", sid)
 }
 
 // Select all stops on a route by route name
-func (db *MockDatabase) SelectStopOnRoute(string) ([]*Stop, error) {
-	panic("The thing is not implemented ")
-	return nil, nil
+func (db *MockDatabase) SelectStopOnRoute(rid string) ([]*Stop, error) {
+	db.Lock()
+	defer db.Unlock()
+	stops := []*Stop{}
+	for _, s := range db.StopTabel {
+		if s.Route.Name == rid {
+			stops = append(stops, s)
+		}
+	}
+	return stops, nil
+}
+
+func (db *MockDatabase) InsertStopEvent(event *StopEvent) error {
+	db.Lock()
+	defer db.unlock()
+	if _, ok := db.StopTabel[event.StopID]; !ok {
+		return fmt.Errorf("Stop '%s' not found", event.StopID)
+	}
+	db.StopEvents = append(db.StopEvents, event)
+	event.ID = int64(len(db.StopEvents))
+	db.notify(StopEventChannel, fmt.Sprint(event.ID))
+	return nil
+}
+
+func (db *MockDatabase) UpdateStopEvent(event *StopEvent) error {
+	db.Lock()
+	defer db.unlock()
+	db.notify(StopEventChannel, fmt.Sprint(event.ID))
+	return nil
+}
+
+func (db *MockDatabase) RecordStopEvents(departure *StopEvent, arrivals []*StopEvent) error {
+	db.Lock()
+	defer db.unlock()
+	for _, event := range arrivals {
+		if _, ok := db.StopTabel[event.StopID]; !ok {
+			return fmt.Errorf("Stop '%s' not found", event.StopID)
+		}
+	}
+	if departure != nil {
+		db.notify(StopEventChannel, fmt.Sprint(departure.ID))
+	}
+	for _, event := range arrivals {
+		db.StopEvents = append(db.StopEvents, event)
+		event.ID = int64(len(db.StopEvents))
+		db.notify(StopEventChannel, fmt.Sprint(event.ID))
+	}
+	return nil
+}
+
+func (db *MockDatabase) SelectStopEvents(sid string, from, to time.Time) ([]*StopEvent, error) {
+	db.Lock()
+	defer db.Unlock()
+	events := []*StopEvent{}
+	for _, e := range db.StopEvents {
+		if e.StopID == sid && !e.ArrivedAt.Before(from) && e.ArrivedAt.Before(to) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (db *MockDatabase) SelectStopEvent(id int64) (*StopEvent, error) {
+	db.Lock()
+	defer db.Unlock()
+	for _, e := range db.StopEvents {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("Stop event %d not found", id)
+}
+
+func (db *MockDatabase) SelectRouteLogs(from, to time.Time) ([]*ShuttleLog, error) {
+	db.Lock()
+	defer db.Unlock()
+	logs := []*ShuttleLog{}
+	for i := range db.LogTabel {
+		log := db.LogTabel[i]
+		if log.RouteName != "" && !log.FixTime.Before(from) && log.FixTime.Before(to) {
+			logs = append(logs, &log)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].FixTime.Before(logs[j].FixTime) })
+	return logs, nil
+}
+
+func (db *MockDatabase) InsertSegmentSamples(samples []*SegmentSample) error {
+	db.Lock()
+	defer db.Unlock()
+	db.SegmentSamples = append(db.SegmentSamples, samples...)
+	return nil
+}
+
+func (db *MockDatabase) SelectLatestSegmentSample() (time.Time, error) {
+	db.Lock()
+	defer db.Unlock()
+	latest := time.Time{}
+	for _, s := range db.SegmentSamples {
+		if s.EndedAt.After(latest) {
+			latest = s.EndedAt
+		}
+	}
+	return latest, nil
+}
+
+func (db *MockDatabase) UpdateSegmentTimes(from time.Time, location *time.Location) error {
+	db.Lock()
+	defer db.Unlock()
+	kept := []*SegmentSample{}
+	samples := map[SegmentTime][]time.Duration{}
+	for _, s := range db.SegmentSamples {
+		if s.StartedAt.Before(from) {
+			continue
+		}
+		kept = append(kept, s)
+		at := s.StartedAt.In(location)
+		key := SegmentTime{RouteName: s.RouteName, FromStop: s.FromStop, ToStop: s.ToStop, Weekday: at.Weekday(), Hour: at.Hour()}
+		samples[key] = append(samples[key], s.EndedAt.Sub(s.StartedAt))
+	}
+	db.SegmentSamples = kept
+	db.SegmentTimes = []*SegmentTime{}
+	for key, travels := range samples {
+		sort.Slice(travels, func(i, j int) bool { return travels[i] < travels[j] })
+		t := key
+		t.TravelTime = travels[len(travels)/2]
+		if len(travels)%2 == 0 {
+			t.TravelTime = (travels[len(travels)/2-1] + travels[len(travels)/2]) / 2
+		}
+		t.Samples = len(travels)
+		t.UpdatedAt = time.Now()
+		db.SegmentTimes = append(db.SegmentTimes, &t)
+	}
+	return nil
+}
+
+func (db *MockDatabase) SelectSegmentTimes(rid string) ([]*SegmentTime, error) {
+	db.Lock()
+	defer db.Unlock()
+	times := []*SegmentTime{}
+	for _, t := range db.SegmentTimes {
+		if t.RouteName == rid {
+			times = append(times, t)
+		}
+	}
+	return times, nil
+}
+
+func (db *MockDatabase) UpsertCalendar(calendar *ServiceCalendar) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.Calendars == nil {
+		db.Calendars = make(map[string]*ServiceCalendar)
+	}
+	db.Calendars[calendar.ServiceID] = calendar
+	calendar.ID = int64(len(db.Calendars))
+	return nil
+}
+
+func (db *MockDatabase) SelectCalendar(sid string) (*ServiceCalendar, error) {
+	db.Lock()
+	defer db.Unlock()
+	if c, ok := db.Calendars[sid]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("Service '%s' not found", sid)
+}
+
+func (db *MockDatabase) InsertTrips(rid string, trips []*Trip) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.RouteTabel[rid]; !ok {
+		return fmt.Errorf("Route '%s' not found", rid)
+	}
+	for _, trip := range trips {
+		if _, ok := db.Calendars[trip.ServiceID]; !ok {
+			return fmt.Errorf("Service '%s' not found", trip.ServiceID)
+		}
+		for _, st := range trip.StopTimes {
+			if _, ok := db.StopTabel[st.StopID]; !ok {
+				return fmt.Errorf("Trip '%s' has unknown stops", trip.TripID)
+			}
+		}
+		trip.RouteName = rid
+	}
+	if db.Trips == nil {
+		db.Trips = make(map[string][]*Trip)
+	}
+	db.Trips[rid] = trips
+	return nil
+}
+
+func (db *MockDatabase) SelectTrips(rid string) ([]*Trip, error) {
+	db.Lock()
+	defer db.Unlock()
+	trips := []*Trip{}
+	return append(trips, db.Trips[rid]...), nil
+}
+
+func (db *MockDatabase) SelectAdherence(rid string, from, to time.Time, tolerance *AdherenceTolerance) ([]*Adherence, error) {
+	db.Lock()
+	defer db.Unlock()
+	buckets := map[Adherence]*Adherence{}
+	adherence := []*Adherence{}
+	for _, e := range db.StopEvents {
+		if e.TripID == "" || (rid != "" && e.RouteName != rid) || e.ScheduledAt.Before(from) || !e.ScheduledAt.Before(to) {
+			continue
+		}
+		key := Adherence{RouteName: e.RouteName, StopID: e.StopID, Hour: e.ScheduledAt.In(tolerance.Location).Hour()}
+		a, ok := buckets[key]
+		if !ok {
+			a = &Adherence{RouteName: key.RouteName, StopID: key.StopID, Hour: key.Hour}
+			buckets[key] = a
+			adherence = append(adherence, a)
+		}
+		// the deviations are summed then divided by the arrivals
+		a.MeanDeviation += e.Deviation
+		a.Arrivals++
+		if e.Deviation < -tolerance.Early {
+			a.Early++
+		} else if e.Deviation > tolerance.Late {
+			a.Late++
+		}
+	}
+	for _, a := range adherence {
+		a.MeanDeviation /= time.Duration(a.Arrivals)
+	}
+	return adherence, nil
+}
+
+func (db *MockDatabase) InsertHeadwayAlert(alert *HeadwayAlert) error {
+	db.Lock()
+	defer db.unlock()
+	db.Headways = append(db.Headways, alert)
+	alert.ID = int64(len(db.Headways))
+	db.notify(HeadwayChannel, alert.RouteName)
+	return nil
+}
+
+func (db *MockDatabase) ResolveHeadwayAlert(alert *HeadwayAlert) error {
+	db.Lock()
+	defer db.unlock()
+	db.notify(HeadwayChannel, alert.RouteName)
+	return nil
+}
+
+func (db *MockDatabase) SelectHeadwayAlerts(rid string, from, to time.Time) ([]*HeadwayAlert, error) {
+	db.Lock()
+	defer db.Unlock()
+	alerts := []*HeadwayAlert{}
+	for _, a := range db.Headways {
+		if a.RouteName == rid && ((!a.RaisedAt.Before(from) && a.RaisedAt.Before(to)) || a.ResolvedAt.IsZero()) {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts, nil
+}
+
+func (db *MockDatabase) SelectOpenHeadwayAlerts() ([]*HeadwayAlert, error) {
+	db.Lock()
+	defer db.Unlock()
+	alerts := []*HeadwayAlert{}
+	for _, a := range db.Headways {
+		if a.ResolvedAt.IsZero() {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts, nil
+}
+
+func (db *MockDatabase) InsertDetour(detour *Detour) error {
+	db.Lock()
+	defer db.unlock()
+	if _, ok := db.RouteTabel[detour.RouteName]; !ok {
+		return fmt.Errorf("Route '%s' not found", detour.RouteName)
+	}
+	db.Detours = append(db.Detours, detour)
+	detour.ID = int64(len(db.Detours))
+	db.notify(RouteChannel, detour.RouteName)
+	return nil
+}
+
+func (db *MockDatabase) DeleteDetour(id int64) error {
+	db.Lock()
+	defer db.unlock()
+	for i, d := range db.Detours {
+		if d.ID == id {
+			db.Detours = append(db.Detours[:i], db.Detours[i+1:]...)
+			db.notify(RouteChannel, d.RouteName)
+			return nil
+		}
+	}
+	return fmt.Errorf("Detour %d not found", id)
+}
+
+func (db *MockDatabase) SelectDetours(rid string, from, to time.Time) ([]*Detour, error) {
+	db.Lock()
+	defer db.Unlock()
+	detours := []*Detour{}
+	for _, d := range db.Detours {
+		if (rid == "" || d.RouteName == rid) && !d.StartsAt.After(to) && d.EndsAt.After(from) {
+			detours = append(detours, d)
+		}
+	}
+	return detours, nil
+}
+
+func (db *MockDatabase) InsertOffRouteEvent(event *OffRouteEvent) error {
+	db.Lock()
+	defer db.unlock()
+	db.OffRoutes = append(db.OffRoutes, event)
+	event.ID = int64(len(db.OffRoutes))
+	db.notify(OffRouteChannel, event.RouteName)
+	return nil
+}
+
+func (db *MockDatabase) UpdateOffRouteEvent(event *OffRouteEvent) error {
+	db.Lock()
+	defer db.unlock()
+	db.notify(OffRouteChannel, event.RouteName)
+	return nil
+}
+
+func (db *MockDatabase) SelectOffRouteEvents(rid string, from, to time.Time) ([]*OffRouteEvent, error) {
+	db.Lock()
+	defer db.Unlock()
+	events := []*OffRouteEvent{}
+	for _, e := range db.OffRoutes {
+		if e.RouteName == rid && ((!e.StartedAt.Before(from) && e.StartedAt.Before(to)) || e.EndedAt.IsZero()) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (db *MockDatabase) InsertServiceAlert(alert *ServiceAlert) error {
+	db.Lock()
+	defer db.unlock()
+	if db.Alerts == nil {
+		db.Alerts = make(map[int64]*ServiceAlert)
+	}
+	db.AlertID++
+	alert.ID = db.AlertID
+	db.Alerts[alert.ID] = alert
+	db.notify(AlertChannel, fmt.Sprint(alert.ID))
+	return nil
+}
+
+func (db *MockDatabase) UpdateServiceAlert(alert *ServiceAlert) error {
+	db.Lock()
+	defer db.unlock()
+	if _, ok := db.Alerts[alert.ID]; !ok {
+		return fmt.Errorf("Alert %d not found", alert.ID)
+	}
+	db.Alerts[alert.ID] = alert
+	db.notify(AlertChannel, fmt.Sprint(alert.ID))
+	return nil
+}
+
+func (db *MockDatabase) DeleteServiceAlert(id int64) error {
+	db.Lock()
+	defer db.unlock()
+	if _, ok := db.Alerts[id]; !ok {
+		return fmt.Errorf("Alert %d not found", id)
+	}
+	delete(db.Alerts, id)
+	db.notify(AlertChannel, fmt.Sprint(id))
+	return nil
+}
+
+func (db *MockDatabase) SelectServiceAlert(id int64) (*ServiceAlert, error) {
+	db.Lock()
+	defer db.Unlock()
+	if a, ok := db.Alerts[id]; ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("Alert %d not found", id)
+}
+
+func (db *MockDatabase) SelectServiceAlerts(at time.Time) ([]*ServiceAlert, error) {
+	db.Lock()
+	defer db.Unlock()
+	alerts := []*ServiceAlert{}
+	for _, a := range db.Alerts {
+		if at.IsZero() || a.ActiveAt(at) {
+			alerts = append(alerts, a)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].ID < alerts[j].ID })
+	return alerts, nil
 }
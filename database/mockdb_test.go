@@ -0,0 +1,27 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMockDatabaseNotifyOutsideLock(t *testing.T) {
+	db := &MockDatabase{}
+	db.Open()
+	read := make(chan *ShuttleLog, 1)
+	db.Subscribe(func(n Notification) {
+		// a subscriber reading the database must not deadlock
+		if log, err := db.SelectLatestLog(n.Key); err == nil {
+			read <- log
+		}
+	})
+	go db.InsertShuttleLog(&ShuttleLog{VehicleID: "1", Location: &Vector{}})
+	select {
+	case log := <-read:
+		if log.VehicleID != "1" {
+			t.Fatalf("expected vehicle 1, got %s", log.VehicleID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscriber deadlocked")
+	}
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// LogChannel notifies a new or updated shuttle log, keyed by vehicle id
+	LogChannel = "yast_log"
+	// RouteChannel notifies a new or updated route, keyed by route name
+	RouteChannel = "yast_route"
+	// VehicleChannel notifies a new, updated or deleted vehicle, keyed by vehicle id
+	VehicleChannel = "yast_vehicle"
+	// StopChannel notifies a new or moved stop, keyed by route name
+	StopChannel = "yast_stop"
+	// StopEventChannel notifies an arrival or a departure at a stop, keyed by stop event id
+	StopEventChannel = "yast_stop_event"
+	// HeadwayChannel notifies a raised or resolved headway alert, keyed by route name
+	HeadwayChannel = "yast_headway"
+	// OffRouteChannel notifies a vehicle leaving or getting back to its route, keyed by route name
+	OffRouteChannel = "yast_off_route"
+	// AlertChannel notifies a new, updated or deleted service alert, keyed by alert id
+	AlertChannel = "yast_alert"
+)
+
+var channels = []string{LogChannel, RouteChannel, VehicleChannel, StopChannel, StopEventChannel, HeadwayChannel, OffRouteChannel, AlertChannel}
+
+// notifyPayload is sent with the notifications, the origin identifies the instance which made the change
+type notifyPayload struct {
+	Origin string `json:"origin"`
+	Key    string `json:"key"`
+}
+
+// Subscribe registers a function called on every change made by any instance, including this one
+func (pg *PgSQL) Subscribe(subscriber func(Notification)) {
+	pg.subscribersLock.Lock()
+	defer pg.subscribersLock.Unlock()
+	pg.subscribers = append(pg.subscribers, subscriber)
+}
+
+// notify the changed keys to all the instances when the transaction commits
+func (pg *PgSQL) notify(tx *sql.Tx, channel string, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	payloads := make([]string, len(keys))
+	for i, key := range keys {
+		payload, err := json.Marshal(notifyPayload{pg.origin, key})
+		if err != nil {
+			return err
+		}
+		payloads[i] = string(payload)
+	}
+	_, err := tx.Exec(notifyChange, channel, pq.Array(payloads))
+	return err
+}
+
+// listen to the notifications of all the instances to keep the caches coherent
+func (pg *PgSQL) listen() {
+	origin := make([]byte, 8)
+	if _, err := rand.Read(origin); err != nil {
+		panic("Failed to generate the notification origin")
+	}
+	pg.origin = hex.EncodeToString(origin)
+	pg.listener = pq.NewListener(pg.URL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			fmt.Printf("Database listener: %s\n", err.Error())
+		}
+	})
+	for _, channel := range channels {
+		if err := pg.listener.Listen(channel); err != nil {
+			panic("Failed to listen to " + channel)
+		}
+	}
+	go pg.handleNotifications(pg.listener)
+}
+
+func (pg *PgSQL) handleNotifications(listener *pq.Listener) {
+	for n := range listener.Notify {
+		if n == nil {
+			// the connection was reestablished, notifications may have been missed
+			pg.clearCaches()
+			continue
+		}
+		payload := notifyPayload{}
+		if err := json.Unmarshal([]byte(n.Extra), &payload); err != nil {
+			fmt.Printf("Invalid notification on %s: %s\n", n.Channel, err.Error())
+			continue
+		}
+		if payload.Origin != pg.origin {
+			pg.refreshCache(n.Channel, payload.Key)
+		}
+		pg.subscribersLock.RLock()
+		for _, subscriber := range pg.subscribers {
+			subscriber(Notification{Channel: n.Channel, Key: payload.Key, Local: payload.Origin == pg.origin})
+		}
+		pg.subscribersLock.RUnlock()
+	}
+}
+
+// refreshCache updates the cached record changed by another instance
+func (pg *PgSQL) refreshCache(channel, key string) {
+	switch channel {
+	case LogChannel:
+		log, err := pg.selectLatestLog(key)
+		if err != nil {
+			fmt.Printf("Unable to refresh shuttle log of vehicle %s: %s\n", key, err.Error())
+			pg.cacheLock.Lock()
+			delete(pg.CachedLatestLog, key)
+			pg.cacheLock.Unlock()
+			return
+		}
+		pg.cacheLock.Lock()
+		pg.cacheLatestLog(log)
+		pg.cacheLock.Unlock()
+	case RouteChannel:
+		// reloaded on the next request
+		pg.cacheLock.Lock()
+		delete(pg.CachedRoute, key)
+		pg.cacheLock.Unlock()
+	case VehicleChannel:
+		pg.cacheLock.Lock()
+		delete(pg.CachedVehicle, key)
+		pg.cacheLock.Unlock()
+	}
+}
+
+func (pg *PgSQL) clearCaches() {
+	pg.cacheLock.Lock()
+	defer pg.cacheLock.Unlock()
+	pg.CachedLatestLog = make(map[string]*ShuttleLog)
+	pg.CachedRoute = make(map[string]*ClosedRoute)
+	pg.CachedVehicle = make(map[string]*Vehicle)
+}
@@ -3,8 +3,12 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/remind101/migrate"
 )
 
@@ -13,8 +17,15 @@ import (
 type PgSQL struct {
 	URL             string
 	DB              *sql.DB
-	CachedLatestLog map[string]*ShuttleLog  // vehicle id -> shuttle log
+	CachedLatestLog map[string]*ShuttleLog  // vehicle id -> copy of the shuttle log, never handed out
 	CachedRoute     map[string]*ClosedRoute // route id -> closed route
+	CachedVehicle   map[string]*Vehicle     // vehicle id -> vehicle
+	cacheLock       sync.RWMutex
+
+	listener        *pq.Listener
+	origin          string // identifies the notifications sent by this instance
+	subscribers     []func(Notification)
+	subscribersLock sync.RWMutex
 }
 
 // Open the database connection and initialize caches
@@ -30,8 +41,12 @@ func (pg *PgSQL) Open() {
 		panic("Data migration failed\n")
 	}
 	fmt.Printf("Finished database migration\n")
+	pg.cacheLock.Lock()
 	pg.CachedLatestLog = make(map[string]*ShuttleLog)
 	pg.CachedRoute = make(map[string]*ClosedRoute)
+	pg.CachedVehicle = make(map[string]*Vehicle)
+	pg.cacheLock.Unlock()
+	pg.listen()
 }
 
 // ListClosedRouteName gives a list of route names
@@ -57,6 +72,226 @@ func (pg *PgSQL) ListClosedRouteName() ([]string, error) {
 	return r, nil
 }
 
+// UpsertVehicle inserts the vehicle or updates the vehicle with the same remote id
+func (pg *PgSQL) UpsertVehicle(vehicle *Vehicle) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	if vehicle.RouteName != "" {
+		var routeID int64
+		err = tx.QueryRow(selectRouteMeta, vehicle.RouteName).Scan(&routeID)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			return fmt.Errorf("Route '%s' not found", vehicle.RouteName)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.QueryRow(upsertVehicle, vehicle.VehicleID, nullString(vehicle.Name), vehicle.Capacity, pq.Array(vehicle.Accessibility),
+		nullString(vehicle.Plate), vehicle.Active, vehicle.RouteName).Scan(&vehicle.ID)
+	if err == nil {
+		err = pg.notify(tx, VehicleChannel, vehicle.VehicleID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	pg.cacheLock.Lock()
+	delete(pg.CachedVehicle, vehicle.VehicleID)
+	pg.cacheLock.Unlock()
+	return nil
+}
+
+// SelectVehicle selects a vehicle by its remote id from cache first, if it's missing, select from the database
+func (pg *PgSQL) SelectVehicle(vehicleID string) (*Vehicle, error) {
+	pg.cacheLock.RLock()
+	v, ok := pg.CachedVehicle[vehicleID]
+	pg.cacheLock.RUnlock()
+	if ok {
+		return v, nil
+	}
+	rows, err := pg.DB.Query(selectVehicle, vehicleID)
+	if err != nil {
+		return nil, err
+	}
+	vehicles, err := scanVehicles(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(vehicles) == 0 {
+		return nil, fmt.Errorf("Vehicle '%s' not found", vehicleID)
+	}
+	pg.cacheLock.Lock()
+	pg.CachedVehicle[vehicleID] = vehicles[0]
+	pg.cacheLock.Unlock()
+	return vehicles[0], nil
+}
+
+// ListVehicles selects all the vehicles
+func (pg *PgSQL) ListVehicles() ([]*Vehicle, error) {
+	rows, err := pg.DB.Query(selectVehicles)
+	if err != nil {
+		return nil, err
+	}
+	return scanVehicles(rows)
+}
+
+// DeleteVehicle retires a vehicle by its remote id. The row is kept inactive, deleting it would detach
+// its logs and the next log of the vehicle would register it again.
+func (pg *PgSQL) DeleteVehicle(vehicleID string) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	res, err := tx.Exec(deleteVehicle, vehicleID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("Vehicle '%s' not found", vehicleID)
+	}
+	if err = pg.notify(tx, VehicleChannel, vehicleID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	pg.cacheLock.Lock()
+	delete(pg.CachedVehicle, vehicleID)
+	pg.cacheLock.Unlock()
+	return nil
+}
+
+func scanVehicles(rows *sql.Rows) ([]*Vehicle, error) {
+	defer rows.Close()
+	vehicles := []*Vehicle{}
+	for rows.Next() {
+		v := &Vehicle{}
+		var (
+			name, plate, route sql.NullString
+			capacity           sql.NullInt64
+			accessibility      pq.StringArray
+			confidence         sql.NullFloat64
+			assignedAt         pq.NullTime
+			stateSince         pq.NullTime
+		)
+		err := rows.Scan(&v.ID, &v.VehicleID, &name, &capacity, &accessibility, &plate, &v.Active, &route, &confidence, &assignedAt,
+			&v.State, &stateSince)
+		if err != nil {
+			return nil, err
+		}
+		v.Name = name.String
+		v.Capacity = int(capacity.Int64)
+		v.Accessibility = []string(accessibility)
+		v.Plate = plate.String
+		v.RouteName = route.String
+		v.RouteConfidence = confidence.Float64
+		v.RouteAssignedAt = assignedAt.Time
+		v.StateSince = stateSince.Time
+		vehicles = append(vehicles, v)
+	}
+	return vehicles, rows.Err()
+}
+
+// AssignRoute assigns the route to the vehicle and records the assignment in its history
+func (pg *PgSQL) AssignRoute(assignment *RouteAssignment) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	var metaID int64
+	err = tx.QueryRow(soiShuttleMeta, assignment.VehicleID, nil).Scan(&metaID)
+	if err == nil {
+		_, err = tx.Exec(updateShuttleRoute, metaID, assignment.RouteName, assignment.Confidence, assignment.AssignedAt)
+	}
+	if err == nil {
+		err = tx.QueryRow(insertRouteAssignment, metaID, assignment.RouteName, assignment.Confidence, assignment.AssignedAt).Scan(&assignment.ID)
+	}
+	if err == nil {
+		err = pg.notify(tx, VehicleChannel, assignment.VehicleID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	pg.cacheLock.Lock()
+	delete(pg.CachedVehicle, assignment.VehicleID)
+	pg.cacheLock.Unlock()
+	return nil
+}
+
+// UpdateVehicleState changes the state of the vehicle and records the transition
+func (pg *PgSQL) UpdateVehicleState(state *VehicleState) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	var metaID int64
+	err = tx.QueryRow(soiShuttleMeta, state.VehicleID, nil).Scan(&metaID)
+	if err == nil {
+		_, err = tx.Exec(updateShuttleState, metaID, state.State, state.At)
+	}
+	if err == nil {
+		err = tx.QueryRow(insertStateTransition, metaID, state.Previous, state.State, state.At).Scan(&state.ID)
+	}
+	if err == nil {
+		err = pg.notify(tx, VehicleChannel, state.VehicleID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	pg.cacheLock.Lock()
+	delete(pg.CachedVehicle, state.VehicleID)
+	pg.cacheLock.Unlock()
+	return nil
+}
+
+// SelectVehicleStates selects the state transitions of the vehicle made in [from, to)
+func (pg *PgSQL) SelectVehicleStates(vehicleID string, from, to time.Time) ([]*VehicleState, error) {
+	rows, err := pg.DB.Query(selectStateTransitions, vehicleID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	states := []*VehicleState{}
+	for rows.Next() {
+		s := &VehicleState{VehicleID: vehicleID}
+		if err = rows.Scan(&s.ID, &s.Previous, &s.State, &s.At); err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	return states, rows.Err()
+}
+
+// SelectRouteAssignments selects the route assignments of the vehicle made in [from, to)
+func (pg *PgSQL) SelectRouteAssignments(vehicleID string, from, to time.Time) ([]*RouteAssignment, error) {
+	rows, err := pg.DB.Query(selectRouteAssignments, vehicleID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	assignments := []*RouteAssignment{}
+	for rows.Next() {
+		a := &RouteAssignment{VehicleID: vehicleID}
+		route := sql.NullString{}
+		if err = rows.Scan(&a.ID, &route, &a.Confidence, &a.AssignedAt); err != nil {
+			return nil, err
+		}
+		a.RouteName = route.String
+		assignments = append(assignments, a)
+	}
+	return assignments, rows.Err()
+}
+
 // InsertClosedRoute inserts route into database and return the route with database ID and error
 func (pg *PgSQL) InsertClosedRoute(route *ClosedRoute) error {
 	tx, err := pg.DB.Begin()
@@ -85,13 +320,22 @@ func (pg *PgSQL) InsertClosedRoute(route *ClosedRoute) error {
 			return err
 		}
 	}
+	// notified on commit
+	err = pg.notify(tx, RouteChannel, route.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	return nil
 }
 
 // SelectClosedRoute selects route by its external routeName from cache first, if it's missing, select from the database
 func (pg *PgSQL) SelectClosedRoute(routeName string) (*ClosedRoute, error) {
 	// if a shuttle id is missing in the cache, then query the database
-	if r, ok := pg.CachedRoute[routeName]; ok {
+	pg.cacheLock.RLock()
+	r, ok := pg.CachedRoute[routeName]
+	pg.cacheLock.RUnlock()
+	if ok {
 		return r, nil
 	}
 	// query database
@@ -121,102 +365,1350 @@ func (pg *PgSQL) SelectClosedRoute(routeName string) (*ClosedRoute, error) {
 		vectors = append(vectors, v)
 	}
 	route.RoutePoints = vectors
+	pg.cacheLock.Lock()
 	pg.CachedRoute[routeName] = route
+	pg.cacheLock.Unlock()
 	return route, nil
 }
 
-func (pg *PgSQL) InsertStop(stop *Stop) error {
-	panic("shit")
-}
-
-func (pg *PgSQL) SelectStop(stopId string) (*Stop, error) {
-	panic("shit")
-}
-
-func (pg *PgSQL) SelectStopOnRoute(stopId string) ([]*Stop, error) {
-	panic("shit")
+// ListClosedRoutes selects all the routes
+func (pg *PgSQL) ListClosedRoutes() ([]*ClosedRoute, error) {
+	names, err := pg.ListClosedRouteName()
+	if err != nil {
+		return nil, err
+	}
+	routes := []*ClosedRoute{}
+	for _, name := range names {
+		route, err := pg.SelectClosedRoute(name)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
 }
 
-// InsertShuttleLog to database
-func (pg *PgSQL) InsertShuttleLog(log *ShuttleLog) error {
+// InsertStop inserts the stop on its route, or moves the stop with the same remote id
+func (pg *PgSQL) InsertStop(stop *Stop) error {
+	if stop.Route == nil || stop.Location == nil {
+		return fmt.Errorf("Stop '%s' requires a route and a location", stop.StopID)
+	}
 	tx, err := pg.DB.Begin()
-
 	if err != nil {
 		return err
 	}
 	defer tx.Commit()
-	err = tx.QueryRow(insertMapPoint, log.Location.X, log.Location.Y, log.Location.Angle, log.Location.Speed).Scan(&log.Location.ID)
+	var routeID int64
+	err = tx.QueryRow(selectRouteMeta, stop.Route.Name).Scan(&routeID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("Route '%s' not found", stop.Route.Name)
+	}
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	var (
-		shuttle_meta_id sql.NullInt64
-		shuttleName     sql.NullString
-	)
-	err = shuttleName.Scan(log.Name)
+	v := stop.Location
+	err = tx.QueryRow(insertMapPoint, v.X, v.Y, v.Angle, v.Speed).Scan(&v.ID)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	err = tx.QueryRow(soiShuttleMeta, log.VehicleID, shuttleName).Scan(&shuttle_meta_id)
+	var metaID int64
+	err = tx.QueryRow(upsertStopMeta, stop.StopID, nullString(stop.Name)).Scan(&metaID)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-
-	_, err = tx.Exec(insertShuttleLog, log.Location.ID, shuttle_meta_id)
+	err = tx.QueryRow(upsertStop, stop.Route.Name, v.ID, metaID).Scan(&stop.ID)
+	if err == nil {
+		err = pg.notify(tx, StopChannel, stop.Route.Name)
+	}
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	pg.CachedLatestLog[log.VehicleID] = log
 	return nil
 }
 
-// SelectShuttleLog selects all shuttle logs of a shuttle specified by its remote id
-func (pg *PgSQL) SelectShuttleLog(remoteShuttleID string) ([]*ShuttleLog, error) {
-	var logs []*ShuttleLog
-	v := &Vector{}
-	s := &ShuttleLog{Location: v}
-	tx, err := pg.DB.Begin()
-
+// SelectStop selects a stop by its remote id
+func (pg *PgSQL) SelectStop(stopID string) (*Stop, error) {
+	rows, err := pg.DB.Query(selectStop, stopID)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Commit()
+	stops, err := scanStops(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(stops) == 0 {
+		return nil, fmt.Errorf("Stop '%s' not found", stopID)
+	}
+	return stops[0], nil
+}
 
-	rows, err := tx.Query(selectShuttleLog, remoteShuttleID)
+// SelectStopOnRoute selects all the stops of a route by route name
+func (pg *PgSQL) SelectStopOnRoute(routeName string) ([]*Stop, error) {
+	rows, err := pg.DB.Query(selectStopsOnRoute, routeName)
 	if err != nil {
 		return nil, err
 	}
+	return scanStops(rows)
+}
+
+func scanStops(rows *sql.Rows) ([]*Stop, error) {
+	defer rows.Close()
+	stops := []*Stop{}
 	for rows.Next() {
+		v := &Vector{}
+		s := &Stop{Location: v, Route: &ClosedRoute{}}
 		name := sql.NullString{}
-		status := sql.NullString{}
-		rows.Scan(&s.ID, &name, &status, &s.CreatedAt, &v.X, &v.Y, &v.Angle, &v.Speed)
-		if name.Valid {
-			s.Name = name.String
+		err := rows.Scan(&s.ID, &s.StopID, &name, &s.Route.Name, &v.X, &v.Y, &v.Angle, &v.Speed)
+		if err != nil {
+			return nil, err
 		}
-		if status.Valid {
-			s.Status = status.String
+		s.Name = name.String
+		stops = append(stops, s)
+	}
+	return stops, rows.Err()
+}
+
+// InsertStopEvent inserts the arrival of the shuttle at the stop, with its departure if it's known
+func (pg *PgSQL) InsertStopEvent(event *StopEvent) error {
+	return pg.RecordStopEvents(nil, []*StopEvent{event})
+}
+
+// UpdateStopEvent records the departure of the shuttle and its dwell time
+func (pg *PgSQL) UpdateStopEvent(event *StopEvent) error {
+	return pg.RecordStopEvents(event, nil)
+}
+
+// RecordStopEvents records the departure of the shuttle, if not nil, and inserts its next arrivals in one
+// transaction, the arrivals keep no id if it fails
+func (pg *PgSQL) RecordStopEvents(departure *StopEvent, arrivals []*StopEvent) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if departure != nil {
+		_, err = tx.Exec(updateStopEvent, departure.ID, nullTime(departure.DepartedAt), departure.Dwell.Seconds())
+		if err == nil {
+			err = pg.notify(tx, StopEventChannel, strconv.FormatInt(departure.ID, 10))
 		}
-		logs = append(logs, s)
 	}
-	return logs, nil
+	for _, event := range arrivals {
+		if err != nil {
+			break
+		}
+		if err = insertStopEventTx(tx, event); err == nil {
+			err = pg.notify(tx, StopEventChannel, strconv.FormatInt(event.ID, 10))
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		for _, event := range arrivals {
+			event.ID = 0
+		}
+	}
+	return err
 }
 
-// SelectLatestLog fetches the latest shuttle's log from database
-func (pg *PgSQL) SelectLatestLog(logid string) (*ShuttleLog, error) {
-	if v, ok := pg.CachedLatestLog[logid]; ok {
-		return v, nil
+func insertStopEventTx(tx *sql.Tx, event *StopEvent) error {
+	var metaID int64
+	if err := tx.QueryRow(soiShuttleMeta, event.VehicleID, sql.NullString{}).Scan(&metaID); err != nil {
+		return err
+	}
+	var deviation, dwell sql.NullFloat64
+	if event.TripID != "" {
+		deviation = sql.NullFloat64{Float64: event.Deviation.Seconds(), Valid: true}
 	}
-	// query database if not in cache ( lazy load requires a special table to store the latest time stamp )
-	return nil, fmt.Errorf("Shuttle Log with Vehicle ID '%s' not found in cache", logid)
+	if !event.DepartedAt.IsZero() {
+		dwell = sql.NullFloat64{Float64: event.Dwell.Seconds(), Valid: true}
+	}
+	return tx.QueryRow(insertStopEvent, event.StopID, metaID, nullString(event.RouteName), event.ArrivedAt,
+		nullString(event.TripID), nullTime(event.ScheduledAt), deviation, nullTime(event.DepartedAt), dwell).Scan(&event.ID)
 }
 
-// Close connection to database and clean caches
-func (pg *PgSQL) Close() {
-	pg.DB.Close()
-	pg.CachedLatestLog = nil
-	pg.CachedRoute = nil
+// SelectStopEvents selects the events of the stop with an arrival in [from, to)
+func (pg *PgSQL) SelectStopEvents(stopID string, from, to time.Time) ([]*StopEvent, error) {
+	rows, err := pg.DB.Query(selectStopEvents, stopID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []*StopEvent{}
+	for rows.Next() {
+		e, err := scanStopEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// SelectStopEvent selects a stop event by its id
+func (pg *PgSQL) SelectStopEvent(id int64) (*StopEvent, error) {
+	e, err := scanStopEvent(pg.DB.QueryRow(selectStopEvent, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Stop event %d not found", id)
+	}
+	return e, err
+}
+
+func scanStopEvent(row scanner) (*StopEvent, error) {
+	e := &StopEvent{}
+	var (
+		vehicleID, route, trip  sql.NullString
+		departedAt, scheduledAt pq.NullTime
+		dwell, deviation        sql.NullFloat64
+	)
+	err := row.Scan(&e.ID, &e.StopID, &vehicleID, &route, &e.ArrivedAt, &departedAt, &dwell, &trip, &scheduledAt, &deviation)
+	if err != nil {
+		return nil, err
+	}
+	e.VehicleID = vehicleID.String
+	e.RouteName = route.String
+	e.DepartedAt = departedAt.Time
+	e.Dwell = time.Duration(dwell.Float64 * float64(time.Second))
+	e.TripID = trip.String
+	e.ScheduledAt = scheduledAt.Time
+	e.Deviation = time.Duration(deviation.Float64 * float64(time.Second))
+	return e, nil
+}
+
+// SelectAdherence counts the arrivals scheduled in [from, to) by route, stop and hour
+func (pg *PgSQL) SelectAdherence(routeName string, from, to time.Time, tolerance *AdherenceTolerance) ([]*Adherence, error) {
+	rows, err := pg.DB.Query(selectAdherence, routeName, from, to, tolerance.Location.String(),
+		tolerance.Early.Seconds(), tolerance.Late.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	adherence := []*Adherence{}
+	for rows.Next() {
+		a := &Adherence{}
+		var mean float64
+		err = rows.Scan(&a.RouteName, &a.StopID, &a.Hour, &a.Arrivals, &a.Early, &a.Late, &mean)
+		if err != nil {
+			return nil, err
+		}
+		a.MeanDeviation = time.Duration(mean * float64(time.Second))
+		adherence = append(adherence, a)
+	}
+	return adherence, rows.Err()
+}
+
+// InsertHeadwayAlert inserts the alert
+func (pg *PgSQL) InsertHeadwayAlert(alert *HeadwayAlert) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	err = tx.QueryRow(insertHeadwayAlert, alert.RouteName, alert.Kind, alert.VehicleID, alert.AheadID, alert.Distance,
+		alert.RaisedAt).Scan(&alert.ID)
+	if err == nil {
+		err = pg.notify(tx, HeadwayChannel, alert.RouteName)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// ResolveHeadwayAlert records the end of the alert
+func (pg *PgSQL) ResolveHeadwayAlert(alert *HeadwayAlert) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	_, err = tx.Exec(resolveHeadwayAlert, alert.ID, alert.ResolvedAt)
+	if err == nil {
+		err = pg.notify(tx, HeadwayChannel, alert.RouteName)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// SelectHeadwayAlerts selects the alerts of the route raised in [from, to) or still open
+func (pg *PgSQL) SelectHeadwayAlerts(routeName string, from, to time.Time) ([]*HeadwayAlert, error) {
+	return pg.selectHeadwayAlerts(selectHeadwayAlerts, routeName, from, to)
+}
+
+// SelectOpenHeadwayAlerts selects the headway alerts of every route that are not resolved
+func (pg *PgSQL) SelectOpenHeadwayAlerts() ([]*HeadwayAlert, error) {
+	return pg.selectHeadwayAlerts(selectOpenHeadwayAlerts)
+}
+
+func (pg *PgSQL) selectHeadwayAlerts(query string, args ...interface{}) ([]*HeadwayAlert, error) {
+	rows, err := pg.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	alerts := []*HeadwayAlert{}
+	for rows.Next() {
+		a := &HeadwayAlert{}
+		var (
+			vehicleID, aheadID sql.NullString
+			distance           sql.NullFloat64
+			resolvedAt         pq.NullTime
+		)
+		err = rows.Scan(&a.ID, &a.RouteName, &a.Kind, &vehicleID, &aheadID, &distance, &a.RaisedAt, &resolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		a.VehicleID = vehicleID.String
+		a.AheadID = aheadID.String
+		a.Distance = distance.Float64
+		a.ResolvedAt = resolvedAt.Time
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// SelectRouteLogs selects the shuttle logs with a route and a fix time in [from, to)
+func (pg *PgSQL) SelectRouteLogs(from, to time.Time) ([]*ShuttleLog, error) {
+	rows, err := pg.DB.Query(selectRouteLogs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logs := []*ShuttleLog{}
+	for rows.Next() {
+		log, err := scanShuttleLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+	return logs, rows.Err()
+}
+
+// InsertSegmentSamples inserts the samples in one statement, the samples of unknown routes or stops are
+// ignored
+func (pg *PgSQL) InsertSegmentSamples(samples []*SegmentSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	routes, from, to := make([]string, len(samples)), make([]string, len(samples)), make([]string, len(samples))
+	startedAt, endedAt := make([]string, len(samples)), make([]string, len(samples))
+	for i, s := range samples {
+		routes[i], from[i], to[i] = s.RouteName, s.FromStop, s.ToStop
+		startedAt[i], endedAt[i] = s.StartedAt.Format(time.RFC3339Nano), s.EndedAt.Format(time.RFC3339Nano)
+	}
+	_, err := pg.DB.Exec(insertSegmentSamples, pq.Array(routes), pq.Array(from), pq.Array(to), pq.Array(startedAt), pq.Array(endedAt))
+	return err
+}
+
+// SelectLatestSegmentSample selects the end of the latest sample, zero if there is none
+func (pg *PgSQL) SelectLatestSegmentSample() (time.Time, error) {
+	var latest pq.NullTime
+	if err := pg.DB.QueryRow(selectLatestSegmentSample).Scan(&latest); err != nil {
+		return time.Time{}, err
+	}
+	return latest.Time, nil
+}
+
+// UpdateSegmentTimes replaces the segment travel times with the ones of the samples since from and
+// deletes the older samples
+func (pg *PgSQL) UpdateSegmentTimes(from time.Time, location *time.Location) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	_, err = tx.Exec(deleteSegmentSamples, from)
+	if err == nil {
+		_, err = tx.Exec(deleteSegmentTimes)
+	}
+	if err == nil {
+		_, err = tx.Exec(insertSegmentTimes, from, location.String())
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// SelectSegmentTimes selects the segment travel times of the route
+func (pg *PgSQL) SelectSegmentTimes(routeName string) ([]*SegmentTime, error) {
+	rows, err := pg.DB.Query(selectSegmentTimes, routeName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	times := []*SegmentTime{}
+	for rows.Next() {
+		t := &SegmentTime{RouteName: routeName}
+		var (
+			weekday int
+			travel  float64
+		)
+		err = rows.Scan(&t.FromStop, &t.ToStop, &weekday, &t.Hour, &travel, &t.Samples, &t.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		t.Weekday = time.Weekday(weekday)
+		t.TravelTime = time.Duration(travel * float64(time.Second))
+		times = append(times, t)
+	}
+	return times, rows.Err()
+}
+
+// UpsertCalendar inserts the calendar or replaces the calendar with the same service id and its exceptions
+func (pg *PgSQL) UpsertCalendar(calendar *ServiceCalendar) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	err = tx.QueryRow(upsertCalendar, calendar.ServiceID, pq.Array(calendar.Weekdays[:]), formatDate(calendar.StartDate),
+		formatDate(calendar.EndDate)).Scan(&calendar.ID)
+	if err == nil {
+		_, err = tx.Exec(deleteCalendarDates, calendar.ID)
+	}
+	if err == nil && len(calendar.Exceptions) > 0 {
+		dates, added := make([]string, len(calendar.Exceptions)), make([]bool, len(calendar.Exceptions))
+		for i, e := range calendar.Exceptions {
+			dates[i], added[i] = formatDate(e.Date), e.Added
+		}
+		_, err = tx.Exec(insertCalendarDates, calendar.ID, pq.Array(dates), pq.Array(added))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// SelectCalendar selects a calendar with its exceptions by its service id
+func (pg *PgSQL) SelectCalendar(serviceID string) (*ServiceCalendar, error) {
+	c := &ServiceCalendar{}
+	var (
+		weekdays           pq.BoolArray
+		startDate, endDate pq.NullTime
+	)
+	err := pg.DB.QueryRow(selectCalendar, serviceID).Scan(&c.ID, &c.ServiceID, &weekdays, &startDate, &endDate)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Service '%s' not found", serviceID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	copy(c.Weekdays[:], weekdays)
+	c.StartDate = startDate.Time
+	c.EndDate = endDate.Time
+	rows, err := pg.DB.Query(selectCalendarDates, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := CalendarException{}
+		if err = rows.Scan(&e.Date, &e.Added); err != nil {
+			return nil, err
+		}
+		c.Exceptions = append(c.Exceptions, e)
+	}
+	return c, rows.Err()
+}
+
+// InsertTrips replaces the trips of the route
+func (pg *PgSQL) InsertTrips(routeName string, trips []*Trip) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	var routeID int64
+	err = tx.QueryRow(selectRouteMeta, routeName).Scan(&routeID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("Route '%s' not found", routeName)
+	}
+	if err == nil {
+		_, err = tx.Exec(deleteTrips, routeName)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, trip := range trips {
+		if err = insertTripTx(tx, routeName, trip); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+func insertTripTx(tx *sql.Tx, routeName string, trip *Trip) error {
+	var calendarID int64
+	err := tx.QueryRow(selectCalendar, trip.ServiceID).Scan(&calendarID, new(string), new(pq.BoolArray), new(pq.NullTime), new(pq.NullTime))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Service '%s' not found", trip.ServiceID)
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(insertTrip, trip.TripID, routeName, trip.ServiceID, nullString(trip.Headsign)).Scan(&trip.ID)
+	if err != nil {
+		return err
+	}
+	trip.RouteName = routeName
+	n := len(trip.StopTimes)
+	stops, sequences, arrivals, departures := make([]string, n), make([]int64, n), make([]int64, n), make([]int64, n)
+	for i, st := range trip.StopTimes {
+		stops[i], sequences[i] = st.StopID, int64(st.Sequence)
+		arrivals[i], departures[i] = int64(st.Arrival/time.Second), int64(st.Departure/time.Second)
+	}
+	res, err := tx.Exec(insertStopTimes, trip.ID, pq.Array(stops), pq.Array(sequences), pq.Array(arrivals), pq.Array(departures))
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err == nil && inserted != int64(n) {
+		return fmt.Errorf("Trip '%s' has unknown stops", trip.TripID)
+	}
+	return nil
+}
+
+// SelectTrips selects the trips of the route with their stop times
+func (pg *PgSQL) SelectTrips(routeName string) ([]*Trip, error) {
+	rows, err := pg.DB.Query(selectTrips, routeName)
+	if err != nil {
+		return nil, err
+	}
+	trips := []*Trip{}
+	byID := map[string]*Trip{}
+	for rows.Next() {
+		t := &Trip{RouteName: routeName}
+		headsign := sql.NullString{}
+		if err = rows.Scan(&t.ID, &t.TripID, &t.ServiceID, &headsign); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.Headsign = headsign.String
+		trips = append(trips, t)
+		byID[t.TripID] = t
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = pg.DB.Query(selectStopTimes, routeName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			tripID             string
+			arrival, departure int64
+		)
+		st := &StopTime{}
+		if err = rows.Scan(&tripID, &st.StopID, &st.Sequence, &arrival, &departure); err != nil {
+			return nil, err
+		}
+		st.Arrival, st.Departure = time.Duration(arrival)*time.Second, time.Duration(departure)*time.Second
+		if t, ok := byID[tripID]; ok {
+			t.StopTimes = append(t.StopTimes, st)
+		}
+	}
+	return trips, rows.Err()
+}
+
+// InsertShuttleLog to database
+func (pg *PgSQL) InsertShuttleLog(log *ShuttleLog) error {
+	tx, err := pg.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	err = insertShuttleLogTx(tx, log)
+	if err == nil {
+		err = pg.notify(tx, LogChannel, log.VehicleID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	pg.cacheLock.Lock()
+	pg.cacheLatestLog(log)
+	pg.cacheLock.Unlock()
+	return nil
+}
+
+// InsertShuttleLogs inserts a batch of shuttle logs in a single transaction using multi-row inserts.
+// If the batch is rejected, the logs are inserted one by one under savepoints so that the failing
+// rows can be reported; the returned slice is aligned with logs and the error is set only when
+// the transaction itself failed.
+func (pg *PgSQL) InsertShuttleLogs(logs []*ShuttleLog) ([]error, error) {
+	errs := make([]error, len(logs))
+	valid := []*ShuttleLog{}
+	for i, log := range logs {
+		if log == nil || log.Location == nil {
+			errs[i] = fmt.Errorf("Shuttle log %d has no location", i)
+			continue
+		}
+		valid = append(valid, log)
+	}
+	if len(valid) == 0 {
+		return errs, nil
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return errs, err
+	}
+	if _, err = tx.Exec("SAVEPOINT batch"); err != nil {
+		tx.Rollback()
+		return errs, err
+	}
+	if err = insertShuttleLogBatch(tx, valid); err != nil {
+		fmt.Printf("Batch insert failed, retrying row by row: %s\n", err.Error())
+		if _, err = tx.Exec("ROLLBACK TO SAVEPOINT batch"); err != nil {
+			tx.Rollback()
+			return errs, err
+		}
+		for i, log := range logs {
+			if errs[i] != nil {
+				continue
+			}
+			if _, err = tx.Exec("SAVEPOINT row"); err != nil {
+				clearShuttleLogIDs(logs, errs)
+				tx.Rollback()
+				return errs, err
+			}
+			// the ids of the rolled back batch are stale, the row insert sets them again
+			log.ID, log.Location.ID = 0, 0
+			if errs[i] = insertShuttleLogTx(tx, log); errs[i] != nil {
+				log.ID, log.Location.ID = 0, 0
+				if _, err = tx.Exec("ROLLBACK TO SAVEPOINT row"); err != nil {
+					clearShuttleLogIDs(logs, errs)
+					tx.Rollback()
+					return errs, err
+				}
+			}
+		}
+	}
+	vehicleIDs := []string{}
+	for i, log := range logs {
+		if errs[i] == nil {
+			vehicleIDs = append(vehicleIDs, log.VehicleID)
+		}
+	}
+	if err = pg.notify(tx, LogChannel, vehicleIDs...); err != nil {
+		clearShuttleLogIDs(logs, errs)
+		tx.Rollback()
+		return errs, err
+	}
+	if err = tx.Commit(); err != nil {
+		clearShuttleLogIDs(logs, errs)
+		return errs, err
+	}
+	pg.cacheLock.Lock()
+	for i, log := range logs {
+		if errs[i] == nil {
+			pg.cacheLatestLog(log)
+		}
+	}
+	pg.cacheLock.Unlock()
+	return errs, nil
+}
+
+// clearShuttleLogIDs resets the ids of the logs whose insert was rolled back, a log with an id is stored
+func clearShuttleLogIDs(logs []*ShuttleLog, errs []error) {
+	for i, log := range logs {
+		if errs[i] == nil {
+			log.ID, log.Location.ID = 0, 0
+		}
+	}
+}
+
+// insertShuttleLogTx inserts a single shuttle log with its map point and meta data in the transaction
+func insertShuttleLogTx(tx *sql.Tx, log *ShuttleLog) error {
+	err := tx.QueryRow(insertMapPoint, log.Location.X, log.Location.Y, log.Location.Angle, log.Location.Speed).Scan(&log.Location.ID)
+	if err != nil {
+		return err
+	}
+	var (
+		shuttle_meta_id sql.NullInt64
+		shuttleName     sql.NullString
+	)
+	err = shuttleName.Scan(log.Name)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(soiShuttleMeta, log.VehicleID, shuttleName).Scan(&shuttle_meta_id)
+	if err != nil {
+		return err
+	}
+	var snappedX, snappedY, distance sql.NullFloat64
+	if log.Snapped != nil {
+		snappedX = sql.NullFloat64{Float64: log.Snapped.X, Valid: true}
+		snappedY = sql.NullFloat64{Float64: log.Snapped.Y, Valid: true}
+		distance = sql.NullFloat64{Float64: log.RouteDistance, Valid: true}
+	}
+	return tx.QueryRow(insertShuttleLog, log.Location.ID, shuttle_meta_id, nullTime(log.FixTime), nullTime(log.StationaryUntil),
+		nullString(log.Source), log.Status, nullString(log.RouteName), snappedX, snappedY, distance).Scan(&log.ID)
+}
+
+// insertShuttleLogBatch inserts the logs with one statement per table, ids are allocated upfront
+// so that map points and logs can be linked without relying on the order of returned rows
+func insertShuttleLogBatch(tx *sql.Tx, logs []*ShuttleLog) error {
+	// allocate the ids
+	rows, err := tx.Query(selectShuttleLogIDs, len(logs))
+	if err != nil {
+		return err
+	}
+	logIDs := make([]int64, 0, len(logs))
+	for i := 0; rows.Next(); i++ {
+		var pointID, logID int64
+		if err = rows.Scan(&pointID, &logID); err != nil {
+			rows.Close()
+			return err
+		}
+		logs[i].Location.ID = pointID
+		logIDs = append(logIDs, logID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(logIDs) != len(logs) {
+		return fmt.Errorf("Allocated %d ids for %d shuttle logs", len(logIDs), len(logs))
+	}
+	// select or insert the shuttle meta data, one row per vehicle
+	names := map[string]string{}
+	vehicleIDs, shuttleNames := []string{}, []string{}
+	for _, log := range logs {
+		if _, ok := names[log.VehicleID]; !ok {
+			names[log.VehicleID] = log.Name
+			vehicleIDs = append(vehicleIDs, log.VehicleID)
+			shuttleNames = append(shuttleNames, log.Name)
+		}
+	}
+	rows, err = tx.Query(soiShuttleMetas, pq.Array(vehicleIDs), pq.Array(shuttleNames))
+	if err != nil {
+		return err
+	}
+	metaIDs := map[string]int64{}
+	for rows.Next() {
+		var (
+			id  int64
+			vid string
+		)
+		if err = rows.Scan(&id, &vid); err != nil {
+			rows.Close()
+			return err
+		}
+		metaIDs[vid] = id
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	// insert the map points and the logs
+	var (
+		pointIDs, logMetaIDs   = make([]int64, len(logs)), make([]int64, len(logs))
+		xs, ys, angles, speeds = make([]float64, len(logs)), make([]float64, len(logs)), make([]float64, len(logs)), make([]float64, len(logs))
+		fixTimes, untils       = make([]string, len(logs)), make([]string, len(logs))
+		sources, statuses      = make([]string, len(logs)), make([]string, len(logs))
+		routeNames             = make([]string, len(logs))
+		snappedXs, snappedYs   = make([]float64, len(logs)), make([]float64, len(logs))
+		distances              = make([]float64, len(logs))
+	)
+	for i, log := range logs {
+		pointIDs[i] = log.Location.ID
+		logMetaIDs[i] = metaIDs[log.VehicleID]
+		xs[i], ys[i], angles[i], speeds[i] = log.Location.X, log.Location.Y, log.Location.Angle, log.Location.Speed
+		fixTimes[i], untils[i] = formatTime(log.FixTime), formatTime(log.StationaryUntil)
+		sources[i], statuses[i] = log.Source, log.Status
+		if log.Snapped != nil {
+			routeNames[i] = log.RouteName
+			snappedXs[i], snappedYs[i], distances[i] = log.Snapped.X, log.Snapped.Y, log.RouteDistance
+		}
+	}
+	_, err = tx.Exec(insertMapPoints, pq.Array(pointIDs), pq.Array(xs), pq.Array(ys), pq.Array(angles), pq.Array(speeds))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertShuttleLogs, pq.Array(logIDs), pq.Array(pointIDs), pq.Array(logMetaIDs), pq.Array(fixTimes), pq.Array(untils), pq.Array(sources), pq.Array(statuses),
+		pq.Array(routeNames), pq.Array(snappedXs), pq.Array(snappedYs), pq.Array(distances))
+	if err != nil {
+		return err
+	}
+	for i, log := range logs {
+		log.ID = logIDs[i]
+	}
+	return nil
+}
+
+// ExtendStationary updates the end of the stationary span of the stored shuttle logs in one statement,
+// the logs without id are not stored yet and skipped
+func (pg *PgSQL) ExtendStationary(logs []*ShuttleLog) error {
+	ids, untils, vehicleIDs := []int64{}, []string{}, []string{}
+	for _, log := range logs {
+		if log.ID == 0 {
+			continue
+		}
+		ids = append(ids, log.ID)
+		untils = append(untils, formatTime(log.StationaryUntil))
+		vehicleIDs = append(vehicleIDs, log.VehicleID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(updateStationary, pq.Array(ids), pq.Array(untils))
+	if err == nil {
+		err = pg.notify(tx, LogChannel, vehicleIDs...)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pg.cacheLock.Lock()
+	for _, log := range logs {
+		if cached, ok := pg.CachedLatestLog[log.VehicleID]; ok && log.ID != 0 && cached.ID == log.ID {
+			cached.StationaryUntil = log.StationaryUntil
+		}
+	}
+	pg.cacheLock.Unlock()
+	return nil
+}
+
+// InsertQuarantine stores a rejected shuttle log with the reason
+func (pg *PgSQL) InsertQuarantine(q *QuarantinedLog) error {
+	log := q.Log
+	return pg.DB.QueryRow(insertQuarantine, log.VehicleID, log.Location.X, log.Location.Y, log.Location.Angle, log.Location.Speed,
+		log.Status, nullTime(log.FixTime), q.Reason).Scan(&q.ID, &q.CreatedAt)
+}
+
+// SelectQuarantine selects the quarantined logs created in [from, to)
+func (pg *PgSQL) SelectQuarantine(from, to time.Time) ([]*QuarantinedLog, error) {
+	rows, err := pg.DB.Query(selectQuarantine, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*QuarantinedLog{}
+	for rows.Next() {
+		v := &Vector{}
+		q := &QuarantinedLog{Log: &ShuttleLog{Location: v}}
+		status := sql.NullString{}
+		fixTime := pq.NullTime{}
+		err = rows.Scan(&q.ID, &q.Log.VehicleID, &v.X, &v.Y, &v.Angle, &v.Speed, &status, &fixTime, &q.Reason, &q.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		q.Log.Status = status.String
+		q.Log.FixTime = fixTime.Time
+		r = append(r, q)
+	}
+	return r, rows.Err()
+}
+
+// AcquireLease acquires the lease if it's free or expired, or renews it if the holder owns it
+func (pg *PgSQL) AcquireLease(lease *Lease) (bool, error) {
+	err := pg.DB.QueryRow(acquireLease, lease.Name, lease.Holder, lease.TTL.Nanoseconds()/int64(time.Millisecond)).Scan(&lease.AcquiredAt, &lease.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SelectLease selects the current holder of the lease, nil before any instance acquired it
+func (pg *PgSQL) SelectLease(name string) (*Lease, error) {
+	lease := &Lease{Name: name}
+	err := pg.DB.QueryRow(selectLease, name).Scan(&lease.Holder, &lease.AcquiredAt, &lease.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// nullString maps the empty string to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// formatTime formats the time for the array parameters, the zero time is formatted as empty string
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// formatDate formats the date for the date parameters, the zero time is formatted as empty string
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// SelectShuttleLog selects all shuttle logs of a shuttle specified by its remote id
+func (pg *PgSQL) SelectShuttleLog(remoteShuttleID string) ([]*ShuttleLog, error) {
+	var logs []*ShuttleLog
+	tx, err := pg.DB.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
+
+	rows, err := tx.Query(selectShuttleLog, remoteShuttleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanShuttleLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// SelectLatestLog fetches the latest shuttle's log from cache first, if it's missing, select from the database.
+// The log is a copy, the pipeline keeps updating the stored logs.
+func (pg *PgSQL) SelectLatestLog(logid string) (*ShuttleLog, error) {
+	pg.cacheLock.RLock()
+	v, ok := pg.CachedLatestLog[logid]
+	var cached ShuttleLog
+	if ok {
+		cached = *v
+	}
+	pg.cacheLock.RUnlock()
+	if ok {
+		return &cached, nil
+	}
+	log, err := pg.selectLatestLog(logid)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Shuttle Log with Vehicle ID '%s' not found", logid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pg.cacheLock.Lock()
+	pg.cacheLatestLog(log)
+	pg.cacheLock.Unlock()
+	return log, nil
+}
+
+// cacheLatestLog caches a copy of the log, the cache lock must be held
+func (pg *PgSQL) cacheLatestLog(log *ShuttleLog) {
+	cached := *log
+	pg.CachedLatestLog[log.VehicleID] = &cached
+}
+
+func (pg *PgSQL) selectLatestLog(remoteShuttleID string) (*ShuttleLog, error) {
+	return scanShuttleLog(pg.DB.QueryRow(selectLatestShuttleLog, remoteShuttleID))
+}
+
+// scanner is implemented by both sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanShuttleLog scans a row selected with shuttleLogColumns
+func scanShuttleLog(row scanner) (*ShuttleLog, error) {
+	v := &Vector{}
+	s := &ShuttleLog{Location: v}
+	var (
+		name, status, source, route  sql.NullString
+		fixTime, until               pq.NullTime
+		snappedX, snappedY, distance sql.NullFloat64
+	)
+	err := row.Scan(&s.ID, &s.VehicleID, &name, &status, &s.CreatedAt, &fixTime, &until, &source,
+		&v.X, &v.Y, &v.Angle, &v.Speed, &route, &snappedX, &snappedY, &distance)
+	if err != nil {
+		return nil, err
+	}
+	s.Name = name.String
+	s.Status = status.String
+	s.FixTime = fixTime.Time
+	s.StationaryUntil = until.Time
+	s.Source = source.String
+	s.RouteName = route.String
+	if route.Valid && snappedX.Valid && snappedY.Valid {
+		s.Snapped = &Vector{X: snappedX.Float64, Y: snappedY.Float64, Angle: v.Angle, Speed: v.Speed}
+		s.RouteDistance = distance.Float64
+	}
+	return s, nil
+}
+
+// Close connection to database and clean caches
+func (pg *PgSQL) Close() {
+	if pg.listener != nil {
+		pg.listener.Close()
+	}
+	pg.DB.Close()
+	pg.cacheLock.Lock()
+	defer pg.cacheLock.Unlock()
+	pg.CachedLatestLog = nil
+	pg.CachedRoute = nil
+	pg.CachedVehicle = nil
+}
+
+// InsertDetour inserts the detour with its points, the detour is notified as a change of its route
+func (pg *PgSQL) InsertDetour(detour *Detour) error {
+	if len(detour.Points) < 2 {
+		return fmt.Errorf("Detour of route '%s' requires at least 2 points", detour.RouteName)
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	var routeID int64
+	err = tx.QueryRow(selectRouteMeta, detour.RouteName).Scan(&routeID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("Route '%s' not found", detour.RouteName)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.QueryRow(insertDetour, detour.RouteName, detour.StartsAt, detour.EndsAt, detour.Reason).Scan(&detour.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, v := range detour.Points {
+		err = tx.QueryRow(insertMapPoint, v.X, v.Y, v.Angle, v.Speed).Scan(&v.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(insertDetourPath, detour.ID, v.ID, i)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = pg.notify(tx, RouteChannel, detour.RouteName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// DeleteDetour deletes the detour, its route is followed again
+func (pg *PgSQL) DeleteDetour(id int64) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	var routeName string
+	err = tx.QueryRow(deleteDetour, id).Scan(&routeName)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("Detour %d not found", id)
+	}
+	if err == nil {
+		err = pg.notify(tx, RouteChannel, routeName)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// SelectDetours selects the detours of the route overlapping [from, to], of all the routes if the route
+// name is empty, sorted by start
+func (pg *PgSQL) SelectDetours(routeName string, from, to time.Time) ([]*Detour, error) {
+	rows, err := pg.DB.Query(selectDetours, routeName, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	detours := []*Detour{}
+	var detour *Detour
+	for rows.Next() {
+		d := &Detour{}
+		v := &Vector{}
+		err = rows.Scan(&d.ID, &d.RouteName, &d.StartsAt, &d.EndsAt, &d.Reason, &v.X, &v.Y, &v.Angle, &v.Speed)
+		if err != nil {
+			return nil, err
+		}
+		// the points of a detour are consecutive
+		if detour == nil || detour.ID != d.ID {
+			detour = d
+			detours = append(detours, detour)
+		}
+		detour.Points = append(detour.Points, v)
+	}
+	return detours, rows.Err()
+}
+
+// InsertOffRouteEvent inserts the event
+func (pg *PgSQL) InsertOffRouteEvent(event *OffRouteEvent) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	err = tx.QueryRow(insertOffRouteEvent, event.VehicleID, event.RouteName, event.StartedAt, event.MaxDistance).Scan(&event.ID)
+	if err == nil {
+		err = pg.notify(tx, OffRouteChannel, event.RouteName)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// UpdateOffRouteEvent records the end and the farthest distance of the event
+func (pg *PgSQL) UpdateOffRouteEvent(event *OffRouteEvent) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	var endedAt *time.Time
+	if !event.EndedAt.IsZero() {
+		endedAt = &event.EndedAt
+	}
+	_, err = tx.Exec(updateOffRouteEvent, event.ID, endedAt, event.MaxDistance)
+	if err == nil {
+		err = pg.notify(tx, OffRouteChannel, event.RouteName)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// SelectOffRouteEvents selects the events of the route started in [from, to) or still going on
+func (pg *PgSQL) SelectOffRouteEvents(routeName string, from, to time.Time) ([]*OffRouteEvent, error) {
+	rows, err := pg.DB.Query(selectOffRouteEvents, routeName, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []*OffRouteEvent{}
+	for rows.Next() {
+		e := &OffRouteEvent{RouteName: routeName}
+		var (
+			endedAt     pq.NullTime
+			maxDistance sql.NullFloat64
+		)
+		err = rows.Scan(&e.ID, &e.VehicleID, &e.StartedAt, &endedAt, &maxDistance)
+		if err != nil {
+			return nil, err
+		}
+		e.EndedAt = endedAt.Time
+		e.MaxDistance = maxDistance.Float64
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// InsertServiceAlert inserts the alert with its routes, stops and periods
+func (pg *PgSQL) InsertServiceAlert(alert *ServiceAlert) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	err = tx.QueryRow(insertServiceAlert, alert.Severity, alert.Header, alert.Description, alert.URL, alert.UpdatedAt).Scan(&alert.ID)
+	if err == nil {
+		err = insertAlertEntitiesTx(tx, alert)
+	}
+	if err == nil {
+		err = pg.notify(tx, AlertChannel, strconv.FormatInt(alert.ID, 10))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// UpdateServiceAlert replaces the alert with the same id, its routes, stops and periods included
+func (pg *PgSQL) UpdateServiceAlert(alert *ServiceAlert) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	res, err := tx.Exec(updateServiceAlert, alert.ID, alert.Severity, alert.Header, alert.Description, alert.URL, alert.UpdatedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("Alert %d not found", alert.ID)
+	}
+	_, err = tx.Exec(deleteServiceAlertEntities, alert.ID)
+	if err == nil {
+		err = insertAlertEntitiesTx(tx, alert)
+	}
+	if err == nil {
+		err = pg.notify(tx, AlertChannel, strconv.FormatInt(alert.ID, 10))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// insertAlertEntitiesTx inserts the routes, the stops and the periods of the alert, the routes and the
+// stops must exist
+func insertAlertEntitiesTx(tx *sql.Tx, alert *ServiceAlert) error {
+	for _, name := range alert.Routes {
+		res, err := tx.Exec(insertServiceAlertRoute, alert.ID, name)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return fmt.Errorf("Route '%s' not found", name)
+		}
+	}
+	for _, id := range alert.Stops {
+		res, err := tx.Exec(insertServiceAlertStop, alert.ID, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return fmt.Errorf("Stop '%s' not found", id)
+		}
+	}
+	for _, p := range alert.Periods {
+		var end *time.Time
+		if !p.End.IsZero() {
+			end = &p.End
+		}
+		if _, err := tx.Exec(insertServiceAlertPeriod, alert.ID, p.Start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteServiceAlert deletes the alert by id
+func (pg *PgSQL) DeleteServiceAlert(id int64) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	res, err := tx.Exec(deleteServiceAlert, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("Alert %d not found", id)
+	}
+	if err = pg.notify(tx, AlertChannel, strconv.FormatInt(id, 10)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// SelectServiceAlert selects the alert by id
+func (pg *PgSQL) SelectServiceAlert(id int64) (*ServiceAlert, error) {
+	alerts, err := pg.selectServiceAlerts(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(alerts) == 0 {
+		return nil, fmt.Errorf("Alert %d not found", id)
+	}
+	return alerts[0], nil
+}
+
+// SelectServiceAlerts selects the alerts active at the time, or all the alerts if the time is zero
+func (pg *PgSQL) SelectServiceAlerts(at time.Time) ([]*ServiceAlert, error) {
+	if at.IsZero() {
+		return pg.selectServiceAlerts(nil, nil)
+	}
+	return pg.selectServiceAlerts(nil, at)
+}
+
+// selectServiceAlerts selects the alert by id and the alerts active at the time, a nil id or time doesn't
+// filter
+func (pg *PgSQL) selectServiceAlerts(id, at interface{}) ([]*ServiceAlert, error) {
+	rows, err := pg.DB.Query(selectServiceAlerts, id, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	alerts := []*ServiceAlert{}
+	for rows.Next() {
+		a := &ServiceAlert{}
+		var (
+			routes, stops pq.StringArray
+			starts, ends  pq.Float64Array
+		)
+		err = rows.Scan(&a.ID, &a.Severity, &a.Header, &a.Description, &a.URL, &a.UpdatedAt, &routes, &stops, &starts, &ends)
+		if err != nil {
+			return nil, err
+		}
+		a.Routes = []string(routes)
+		a.Stops = []string(stops)
+		for i := range starts {
+			p := AlertPeriod{Start: fromEpoch(starts[i])}
+			if ends[i] > 0 {
+				p.End = fromEpoch(ends[i])
+			}
+			a.Periods = append(a.Periods, p)
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// fromEpoch converts seconds since the epoch to a time
+func fromEpoch(seconds float64) time.Time {
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9))
 }
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// fleetSize is the number of vehicles reporting in one poll
+const fleetSize = 200
+
+// openTestDB connects to the database of YAST_TEST_DB, the benchmark is skipped without it
+func openTestDB(b *testing.B) *PgSQL {
+	url := os.Getenv("YAST_TEST_DB")
+	if url == "" {
+		b.Skip("YAST_TEST_DB is not set")
+	}
+	pg := &PgSQL{URL: url}
+	pg.Open()
+	return pg
+}
+
+// fleetLogs returns one log per vehicle of the fleet
+func fleetLogs(poll int) []*ShuttleLog {
+	now := time.Now()
+	logs := make([]*ShuttleLog, fleetSize)
+	for i := range logs {
+		logs[i] = &ShuttleLog{
+			VehicleID: fmt.Sprintf("bench-%03d", i),
+			Status:    "bench",
+			Location:  &Vector{X: -73.68 + float64(i)*1e-4, Y: 42.73 + float64(poll)*1e-5, Speed: 12},
+			FixTime:   now,
+		}
+	}
+	return logs
+}
+
+// BenchmarkInsertShuttleLogs compares the batch insert of a poll of the fleet with one insert per vehicle
+func BenchmarkInsertShuttleLogs(b *testing.B) {
+	pg := openTestDB(b)
+	defer pg.Close()
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			logs := fleetLogs(i)
+			b.StartTimer()
+			errs, err := pg.InsertShuttleLogs(logs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for j, err := range errs {
+				if err != nil {
+					b.Fatalf("log %d: %s", j, err)
+				}
+				if logs[j].ID == 0 {
+					b.Fatalf("log %d has no id", j)
+				}
+			}
+		}
+	})
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			logs := fleetLogs(i)
+			b.StartTimer()
+			for _, log := range logs {
+				if err := pg.InsertShuttleLog(log); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
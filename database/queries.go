@@ -1,5 +1,17 @@
 package database
 
+const (
+	// columns and joins to select shuttle logs, see scanShuttleLog
+	shuttleLogColumns = `
+		SELECT shuttle_log.id, remote_shuttle_id, shuttle_name, status, created_at, fix_time, stationary_until, source,
+			longitude, latitude, angle, speed, route.name, snapped_longitude, snapped_latitude, route_distance
+		FROM shuttle_log
+		JOIN shuttle_meta ON shuttle_log.shuttle_meta_id = shuttle_meta.id
+		JOIN map_point ON shuttle_log.map_point_id = map_point.id
+		LEFT JOIN route ON shuttle_log.route_id = route.id
+	`
+)
+
 const (
 	selectAllRouteName = `SELECT name FROM route`
 	insertMapPoint     = `INSERT INTO map_point (longitude, latitude, angle, speed) VALUES ($1, $2, $3, $4) RETURNING id`
@@ -12,14 +24,69 @@ const (
 						SELECT id FROM shuttle_meta WHERE remote_shuttle_id = $1
 						UNION
 						SELECT id FROM new_shuttle_meta`
-	insertShuttleLog = `INSERT INTO shuttle_log (map_point_id, shuttle_meta_id, created_at) VALUES($1, $2, CURRENT_TIMESTAMP)`
-	selectShuttleLog = ` 
-					SELECT shuttle_log.id, shuttle_name, status, created_at, longitude, latitude, angle, speed
-						FROM shuttle_log 
-							LEFT JOIN shuttle_meta ON shuttle_log.shuttle_meta_id = shuttle_meta.id
-							LEFT JOIN map_point ON shuttle_log.map_point_id = map_point.id
-                     WHERE shuttle_meta.remote_shuttle_id = $1
-						`
+	insertShuttleLog = `INSERT INTO shuttle_log (map_point_id, shuttle_meta_id, fix_time, stationary_until, source, status,
+							route_id, snapped_longitude, snapped_latitude, route_distance, created_at)
+						VALUES($1, $2, $3, $4, $5, $6, (SELECT id FROM route WHERE name = $7), $8, $9, $10, CURRENT_TIMESTAMP) RETURNING id`
+	updateStationary = `UPDATE shuttle_log SET stationary_until = CAST(NULLIF(t.stationary_until, '') AS TIMESTAMP WITH TIME ZONE)
+						FROM unnest(CAST($1 AS INT[]), CAST($2 AS VARCHAR[])) AS t(id, stationary_until)
+						WHERE shuttle_log.id = t.id`
+	// allocate ids for a batch of map points and shuttle logs
+	selectShuttleLogIDs = `SELECT nextval('map_point_id_seq'), nextval('shuttle_log_id_seq') FROM generate_series(1, $1)`
+	// select or insert the meta data of a batch of shuttles
+	soiShuttleMetas = `WITH input AS (
+							SELECT * FROM unnest(CAST($1 AS VARCHAR[]), CAST($2 AS VARCHAR[])) AS t(remote_shuttle_id, shuttle_name)),
+						new_shuttle_meta AS (
+							INSERT INTO shuttle_meta (remote_shuttle_id, shuttle_name)
+							SELECT remote_shuttle_id, shuttle_name FROM input
+							WHERE NOT EXISTS (SELECT remote_shuttle_id FROM shuttle_meta WHERE shuttle_meta.remote_shuttle_id = input.remote_shuttle_id)
+							RETURNING id, remote_shuttle_id)
+						SELECT id, remote_shuttle_id FROM shuttle_meta WHERE remote_shuttle_id = ANY($1)
+						UNION
+						SELECT id, remote_shuttle_id FROM new_shuttle_meta`
+	insertMapPoints = `INSERT INTO map_point (id, longitude, latitude, angle, speed)
+						SELECT * FROM unnest(CAST($1 AS INT[]), CAST($2 AS FLOAT[]), CAST($3 AS FLOAT[]), CAST($4 AS FLOAT[]), CAST($5 AS FLOAT[]))`
+	// the snapped location is only set for the logs on a route
+	insertShuttleLogs = `INSERT INTO shuttle_log (id, map_point_id, shuttle_meta_id, fix_time, stationary_until, source, status,
+							route_id, snapped_longitude, snapped_latitude, route_distance, created_at)
+						SELECT t.id, map_point_id, shuttle_meta_id,
+							CAST(NULLIF(fix_time, '') AS TIMESTAMP WITH TIME ZONE),
+							CAST(NULLIF(stationary_until, '') AS TIMESTAMP WITH TIME ZONE),
+							NULLIF(source, ''),
+							status,
+							route.id,
+							CASE WHEN route.id IS NULL THEN NULL ELSE snapped_longitude END,
+							CASE WHEN route.id IS NULL THEN NULL ELSE snapped_latitude END,
+							CASE WHEN route.id IS NULL THEN NULL ELSE route_distance END,
+							CURRENT_TIMESTAMP
+						FROM unnest(CAST($1 AS INT[]), CAST($2 AS INT[]), CAST($3 AS INT[]), CAST($4 AS VARCHAR[]), CAST($5 AS VARCHAR[]),
+							CAST($6 AS VARCHAR[]), CAST($7 AS VARCHAR[]), CAST($8 AS VARCHAR[]), CAST($9 AS FLOAT[]), CAST($10 AS FLOAT[]),
+							CAST($11 AS FLOAT[]))
+							AS t(id, map_point_id, shuttle_meta_id, fix_time, stationary_until, source, status,
+								route_name, snapped_longitude, snapped_latitude, route_distance)
+						LEFT JOIN route ON route.name = t.route_name`
+	selectShuttleLog = shuttleLogColumns + `
+		WHERE shuttle_meta.remote_shuttle_id = $1
+		ORDER BY shuttle_log.id
+	`
+	insertQuarantine = `
+		INSERT INTO shuttle_quarantine (remote_shuttle_id, longitude, latitude, angle, speed, status, fix_time, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP) RETURNING id, created_at
+	`
+	selectQuarantine = `
+		SELECT id, remote_shuttle_id, longitude, latitude, angle, speed, status, fix_time, reason, created_at
+		FROM shuttle_quarantine
+		WHERE created_at >= $1 AND created_at < $2
+		ORDER BY created_at
+	`
+	selectLatestShuttleLog = shuttleLogColumns + `
+		WHERE shuttle_meta.remote_shuttle_id = $1
+		ORDER BY shuttle_log.id DESC
+		LIMIT 1
+	`
+	// notify the other instances of the changed keys
+	notifyChange = `
+		SELECT pg_notify($1, payload) FROM unnest(CAST($2 AS TEXT[])) AS payload
+	`
 	insertRoutePath = `
 		INSERT INTO route_path (route_id, map_point_id, ordering) VALUES ($1, $2, $3)
 	`
@@ -37,4 +104,371 @@ const (
 	selectRouteMeta = `
 		SELECT id FROM route WHERE name = $1
 	`
+	// acquire the lease if it expired or renew it if the holder already owns it
+	acquireLease = `
+		INSERT INTO lease (name, holder, acquired_at, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (name) DO UPDATE SET
+			holder = EXCLUDED.holder,
+			acquired_at = CASE WHEN lease.holder = EXCLUDED.holder THEN lease.acquired_at ELSE EXCLUDED.acquired_at END,
+			expires_at = EXCLUDED.expires_at
+		WHERE lease.holder = EXCLUDED.holder OR lease.expires_at < CURRENT_TIMESTAMP
+		RETURNING acquired_at, expires_at
+	`
+	selectLease = `
+		SELECT holder, acquired_at, expires_at FROM lease WHERE name = $1
+	`
+	upsertVehicle = `
+		INSERT INTO shuttle_meta (remote_shuttle_id, shuttle_name, capacity, accessibility, plate, active, shuttle_route_id)
+		VALUES ($1, $2, $3, $4, $5, $6, (SELECT id FROM route WHERE name = $7))
+		ON CONFLICT (remote_shuttle_id) DO UPDATE SET
+			shuttle_name = EXCLUDED.shuttle_name,
+			capacity = EXCLUDED.capacity,
+			accessibility = EXCLUDED.accessibility,
+			plate = EXCLUDED.plate,
+			active = EXCLUDED.active,
+			shuttle_route_id = EXCLUDED.shuttle_route_id,
+			route_confidence = CASE WHEN shuttle_meta.shuttle_route_id IS NOT DISTINCT FROM EXCLUDED.shuttle_route_id
+				THEN shuttle_meta.route_confidence END,
+			route_assigned_at = CASE WHEN shuttle_meta.shuttle_route_id IS NOT DISTINCT FROM EXCLUDED.shuttle_route_id
+				THEN shuttle_meta.route_assigned_at ELSE CURRENT_TIMESTAMP END
+		RETURNING id
+	`
+	selectVehicles = `
+		SELECT shuttle_meta.id, remote_shuttle_id, shuttle_name, capacity, accessibility, plate, active, route.name,
+			route_confidence, route_assigned_at, state, state_since
+		FROM shuttle_meta
+		LEFT JOIN route ON route.id = shuttle_meta.shuttle_route_id
+	`
+	selectVehicle = selectVehicles + `WHERE remote_shuttle_id = $1`
+	deleteVehicle = `
+		UPDATE shuttle_meta SET active = false WHERE remote_shuttle_id = $1
+	`
+	// assign the route to the shuttle, the shuttle meta data is created if missing
+	updateShuttleRoute = `
+		UPDATE shuttle_meta SET
+			shuttle_route_id = (SELECT id FROM route WHERE name = $2),
+			route_confidence = $3,
+			route_assigned_at = $4
+		WHERE id = $1
+	`
+	insertRouteAssignment = `
+		INSERT INTO route_assignment (shuttle_meta_id, route_id, confidence, assigned_at)
+		VALUES ($1, (SELECT id FROM route WHERE name = $2), $3, $4) RETURNING id
+	`
+	selectRouteAssignments = `
+		SELECT route_assignment.id, route.name, confidence, assigned_at
+		FROM route_assignment
+		JOIN shuttle_meta ON shuttle_meta.id = route_assignment.shuttle_meta_id
+		LEFT JOIN route ON route.id = route_assignment.route_id
+		WHERE remote_shuttle_id = $1 AND assigned_at >= $2 AND assigned_at < $3
+		ORDER BY assigned_at
+	`
+	upsertStopMeta = `
+		INSERT INTO stop_meta (remote_stop_id, stop_name) VALUES ($1, $2)
+		ON CONFLICT (remote_stop_id) DO UPDATE SET stop_name = EXCLUDED.stop_name
+		RETURNING id
+	`
+	upsertStop = `
+		INSERT INTO stop (route_id, map_point_id, stop_meta_id) VALUES ((SELECT id FROM route WHERE name = $1), $2, $3)
+		ON CONFLICT (stop_meta_id) DO UPDATE SET
+			route_id = EXCLUDED.route_id,
+			map_point_id = EXCLUDED.map_point_id
+		RETURNING id
+	`
+	selectStops = `
+		SELECT stop.id, remote_stop_id, stop_name, route.name, longitude, latitude, angle, speed
+		FROM stop
+		JOIN stop_meta ON stop_meta.id = stop.stop_meta_id
+		JOIN map_point ON map_point.id = stop.map_point_id
+		JOIN route ON route.id = stop.route_id
+	`
+	selectStop         = selectStops + `WHERE remote_stop_id = $1`
+	selectStopsOnRoute = selectStops + `WHERE route.name = $1 ORDER BY stop.id`
+	insertStopEvent    = `
+		INSERT INTO stop_event (stop_id, shuttle_meta_id, route_id, arrived_at, trip_id, scheduled_at, deviation,
+			departed_at, dwell)
+		VALUES (
+			(SELECT stop.id FROM stop JOIN stop_meta ON stop_meta.id = stop.stop_meta_id WHERE remote_stop_id = $1),
+			$2, (SELECT id FROM route WHERE name = $3), $4,
+			(SELECT id FROM trip WHERE trip_id = $5), $6, $7, $8, $9
+		) RETURNING id
+	`
+	updateStopEvent = `
+		UPDATE stop_event SET departed_at = $2, dwell = $3 WHERE id = $1
+	`
+	selectStopEventBase = `
+		SELECT stop_event.id, remote_stop_id, remote_shuttle_id, route.name, arrived_at, departed_at, dwell,
+			trip.trip_id, scheduled_at, deviation
+		FROM stop_event
+		JOIN stop ON stop.id = stop_event.stop_id
+		JOIN stop_meta ON stop_meta.id = stop.stop_meta_id
+		LEFT JOIN shuttle_meta ON shuttle_meta.id = stop_event.shuttle_meta_id
+		LEFT JOIN route ON route.id = stop_event.route_id
+		LEFT JOIN trip ON trip.id = stop_event.trip_id
+	`
+	selectStopEvents = selectStopEventBase + `
+		WHERE remote_stop_id = $1 AND arrived_at >= $2 AND arrived_at < $3
+		ORDER BY arrived_at
+	`
+	selectStopEvent = selectStopEventBase + `WHERE stop_event.id = $1`
+	selectRouteLogs = shuttleLogColumns + `
+		WHERE fix_time >= $1 AND fix_time < $2 AND shuttle_log.route_id IS NOT NULL
+		ORDER BY fix_time
+	`
+	insertSegmentSamples = `
+		INSERT INTO segment_sample (route_id, from_stop_id, to_stop_id, started_at, ended_at)
+		SELECT route.id, from_stop.id, to_stop.id, t.started_at, t.ended_at
+		FROM unnest(CAST($1 AS VARCHAR[]), CAST($2 AS VARCHAR[]), CAST($3 AS VARCHAR[]),
+			CAST($4 AS TIMESTAMP WITH TIME ZONE[]), CAST($5 AS TIMESTAMP WITH TIME ZONE[]))
+			AS t(route, from_stop, to_stop, started_at, ended_at)
+		JOIN route ON route.name = t.route
+		JOIN stop_meta AS from_meta ON from_meta.remote_stop_id = t.from_stop
+		JOIN stop AS from_stop ON from_stop.stop_meta_id = from_meta.id
+		JOIN stop_meta AS to_meta ON to_meta.remote_stop_id = t.to_stop
+		JOIN stop AS to_stop ON to_stop.stop_meta_id = to_meta.id
+	`
+	selectLatestSegmentSample = `SELECT MAX(ended_at) FROM segment_sample`
+	deleteSegmentSamples      = `DELETE FROM segment_sample WHERE started_at < $1`
+	deleteSegmentTimes        = `DELETE FROM segment_time`
+	// median travel times from the arrival of a vehicle at a stop to its arrival at the next one,
+	// bucketed in the time zone $2
+	insertSegmentTimes = `
+		INSERT INTO segment_time (route_id, from_stop_id, to_stop_id, day_of_week, hour, travel_time, samples, updated_at)
+		SELECT route_id, from_stop_id, to_stop_id,
+			EXTRACT(DOW FROM started_at AT TIME ZONE $2),
+			EXTRACT(HOUR FROM started_at AT TIME ZONE $2),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM ended_at - started_at)),
+			COUNT(*),
+			CURRENT_TIMESTAMP
+		FROM segment_sample
+		WHERE started_at >= $1
+		GROUP BY 1, 2, 3, 4, 5
+	`
+	selectSegmentTimes = `
+		SELECT from_meta.remote_stop_id, to_meta.remote_stop_id, day_of_week, hour, travel_time, samples, updated_at
+		FROM segment_time
+		JOIN route ON route.id = segment_time.route_id
+		JOIN stop AS from_stop ON from_stop.id = segment_time.from_stop_id
+		JOIN stop_meta AS from_meta ON from_meta.id = from_stop.stop_meta_id
+		JOIN stop AS to_stop ON to_stop.id = segment_time.to_stop_id
+		JOIN stop_meta AS to_meta ON to_meta.id = to_stop.stop_meta_id
+		WHERE route.name = $1
+		ORDER BY from_meta.remote_stop_id, to_meta.remote_stop_id, day_of_week, hour
+	`
+	upsertCalendar = `
+		INSERT INTO service_calendar (service_id, weekdays, start_date, end_date)
+		VALUES ($1, $2, CAST(NULLIF($3, '') AS DATE), CAST(NULLIF($4, '') AS DATE))
+		ON CONFLICT (service_id) DO UPDATE SET
+			weekdays = EXCLUDED.weekdays,
+			start_date = EXCLUDED.start_date,
+			end_date = EXCLUDED.end_date
+		RETURNING id
+	`
+	deleteCalendarDates = `DELETE FROM service_calendar_date WHERE calendar_id = $1`
+	insertCalendarDates = `
+		INSERT INTO service_calendar_date (calendar_id, date, added)
+		SELECT $1, date, added FROM unnest(CAST($2 AS DATE[]), CAST($3 AS BOOLEAN[])) AS t(date, added)
+	`
+	selectCalendars = `
+		SELECT id, service_id, weekdays, start_date, end_date FROM service_calendar
+	`
+	selectCalendar      = selectCalendars + `WHERE service_id = $1`
+	selectCalendarDates = `
+		SELECT date, added FROM service_calendar_date WHERE calendar_id = $1 ORDER BY date
+	`
+	deleteTrips = `
+		DELETE FROM trip WHERE route_id = (SELECT id FROM route WHERE name = $1)
+	`
+	insertTrip = `
+		INSERT INTO trip (trip_id, route_id, calendar_id, headsign)
+		VALUES ($1, (SELECT id FROM route WHERE name = $2), (SELECT id FROM service_calendar WHERE service_id = $3), $4)
+		RETURNING id
+	`
+	insertStopTimes = `
+		INSERT INTO stop_time (trip_id, stop_id, sequence, arrival, departure)
+		SELECT $1, stop.id, sequence, arrival, departure
+		FROM unnest(CAST($2 AS VARCHAR[]), CAST($3 AS INT[]), CAST($4 AS INT[]), CAST($5 AS INT[]))
+			AS t(remote_stop_id, sequence, arrival, departure)
+		JOIN stop_meta ON stop_meta.remote_stop_id = t.remote_stop_id
+		JOIN stop ON stop.stop_meta_id = stop_meta.id
+	`
+	selectTrips = `
+		SELECT trip.id, trip_id, service_id, headsign
+		FROM trip
+		JOIN route ON route.id = trip.route_id
+		JOIN service_calendar ON service_calendar.id = trip.calendar_id
+		WHERE route.name = $1
+		ORDER BY trip_id
+	`
+	selectStopTimes = `
+		SELECT trip.trip_id, remote_stop_id, sequence, arrival, departure
+		FROM stop_time
+		JOIN trip ON trip.id = stop_time.trip_id
+		JOIN route ON route.id = trip.route_id
+		JOIN stop ON stop.id = stop_time.stop_id
+		JOIN stop_meta ON stop_meta.id = stop.stop_meta_id
+		WHERE route.name = $1
+		ORDER BY trip.trip_id, sequence
+	`
+	// arrivals compared to the schedule by route, stop and hour of the schedule in the time zone $4,
+	// an arrival is on time from $5 seconds early to $6 seconds late
+	selectAdherence = `
+		SELECT route.name, remote_stop_id, EXTRACT(HOUR FROM scheduled_at AT TIME ZONE $4),
+			COUNT(*),
+			COUNT(*) FILTER (WHERE deviation < -CAST($5 AS FLOAT)),
+			COUNT(*) FILTER (WHERE deviation > $6),
+			AVG(deviation)
+		FROM stop_event
+		JOIN route ON route.id = stop_event.route_id
+		JOIN stop ON stop.id = stop_event.stop_id
+		JOIN stop_meta ON stop_meta.id = stop.stop_meta_id
+		WHERE ($1 = '' OR route.name = $1) AND scheduled_at >= $2 AND scheduled_at < $3
+		GROUP BY 1, 2, 3
+		ORDER BY 1, 2, 3
+	`
+	insertHeadwayAlert = `
+		INSERT INTO headway_alert (route_id, kind, shuttle_meta_id, ahead_shuttle_meta_id, distance, raised_at)
+		VALUES (
+			(SELECT id FROM route WHERE name = $1), $2,
+			(SELECT id FROM shuttle_meta WHERE remote_shuttle_id = $3),
+			(SELECT id FROM shuttle_meta WHERE remote_shuttle_id = $4),
+			$5, $6
+		) RETURNING id
+	`
+	resolveHeadwayAlert = `
+		UPDATE headway_alert SET resolved_at = $2 WHERE id = $1
+	`
+	selectHeadwayAlertBase = `
+		SELECT headway_alert.id, route.name, kind, vehicle.remote_shuttle_id, ahead.remote_shuttle_id, distance,
+			raised_at, resolved_at
+		FROM headway_alert
+		JOIN route ON route.id = headway_alert.route_id
+		LEFT JOIN shuttle_meta AS vehicle ON vehicle.id = headway_alert.shuttle_meta_id
+		LEFT JOIN shuttle_meta AS ahead ON ahead.id = headway_alert.ahead_shuttle_meta_id
+	`
+	// alerts raised in a time range or still open
+	selectHeadwayAlerts = selectHeadwayAlertBase + `
+		WHERE route.name = $1 AND ((raised_at >= $2 AND raised_at < $3) OR resolved_at IS NULL)
+		ORDER BY raised_at
+	`
+	selectOpenHeadwayAlerts = selectHeadwayAlertBase + `
+		WHERE resolved_at IS NULL
+		ORDER BY raised_at
+	`
+	insertDetour = `
+		INSERT INTO route_detour (route_id, starts_at, ends_at, reason)
+		VALUES ((SELECT id FROM route WHERE name = $1), $2, $3, $4) RETURNING id
+	`
+	insertDetourPath = `
+		INSERT INTO detour_path (route_detour_id, map_point_id, ordering) VALUES ($1, $2, $3)
+	`
+	deleteDetour = `
+		DELETE FROM route_detour WHERE id = $1 RETURNING (SELECT name FROM route WHERE route.id = route_detour.route_id)
+	`
+	// detours overlapping a time range with their points, of all the routes without route name
+	selectDetours = `
+		SELECT route_detour.id, route.name, starts_at, ends_at, reason, longitude, latitude, angle, speed
+		FROM route_detour
+		JOIN route ON route.id = route_detour.route_id
+		JOIN detour_path ON detour_path.route_detour_id = route_detour.id
+		JOIN map_point ON map_point.id = detour_path.map_point_id
+		WHERE ($1 = '' OR route.name = $1) AND starts_at <= $3 AND ends_at > $2
+		ORDER BY starts_at, route_detour.id, detour_path.ordering
+	`
+	insertOffRouteEvent = `
+		INSERT INTO off_route_event (shuttle_meta_id, route_id, started_at, max_distance)
+		VALUES (
+			(SELECT id FROM shuttle_meta WHERE remote_shuttle_id = $1),
+			(SELECT id FROM route WHERE name = $2),
+			$3, $4
+		) RETURNING id
+	`
+	updateOffRouteEvent = `
+		UPDATE off_route_event SET ended_at = $2, max_distance = $3 WHERE id = $1
+	`
+	// events started in a time range or still going on
+	selectOffRouteEvents = `
+		SELECT off_route_event.id, remote_shuttle_id, started_at, ended_at, max_distance
+		FROM off_route_event
+		JOIN route ON route.id = off_route_event.route_id
+		JOIN shuttle_meta ON shuttle_meta.id = off_route_event.shuttle_meta_id
+		WHERE route.name = $1 AND ((started_at >= $2 AND started_at < $3) OR ended_at IS NULL)
+		ORDER BY started_at
+	`
+	// change the current state of the shuttle
+	updateShuttleState = `
+		UPDATE shuttle_meta SET state = $2, state_since = $3 WHERE id = $1
+	`
+	insertStateTransition = `
+		INSERT INTO vehicle_state_transition (shuttle_meta_id, from_state, to_state, at) VALUES ($1, $2, $3, $4) RETURNING id
+	`
+	selectStateTransitions = `
+		SELECT vehicle_state_transition.id, from_state, to_state, at
+		FROM vehicle_state_transition
+		JOIN shuttle_meta ON shuttle_meta.id = vehicle_state_transition.shuttle_meta_id
+		WHERE remote_shuttle_id = $1 AND at >= $2 AND at < $3
+		ORDER BY at
+	`
+	insertServiceAlert = `
+		INSERT INTO service_alert (severity, header, description, url, updated_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id
+	`
+	updateServiceAlert = `
+		UPDATE service_alert SET severity = $2, header = $3, description = $4, url = $5, updated_at = $6
+		WHERE id = $1
+	`
+	deleteServiceAlert = `
+		DELETE FROM service_alert WHERE id = $1
+	`
+	// the affected routes, stops and periods are replaced on update
+	deleteServiceAlertEntities = `
+		WITH routes AS (DELETE FROM service_alert_route WHERE service_alert_id = $1),
+			stops AS (DELETE FROM service_alert_stop WHERE service_alert_id = $1)
+		DELETE FROM service_alert_period WHERE service_alert_id = $1
+	`
+	insertServiceAlertRoute = `
+		INSERT INTO service_alert_route (service_alert_id, route_id)
+		SELECT $1, id FROM route WHERE name = $2
+	`
+	insertServiceAlertStop = `
+		INSERT INTO service_alert_stop (service_alert_id, stop_meta_id)
+		SELECT $1, id FROM stop_meta WHERE remote_stop_id = $2
+	`
+	insertServiceAlertPeriod = `
+		INSERT INTO service_alert_period (service_alert_id, starts_at, ends_at) VALUES ($1, $2, $3)
+	`
+	// alerts with their routes, stops and periods, by id with $1 or all of them with NULL, and active at $2
+	// or at any time with NULL. The periods are in seconds since the epoch and 0 if they never end, an
+	// alert without period is always active.
+	selectServiceAlerts = `
+		WITH routes AS (
+			SELECT service_alert_id, array_agg(route.name ORDER BY route.name) AS names
+			FROM service_alert_route
+			JOIN route ON route.id = service_alert_route.route_id
+			GROUP BY service_alert_id
+		), stops AS (
+			SELECT service_alert_id, array_agg(remote_stop_id ORDER BY remote_stop_id) AS ids
+			FROM service_alert_stop
+			JOIN stop_meta ON stop_meta.id = service_alert_stop.stop_meta_id
+			GROUP BY service_alert_id
+		), periods AS (
+			SELECT service_alert_id,
+				array_agg(EXTRACT(EPOCH FROM starts_at) ORDER BY starts_at, ends_at) AS starts,
+				array_agg(COALESCE(EXTRACT(EPOCH FROM ends_at), 0) ORDER BY starts_at, ends_at) AS ends,
+				bool_or(starts_at <= $2 AND (ends_at IS NULL OR ends_at > $2)) AS active
+			FROM service_alert_period
+			GROUP BY service_alert_id
+		)
+		SELECT service_alert.id, severity, header, description, url, updated_at,
+			COALESCE(routes.names, '{}'), COALESCE(stops.ids, '{}'),
+			COALESCE(periods.starts, '{}'), COALESCE(periods.ends, '{}')
+		FROM service_alert
+		LEFT JOIN routes ON routes.service_alert_id = service_alert.id
+		LEFT JOIN stops ON stops.service_alert_id = service_alert.id
+		LEFT JOIN periods ON periods.service_alert_id = service_alert.id
+		WHERE ($1::INT IS NULL OR service_alert.id = $1)
+			AND ($2::TIMESTAMP WITH TIME ZONE IS NULL OR periods.active IS NULL OR periods.active)
+		ORDER BY service_alert.id
+	`
 )
@@ -0,0 +1,95 @@
+package yast
+
+import (
+	"sync"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// Deduplicator suppresses the fixes the remote feed repeats for parked shuttles
+type Deduplicator struct {
+	sync.Mutex
+
+	vehicles map[string]*dedupeState // vehicle id -> state, guarded by the deduplicator lock
+	extended []*database.ShuttleLog  // stored logs whose stationary span was extended since the last call to Extended
+}
+
+// dedupeState is the state of one vehicle, the workers of the pipeline only contend on their own vehicles
+type dedupeState struct {
+	sync.Mutex
+
+	lastFix    *database.ShuttleLog // last received log
+	lastStored *database.ShuttleLog // last stored log
+	lastRaw    database.Vector      // position of last stored log as received
+}
+
+// Filter returns the logs which should be stored. A log repeating the device timestamp of the
+// previous one is dropped, a log at the same position as the last stored one is coalesced into
+// its stationary span instead of being stored.
+func (d *Deduplicator) Filter(logs []*database.ShuttleLog) []*database.ShuttleLog {
+	kept, extended := []*database.ShuttleLog{}, []*database.ShuttleLog{}
+	for _, log := range logs {
+		v := d.vehicle(log.VehicleID)
+		v.Lock()
+		if last := v.lastFix; last != nil && !log.FixTime.IsZero() && log.FixTime.Equal(last.FixTime) {
+			v.Unlock()
+			pkg.Count("suppressed_duplicate", 1)
+			continue
+		}
+		v.lastFix = log
+		if stored := v.lastStored; stored != nil && samePosition(v.lastRaw, stored.Status, log) {
+			// the pipeline owns the stored log, the database caches and returns copies of it
+			stored.StationaryUntil = log.FixTime
+			v.Unlock()
+			extended = append(extended, stored)
+			pkg.Count("suppressed_stationary", 1)
+			continue
+		}
+		v.lastStored, v.lastRaw = log, *log.Location
+		v.Unlock()
+		kept = append(kept, log)
+	}
+	if len(extended) > 0 {
+		d.Lock()
+		d.extended = append(d.extended, extended...)
+		d.Unlock()
+	}
+	return kept
+}
+
+// Extended returns the stored logs whose stationary span was extended since the last call, once each
+func (d *Deduplicator) Extended() []*database.ShuttleLog {
+	d.Lock()
+	defer d.Unlock()
+	seen := map[*database.ShuttleLog]bool{}
+	extended := []*database.ShuttleLog{}
+	for _, log := range d.extended {
+		if !seen[log] {
+			seen[log] = true
+			extended = append(extended, log)
+		}
+	}
+	d.extended = nil
+	return extended
+}
+
+// vehicle returns the state of the vehicle, created the first time it's seen
+func (d *Deduplicator) vehicle(vehicleID string) *dedupeState {
+	d.Lock()
+	defer d.Unlock()
+	if d.vehicles == nil {
+		d.vehicles = make(map[string]*dedupeState)
+	}
+	v, ok := d.vehicles[vehicleID]
+	if !ok {
+		v = &dedupeState{}
+		d.vehicles[vehicleID] = v
+	}
+	return v
+}
+
+// samePosition compares the received position, later stages may move the stored one
+func samePosition(position database.Vector, status string, log *database.ShuttleLog) bool {
+	return position.X == log.Location.X && position.Y == log.Location.Y && status == log.Status
+}
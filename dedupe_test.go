@@ -0,0 +1,58 @@
+package yast
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// run with -race, the stationary spans are extended while the api reads the latest log
+func TestDeduplicatorExtendsWhileReading(t *testing.T) {
+	db := &database.MockDatabase{}
+	db.Open()
+	buffer := NewWriteBuffer(db, 0, "", 0)
+	d := &Deduplicator{}
+	start := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	const fixes = 1000
+	done := make(chan struct{})
+	var (
+		wg   sync.WaitGroup
+		seen time.Time
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if log, err := db.SelectLatestLog("v1"); err == nil {
+				if log.StationaryUntil.After(seen) {
+					seen = log.StationaryUntil
+				}
+			}
+		}
+	}()
+	for i := 0; i < fixes; i++ {
+		log := &database.ShuttleLog{VehicleID: "v1", FixTime: start.Add(time.Duration(i) * time.Second),
+			Location: &database.Vector{X: 1, Y: 2}}
+		buffer.Write(d.Filter([]*database.ShuttleLog{log}))
+		buffer.Extend(d.Extended())
+	}
+	close(done)
+	wg.Wait()
+	if seen.After(start.Add(fixes * time.Second)) {
+		t.Errorf("read a span until %s", seen)
+	}
+	latest, err := db.SelectLatestLog("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add((fixes - 1) * time.Second); !latest.FixTime.Equal(start) || !latest.StationaryUntil.Equal(want) {
+		t.Errorf("got log at %s until %s, want %s until %s", latest.FixTime, latest.StationaryUntil, start, want)
+	}
+}
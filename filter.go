@@ -0,0 +1,116 @@
+package yast
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keyboardnerd/yastserver/api"
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+const (
+	// number of consecutive rejected fixes after which the vehicle is assumed to have really moved
+	maxConsecutiveRejections = 3
+)
+
+// OutlierFilter rejects the fixes implying an impossible speed since the last accepted fix of the
+// vehicle or lying outside of the service area, the rejected fixes are put into quarantine
+type OutlierFilter struct {
+	sync.Mutex
+
+	MaxSpeed float64     // mph, 0 disables the check
+	Area     *api.Bounds // nil disables the check
+
+	vehicles map[string]*outlierState // vehicle id -> state, guarded by the filter lock
+}
+
+// outlierState is the state of one vehicle, the workers of the pipeline only contend on their own vehicles
+type outlierState struct {
+	sync.Mutex
+
+	last     *database.ShuttleLog // last accepted log
+	rejected int                  // consecutive rejections
+}
+
+// Filter returns the accepted logs and quarantines the others
+func (f *OutlierFilter) Filter(db database.Database, logs []*database.ShuttleLog) []*database.ShuttleLog {
+	kept, rejected := f.filter(logs)
+	for _, q := range rejected {
+		if err := db.InsertQuarantine(q); err != nil {
+			fmt.Printf("Unable to quarantine shuttle log of vehicle %s: %s\n", q.Log.VehicleID, err.Error())
+		}
+	}
+	return kept
+}
+
+// filter returns the accepted logs and the rejected ones with their reasons
+func (f *OutlierFilter) filter(logs []*database.ShuttleLog) ([]*database.ShuttleLog, []*database.QuarantinedLog) {
+	kept, rejected := []*database.ShuttleLog{}, []*database.QuarantinedLog{}
+	for _, log := range logs {
+		v := f.vehicle(log.VehicleID)
+		v.Lock()
+		reason := f.check(v, log)
+		if reason == "" {
+			v.last, v.rejected = log, 0
+		}
+		v.Unlock()
+		if reason == "" {
+			kept = append(kept, log)
+			continue
+		}
+		pkg.Count("quarantined", 1)
+		rejected = append(rejected, &database.QuarantinedLog{Log: log, Reason: reason})
+	}
+	return kept, rejected
+}
+
+// vehicle returns the state of the vehicle, created the first time it's seen
+func (f *OutlierFilter) vehicle(vehicleID string) *outlierState {
+	f.Lock()
+	defer f.Unlock()
+	if f.vehicles == nil {
+		f.vehicles = make(map[string]*outlierState)
+	}
+	v, ok := f.vehicles[vehicleID]
+	if !ok {
+		v = &outlierState{}
+		f.vehicles[vehicleID] = v
+	}
+	return v
+}
+
+// check returns the reason to reject the log of the vehicle or empty string if it's accepted
+func (f *OutlierFilter) check(v *outlierState, log *database.ShuttleLog) string {
+	if f.Area != nil && !f.Area.Contains(log.Location.X, log.Location.Y) {
+		return fmt.Sprintf("outside of service area at (%f, %f)", log.Location.X, log.Location.Y)
+	}
+	last := v.last
+	if f.MaxSpeed <= 0 || last == nil || log.FixTime.IsZero() || last.FixTime.IsZero() {
+		return ""
+	}
+	elapsed := log.FixTime.Sub(last.FixTime).Seconds()
+	distance := pkg.Distance(last.Location.X, last.Location.Y, log.Location.X, log.Location.Y)
+	var reason string
+	switch {
+	case elapsed < 0:
+		reason = fmt.Sprintf("fix %.0f s older than the last accepted fix", -elapsed)
+	case elapsed == 0 && distance > 0:
+		// a repeated fix at the same position is left to the deduplicator
+		reason = fmt.Sprintf("moved %.0f m without the fix time changing", distance)
+	case elapsed == 0:
+		return ""
+	default:
+		speed := distance / elapsed * pkg.MetersPerSecondToMph
+		if speed <= f.MaxSpeed {
+			return ""
+		}
+		reason = fmt.Sprintf("implied speed %.1f mph over %.0f m in %.0f s", speed, distance, elapsed)
+	}
+	// a vehicle jumping consistently, or whose clock went back, is trusted again after a few fixes
+	v.rejected++
+	if v.rejected > maxConsecutiveRejections {
+		return ""
+	}
+	return reason
+}
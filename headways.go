@@ -0,0 +1,208 @@
+package yast
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/api"
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// positions older than this are not part of the headways of a route
+const headwayMaxAge = 5 * time.Minute
+
+// HeadwayMonitor follows the distances between the vehicles of every route and raises an alert when a
+// vehicle is closer than Bunching or farther than Gap meters from the vehicle ahead, the alert is
+// resolved once the headway is back in bounds or the vehicle leaves the route. It runs after the route
+// snapper and reads the lengths of the cached routes. The alerts left open by a previous run are loaded
+// with the first log, those of the vehicles that don't report within headwayMaxAge are resolved.
+type HeadwayMonitor struct {
+	sync.Mutex
+
+	Database database.Database
+	Routes   *RouteCache
+	// meters to the vehicle ahead, 0 to disable the alert
+	Bunching float64
+	Gap      float64
+
+	positions map[string]map[string]api.VehiclePosition // route name -> vehicle id -> position
+	alerts    map[string]*database.HeadwayAlert         // vehicle id -> open alert, or resolved until it's stored
+	loadedAt  time.Time                                 // fix time of the log that loaded the open alerts
+}
+
+// Observe updates the headways of the route of the log and records the alerts raised and resolved by
+// its new position
+func (m *HeadwayMonitor) Observe(log *database.ShuttleLog) error {
+	raised, resolved, err := m.monitor(log)
+	if err != nil {
+		return err
+	}
+	for i, alert := range resolved {
+		if err := m.Database.ResolveHeadwayAlert(alert); err != nil {
+			m.rollback(raised, resolved[i:])
+			return err
+		}
+		m.Lock()
+		if m.alerts[alert.VehicleID] == alert {
+			delete(m.alerts, alert.VehicleID)
+		}
+		m.Unlock()
+	}
+	for i, alert := range raised {
+		if err := m.Database.InsertHeadwayAlert(alert); err != nil {
+			m.rollback(raised[i:], nil)
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback forgets the alerts that couldn't be inserted and reopens those that couldn't be resolved, the
+// next logs raise and resolve them again
+func (m *HeadwayMonitor) rollback(raised, resolved []*database.HeadwayAlert) {
+	m.Lock()
+	defer m.Unlock()
+	for _, alert := range raised {
+		if m.alerts[alert.VehicleID] == alert {
+			delete(m.alerts, alert.VehicleID)
+		}
+	}
+	for _, alert := range resolved {
+		alert.ResolvedAt = time.Time{}
+		m.alerts[alert.VehicleID] = alert
+	}
+}
+
+// monitor updates the position of the vehicle and returns the alerts it raised and resolved
+func (m *HeadwayMonitor) monitor(log *database.ShuttleLog) (raised, resolved []*database.HeadwayAlert, err error) {
+	at := log.FixTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.alerts == nil {
+		if err := m.load(at); err != nil {
+			return nil, nil, err
+		}
+	}
+	// the vehicle leaves the other routes
+	for name, positions := range m.positions {
+		if name != log.RouteName || log.Snapped == nil {
+			delete(positions, log.VehicleID)
+		}
+	}
+	if alert, ok := m.open(log.VehicleID); ok && (alert.RouteName != log.RouteName || log.Snapped == nil) {
+		resolved = append(resolved, m.resolve(alert, at))
+	}
+	if log.Snapped == nil {
+		return raised, resolved, nil
+	}
+	length := m.routeLength(log.RouteName)
+	if length == 0 {
+		return raised, resolved, nil
+	}
+	positions, ok := m.positions[log.RouteName]
+	if !ok {
+		positions = make(map[string]api.VehiclePosition)
+		m.positions[log.RouteName] = positions
+	}
+	positions[log.VehicleID] = api.VehiclePosition{
+		VehicleID: log.VehicleID,
+		Along:     log.RouteDistance,
+		Speed:     log.Location.Speed / pkg.MetersPerSecondToMph,
+		FixTime:   at,
+	}
+	current := []api.VehiclePosition{}
+	for id, p := range positions {
+		if at.Sub(p.FixTime) > headwayMaxAge {
+			delete(positions, id)
+			if alert, ok := m.open(id); ok {
+				resolved = append(resolved, m.resolve(alert, at))
+			}
+			continue
+		}
+		current = append(current, p)
+	}
+	// the loaded alerts of the vehicles that stopped reporting
+	if at.Sub(m.loadedAt) > headwayMaxAge {
+		for id, alert := range m.alerts {
+			if _, ok := positions[id]; !ok && alert.RouteName == log.RouteName && alert.ResolvedAt.IsZero() {
+				resolved = append(resolved, m.resolve(alert, at))
+			}
+		}
+	}
+	headways := api.ComputeHeadways(length, current, m.Bunching, m.Gap)
+	inBounds := make(map[string]bool, len(current))
+	for _, p := range current {
+		inBounds[p.VehicleID] = true
+	}
+	for _, h := range headways {
+		alert, open := m.open(h.VehicleID)
+		if h.Status != database.HeadwayBunching && h.Status != database.HeadwayGap {
+			continue
+		}
+		inBounds[h.VehicleID] = false
+		if open && alert.Kind == h.Status {
+			continue
+		}
+		if open {
+			resolved = append(resolved, m.resolve(alert, at))
+		}
+		alert = &database.HeadwayAlert{
+			RouteName: log.RouteName,
+			Kind:      h.Status,
+			VehicleID: h.VehicleID,
+			AheadID:   h.AheadID,
+			Distance:  h.Distance,
+			RaisedAt:  at,
+		}
+		m.alerts[h.VehicleID] = alert
+		raised = append(raised, alert)
+	}
+	// the headways back in bounds, or of a vehicle alone on the route
+	for id, ok := range inBounds {
+		if alert, open := m.open(id); ok && open {
+			resolved = append(resolved, m.resolve(alert, at))
+		}
+	}
+	return raised, resolved, nil
+}
+
+// load reads the alerts left open, it must be called with the lock held
+func (m *HeadwayMonitor) load(at time.Time) error {
+	alerts, err := m.Database.SelectOpenHeadwayAlerts()
+	if err != nil {
+		return err
+	}
+	m.positions = make(map[string]map[string]api.VehiclePosition)
+	m.alerts = make(map[string]*database.HeadwayAlert, len(alerts))
+	for _, alert := range alerts {
+		m.alerts[alert.VehicleID] = alert
+	}
+	m.loadedAt = at
+	return nil
+}
+
+// open returns the alert of the vehicle that isn't resolved, it must be called with the lock held
+func (m *HeadwayMonitor) open(vehicleID string) (*database.HeadwayAlert, bool) {
+	alert, ok := m.alerts[vehicleID]
+	return alert, ok && alert.ResolvedAt.IsZero()
+}
+
+// resolve closes the open alert of the vehicle, the alert is kept until it's resolved in the database.
+// It must be called with the lock held.
+func (m *HeadwayMonitor) resolve(alert *database.HeadwayAlert, at time.Time) *database.HeadwayAlert {
+	alert.ResolvedAt = at
+	return alert
+}
+
+// routeLength is the length of the route in meters, 0 if the route is unknown
+func (m *HeadwayMonitor) routeLength(name string) float64 {
+	route := m.Routes.Route(name)
+	if route == nil {
+		return 0
+	}
+	return pkg.PathLength(routePath(route), true)
+}
@@ -0,0 +1,36 @@
+package yast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+func TestHeadwayMonitorLoadsOpenAlerts(t *testing.T) {
+	db := &database.MockDatabase{}
+	db.Open()
+	squareRoute(db, nil)
+	start := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	// left open by the previous run, v2 doesn't report anymore
+	left := &database.HeadwayAlert{RouteName: "loop", Kind: database.HeadwayGap, VehicleID: "v2", RaisedAt: start.Add(-time.Hour)}
+	db.InsertHeadwayAlert(left)
+	routes := &RouteCache{Database: db}
+	snapper := &RouteSnapper{Routes: routes}
+	monitor := &HeadwayMonitor{Database: db, Routes: routes}
+	for i := 0; i <= 6; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		log := &database.ShuttleLog{VehicleID: "v1", RouteName: "loop", FixTime: at,
+			Location: &database.Vector{X: 0.001 * float64(i), Y: 0}}
+		snapper.Process(log)
+		if err := monitor.Observe(log); err != nil {
+			t.Fatal(err)
+		}
+		if resolved := !left.ResolvedAt.IsZero(); resolved != (at.Sub(start) > headwayMaxAge) {
+			t.Fatalf("at %s: got resolved %v", at, resolved)
+		}
+	}
+	if _, open := monitor.alerts["v2"]; open {
+		t.Errorf("resolved alert kept in memory")
+	}
+}
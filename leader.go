@@ -0,0 +1,58 @@
+package yast
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+const (
+	// name of the lease held by the instance polling the remote feeds
+	updaterLease = "updater"
+)
+
+// Elector keeps a lease in the database so that exactly one instance is the leader, the lease is
+// renewed well before it expires and taken over by another instance once it does
+type Elector struct {
+	sync.Mutex
+
+	Database database.Database
+	// identity of this instance
+	Holder string
+	TTL    time.Duration
+
+	leader bool
+}
+
+// Run renews or acquires the lease forever
+func (e *Elector) Run() {
+	for range time.Tick(e.TTL / 3) {
+		e.Elect()
+	}
+}
+
+// IsLeader tells if this instance holds the lease
+func (e *Elector) IsLeader() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.leader
+}
+
+// Elect acquires or renews the lease once
+func (e *Elector) Elect() {
+	lease := &database.Lease{Name: updaterLease, Holder: e.Holder, TTL: e.TTL}
+	leader, err := e.Database.AcquireLease(lease)
+	if err != nil {
+		// without the database the lease can't be renewed, step down before another instance takes it
+		fmt.Printf("Unable to acquire lease %s: %s\n", updaterLease, err.Error())
+		leader = false
+	}
+	e.Lock()
+	defer e.Unlock()
+	if leader != e.leader {
+		fmt.Printf("Instance %s leader: %v\n", e.Holder, leader)
+	}
+	e.leader = leader
+}
@@ -0,0 +1,198 @@
+package yast
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// terminator of a record in the remote feed format
+	recordTerminator = "eof"
+	// a connection without any complete record in this buffer size is reset
+	maxRecordBuffer = 64 * 1024
+	// connections idle for longer are closed, the device is expected to reconnect, and the incomplete
+	// record of a udp sender idle for longer is dropped
+	listenerIdleTimeout = 5 * time.Minute
+)
+
+// Listener receives the records of the remote feed format streamed by the devices over TCP and UDP
+// and ingests them through the updater
+type Listener struct {
+	sync.Mutex
+
+	TCPAddr string
+	UDPAddr string
+	Updater *Updater
+
+	tcp    net.Listener
+	udp    net.PacketConn
+	closed bool
+}
+
+// Listen opens the configured sockets and serves them asynchronously
+func (l *Listener) Listen() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.TCPAddr != "" {
+		tcp, err := net.Listen("tcp", l.TCPAddr)
+		if err != nil {
+			return err
+		}
+		l.tcp = tcp
+		fmt.Printf("Listening for shuttle logs on tcp %s\n", tcp.Addr())
+		go l.serveTCP(tcp)
+	}
+	if l.UDPAddr != "" {
+		udp, err := net.ListenPacket("udp", l.UDPAddr)
+		if err != nil {
+			if l.tcp != nil {
+				l.tcp.Close()
+			}
+			return err
+		}
+		l.udp = udp
+		fmt.Printf("Listening for shuttle logs on udp %s\n", udp.LocalAddr())
+		go l.serveUDP(udp)
+	}
+	return nil
+}
+
+// Close stops listening and closes the sockets
+func (l *Listener) Close() {
+	l.Lock()
+	defer l.Unlock()
+	l.closed = true
+	if l.tcp != nil {
+		l.tcp.Close()
+	}
+	if l.udp != nil {
+		l.udp.Close()
+	}
+}
+
+func (l *Listener) isClosed() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.closed
+}
+
+func (l *Listener) serveTCP(tcp net.Listener) {
+	delay := 10 * time.Millisecond
+	for {
+		conn, err := tcp.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			// keep accepting after transient failures, e.g. running out of file descriptors
+			fmt.Printf("Unable to accept tcp connection: %s\n", err.Error())
+			time.Sleep(delay)
+			if delay < time.Second {
+				delay *= 2
+			}
+			continue
+		}
+		delay = 10 * time.Millisecond
+		go l.serveConn(conn)
+	}
+}
+
+// serveConn reads the records from a connection until the device disconnects
+func (l *Listener) serveConn(conn net.Conn) {
+	defer conn.Close()
+	framer := &recordFramer{}
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(listenerIdleTimeout))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			l.ingest(framer.Write(buf[:n]), "tcp", conn.RemoteAddr())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (l *Listener) serveUDP(udp net.PacketConn) {
+	// records split across datagrams are reassembled per sender
+	framers := map[string]*recordFramer{}
+	lastEviction := time.Now()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := udp.ReadFrom(buf)
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			fmt.Printf("Unable to read udp datagram: %s\n", err.Error())
+			continue
+		}
+		framer, ok := framers[addr.String()]
+		if !ok {
+			framer = &recordFramer{}
+			framers[addr.String()] = framer
+		}
+		now := time.Now()
+		framer.seen = now
+		l.ingest(framer.Write(buf[:n]), "udp", addr)
+		if framer.Len() == 0 {
+			delete(framers, addr.String())
+		}
+		if now.Sub(lastEviction) > listenerIdleTimeout {
+			evictIdleFramers(framers, now)
+			lastEviction = now
+		}
+	}
+}
+
+// evictIdleFramers drops the incomplete records of the senders idle for longer than listenerIdleTimeout
+func evictIdleFramers(framers map[string]*recordFramer, now time.Time) {
+	for addr, framer := range framers {
+		if now.Sub(framer.seen) > listenerIdleTimeout {
+			fmt.Printf("Dropped %d bytes of idle udp sender %s\n", framer.Len(), addr)
+			delete(framers, addr)
+		}
+	}
+}
+
+func (l *Listener) ingest(records []byte, source string, addr net.Addr) {
+	if len(records) == 0 {
+		return
+	}
+	if _, err := l.Updater.ingestText(records, source); err != nil {
+		fmt.Printf("Unable to ingest shuttle logs from %s: %s\n", addr, err.Error())
+	}
+}
+
+// recordFramer accumulates a stream of bytes and cuts it after the record terminators
+type recordFramer struct {
+	buf bytes.Buffer
+	// time of the last data received
+	seen time.Time
+}
+
+// Write appends data to the stream and returns the complete records received so far
+func (f *recordFramer) Write(data []byte) []byte {
+	f.buf.Write(data)
+	end := bytes.LastIndex(f.buf.Bytes(), []byte(recordTerminator))
+	if end < 0 {
+		if f.buf.Len() > maxRecordBuffer {
+			fmt.Printf("Dropped %d bytes without record terminator\n", f.buf.Len())
+			f.buf.Reset()
+		}
+		return nil
+	}
+	end += len(recordTerminator)
+	records := make([]byte, end)
+	copy(records, f.buf.Next(end))
+	return records
+}
+
+// Len is the number of bytes of the incomplete record
+func (f *recordFramer) Len() int {
+	return f.buf.Len()
+}
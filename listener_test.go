@@ -0,0 +1,88 @@
+package yast
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+func testRecord(vehicleID string, second int) string {
+	return fmt.Sprintf("Vehicle ID:%s lat:42.730%d lon:-73.676 dir:90 spd:10 lck:1 time:1200%02d date:01022020 trig:0 eof\n",
+		vehicleID, second, second)
+}
+
+// listen starts a listener on the loopback and returns the channel of the stored logs
+func listen(t *testing.T, tcp, udp string) (*Listener, chan *database.ShuttleLog) {
+	db := &outageDatabase{}
+	updater := &Updater{Database: db, Buffer: NewWriteBuffer(db, 0, "", 0)}
+	logs := make(chan *database.ShuttleLog, 16)
+	updater.Subscribe(func(log *database.ShuttleLog) { logs <- log })
+	l := &Listener{TCPAddr: tcp, UDPAddr: udp, Updater: updater}
+	if err := l.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Close)
+	return l, logs
+}
+
+func receive(t *testing.T, logs chan *database.ShuttleLog, vehicleIDs ...string) {
+	for _, vehicleID := range vehicleIDs {
+		select {
+		case log := <-logs:
+			if log.VehicleID != vehicleID {
+				t.Fatalf("expected vehicle %s, got %s", vehicleID, log.VehicleID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("vehicle %s wasn't received", vehicleID)
+		}
+	}
+}
+
+func TestListenerTCP(t *testing.T) {
+	l, logs := listen(t, "127.0.0.1:0", "")
+	conn, err := net.Dial("tcp", l.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a record split across writes and two records in one write
+	record := testRecord("1", 1)
+	conn.Write([]byte(record[:20]))
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte(record[20:]))
+	conn.Write([]byte(testRecord("2", 1) + testRecord("3", 1)))
+	receive(t, logs, "1", "2", "3")
+}
+
+func TestListenerUDP(t *testing.T) {
+	l, logs := listen(t, "", "127.0.0.1:0")
+	conn, err := net.Dial("udp", l.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a record split across datagrams is reassembled
+	record := testRecord("1", 1)
+	conn.Write([]byte(record[:20]))
+	conn.Write([]byte(record[20:]))
+	conn.Write([]byte(testRecord("2", 2)))
+	receive(t, logs, "1", "2")
+}
+
+func TestEvictIdleFramers(t *testing.T) {
+	now := time.Now()
+	idle, active := &recordFramer{seen: now.Add(-2 * listenerIdleTimeout)}, &recordFramer{seen: now}
+	idle.Write([]byte("Vehicle ID:1"))
+	active.Write([]byte("Vehicle ID:2"))
+	framers := map[string]*recordFramer{"idle": idle, "active": active}
+	evictIdleFramers(framers, now)
+	if _, ok := framers["idle"]; ok {
+		t.Fatal("idle sender wasn't evicted")
+	}
+	if _, ok := framers["active"]; !ok {
+		t.Fatal("active sender was evicted")
+	}
+}
@@ -0,0 +1,176 @@
+package yast
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// RouteMatcher assigns each vehicle to the route which best fits its recent fixes. The confidence of a
+// route is the share of the recent fixes within MaxDistance of it, a new route is assigned once it has
+// been the best fit for SwitchAfter consecutive fixes.
+type RouteMatcher struct {
+	Database database.Database
+	Routes   *RouteCache
+	// number of recent fixes matched against the routes
+	Window int
+	// meters from a route for a fix to be on it
+	MaxDistance float64
+	// minimum confidence of an assignment, below it the vehicle is unassigned
+	MinConfidence float64
+	SwitchAfter   int
+
+	vehiclesLock sync.Mutex
+	vehicles     map[string]*vehicleMatch // vehicle id -> matching state
+}
+
+// vehicleMatch is the matching state of one vehicle, the workers of the pipeline only contend on their
+// own vehicles
+type vehicleMatch struct {
+	sync.Mutex
+
+	fixes []pkg.Point
+	// current assignment, loaded from the database the first time the vehicle is seen and again when
+	// any instance changes the vehicle, e.g. to assign its route manually
+	route  string
+	loaded bool
+	// best route differing from the current one and for how many fixes it has been the best
+	candidate string
+	streak    int
+}
+
+// NewRouteMatcher creates a matcher over the cached routes. By default it looks at the last 10 fixes, a fix
+// within 40 m of a route is on it, a route needs 70% of the fixes on it and switching to another route
+// takes 3 fixes.
+func NewRouteMatcher(db database.Database, routes *RouteCache, window int, maxDistance, minConfidence float64, switchAfter int) *RouteMatcher {
+	m := &RouteMatcher{Database: db, Routes: routes, Window: window, MaxDistance: maxDistance, MinConfidence: minConfidence, SwitchAfter: switchAfter}
+	if m.Window <= 0 {
+		m.Window = 10
+	}
+	if m.MaxDistance <= 0 {
+		m.MaxDistance = 40
+	}
+	if m.MinConfidence <= 0 {
+		m.MinConfidence = 0.7
+	}
+	if m.SwitchAfter <= 0 {
+		m.SwitchAfter = 3
+	}
+	return m
+}
+
+// Process sets the route of the log and records the assignment when it changes, the vehicle keeps its
+// route until the assignment is stored
+func (m *RouteMatcher) Process(log *database.ShuttleLog) ([]*database.ShuttleLog, error) {
+	v := m.vehicle(log.VehicleID)
+	v.Lock()
+	defer v.Unlock()
+	assignment := m.match(v, log)
+	log.RouteName = v.route
+	if assignment != nil {
+		if err := m.Database.AssignRoute(assignment); err != nil {
+			return nil, err
+		}
+		v.route, v.candidate, v.streak = assignment.RouteName, "", 0
+		log.RouteName = v.route
+	}
+	return []*database.ShuttleLog{log}, nil
+}
+
+// Notify loads again the assignment of a vehicle changed by any instance
+func (m *RouteMatcher) Notify(n database.Notification) {
+	if n.Channel != database.VehicleChannel {
+		return
+	}
+	v := m.vehicle(n.Key)
+	v.Lock()
+	v.loaded = false
+	v.Unlock()
+}
+
+// match updates the state of the vehicle and returns the new assignment if it changed, the lock of the
+// vehicle must be held
+func (m *RouteMatcher) match(v *vehicleMatch, log *database.ShuttleLog) *database.RouteAssignment {
+	routes := m.Routes.Routes()
+	if !v.loaded {
+		if vehicle, err := m.Database.SelectVehicle(log.VehicleID); err == nil {
+			v.route = vehicle.RouteName
+		}
+		v.loaded = true
+	}
+	v.fixes = append(v.fixes, pkg.Point{X: log.Location.X, Y: log.Location.Y})
+	if len(v.fixes) > m.Window {
+		v.fixes = v.fixes[len(v.fixes)-m.Window:]
+	}
+	// wait for enough fixes to tell the routes apart
+	if len(v.fixes) < (m.Window+1)/2 {
+		return nil
+	}
+	best, confidence := "", 0.0
+	bestOffset := 0.0
+	for _, route := range routes {
+		path := routePath(route)
+		if len(path) < 2 {
+			continue
+		}
+		near, offset := 0, 0.0
+		for _, fix := range v.fixes {
+			p := pkg.Project(path, true, fix)
+			offset += p.Offset
+			if p.Offset <= m.MaxDistance {
+				near++
+			}
+		}
+		c := float64(near) / float64(len(v.fixes))
+		offset /= float64(len(v.fixes))
+		if c > confidence || (c == confidence && c > 0 && offset < bestOffset) {
+			best, confidence, bestOffset = route.Name, c, offset
+		}
+	}
+	if confidence < m.MinConfidence {
+		best = ""
+	}
+	if best == v.route {
+		v.candidate, v.streak = "", 0
+		return nil
+	}
+	if best == v.candidate {
+		v.streak++
+	} else {
+		v.candidate, v.streak = best, 1
+	}
+	if v.streak < m.SwitchAfter {
+		return nil
+	}
+	assignedAt := log.FixTime
+	if assignedAt.IsZero() {
+		assignedAt = time.Now()
+	}
+	return &database.RouteAssignment{VehicleID: log.VehicleID, RouteName: best, Confidence: confidence, AssignedAt: assignedAt}
+}
+
+// vehicle returns the matching state of the vehicle, created the first time it's seen
+func (m *RouteMatcher) vehicle(vehicleID string) *vehicleMatch {
+	m.vehiclesLock.Lock()
+	defer m.vehiclesLock.Unlock()
+	if m.vehicles == nil {
+		m.vehicles = make(map[string]*vehicleMatch)
+	}
+	v, ok := m.vehicles[vehicleID]
+	if !ok {
+		v = &vehicleMatch{}
+		m.vehicles[vehicleID] = v
+	}
+	return v
+}
+
+// routePath converts the points of the route for the geometry functions
+func routePath(route *database.ClosedRoute) []pkg.Point {
+	path := make([]pkg.Point, len(route.RoutePoints))
+	for i, v := range route.RoutePoints {
+		path[i] = pkg.Point{X: v.X, Y: v.Y}
+	}
+	return path
+}
@@ -0,0 +1,146 @@
+package yast
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// OffRouteDetector records the vehicles staying farther than Distance from their route for at least
+// Duration, the event ends with the first fix back within Distance or when the vehicle is assigned to
+// another route. A vehicle unassigned by the matcher while off its route is still measured against it.
+// It runs after the route snapper and measures against the cached routes, detours included.
+type OffRouteDetector struct {
+	sync.Mutex
+
+	Database database.Database
+	Routes   *RouteCache
+	// meters from the route for a fix to be off it
+	Distance float64
+	// time a vehicle must stay off its route before the event is recorded
+	Duration time.Duration
+
+	vehicles map[string]*offRoute // vehicle id -> deviation
+}
+
+type offRoute struct {
+	route string
+	// time of the first fix off the route, zero while on it
+	since       time.Time
+	maxDistance float64
+	// recorded event, nil until the deviation lasted for Duration
+	event *database.OffRouteEvent
+}
+
+// NewOffRouteDetector creates a detector, by default a vehicle is off its route 50 m away from it for a
+// minute
+func NewOffRouteDetector(db database.Database, routes *RouteCache, distance float64, duration time.Duration) *OffRouteDetector {
+	d := &OffRouteDetector{Database: db, Routes: routes, Distance: distance, Duration: duration}
+	if d.Distance <= 0 {
+		d.Distance = 50
+	}
+	if d.Duration <= 0 {
+		d.Duration = time.Minute
+	}
+	return d
+}
+
+// Observe records the start or the end of the deviation of the vehicle, an unassigned vehicle is still
+// measured against the route it deviated from
+func (d *OffRouteDetector) Observe(log *database.ShuttleLog) error {
+	ended, started := d.detect(log)
+	if ended != nil {
+		if err := d.Database.UpdateOffRouteEvent(ended); err != nil {
+			return err
+		}
+	}
+	if started != nil {
+		if err := d.Database.InsertOffRouteEvent(started); err != nil {
+			d.Lock()
+			delete(d.vehicles, log.VehicleID)
+			d.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// detect updates the deviation of the vehicle and returns the events it ended and started, the farthest
+// distance of an event is recorded when it ends
+func (d *OffRouteDetector) detect(log *database.ShuttleLog) (ended, started *database.OffRouteEvent) {
+	at := log.FixTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.vehicles == nil {
+		d.vehicles = make(map[string]*offRoute)
+	}
+	v, ok := d.vehicles[log.VehicleID]
+	if !ok {
+		v = &offRoute{}
+		d.vehicles[log.VehicleID] = v
+	}
+	route := log.RouteName
+	if route == "" && !v.since.IsZero() {
+		route = v.route
+	}
+	if route != v.route {
+		// a new route ends the deviation from the previous one
+		if v.event != nil {
+			ended = v.event
+			ended.EndedAt = at
+		}
+		*v = offRoute{route: route}
+	}
+	distance, known := d.distanceTo(route, log.Location)
+	if route == "" || !known || distance <= d.Distance {
+		if v.event != nil {
+			ended = v.event
+			ended.EndedAt = at
+		}
+		*v = offRoute{route: log.RouteName}
+		return ended, nil
+	}
+	if v.since.IsZero() {
+		v.since = at
+	}
+	if distance > v.maxDistance {
+		v.maxDistance = distance
+		if v.event != nil {
+			v.event.MaxDistance = distance
+		}
+	}
+	if v.event == nil && at.Sub(v.since) >= d.Duration {
+		v.event = &database.OffRouteEvent{VehicleID: log.VehicleID, RouteName: route, StartedAt: v.since, MaxDistance: v.maxDistance}
+		started = v.event
+	}
+	return ended, started
+}
+
+// distanceTo is the distance in meters from the location to the route, false if the route is unknown
+func (d *OffRouteDetector) distanceTo(name string, location *database.Vector) (float64, bool) {
+	if name == "" || location == nil {
+		return 0, false
+	}
+	route := d.Routes.Route(name)
+	if route == nil {
+		return 0, false
+	}
+	path := routePath(route)
+	if len(path) < 2 {
+		return 0, false
+	}
+	return pkg.Project(path, true, pkg.Point{X: location.X, Y: location.Y}).Offset, true
+}
+
+// OffRoute tells whether the vehicle has been off its route for at least Duration
+func (d *OffRouteDetector) OffRoute(vehicleID string) bool {
+	d.Lock()
+	defer d.Unlock()
+	v, ok := d.vehicles[vehicleID]
+	return ok && v.event != nil
+}
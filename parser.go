@@ -0,0 +1,137 @@
+package yast
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+const (
+	// layout of the "time:" and "date:" fields of the remote feed, in UTC
+	fixTimeLayout = "150405 01022006"
+	// start of a record in the remote feed
+	recordStart = "Vehicle ID:"
+)
+
+var (
+	// fields are validated one by one to give the reason of a rejection
+	logregex = regexp.MustCompile(
+		`^Vehicle ID:(\S*) lat:(\S*) lon:(\S*) dir:(\S*) spd:(\S*) lck:(\S*) time:(\S*) date:(\S*) trig:(\S*) eof$`)
+	vehicleIDRegex = regexp.MustCompile(`^\d+$`)
+)
+
+// ParseResult is the outcome of parsing one record of the remote feed
+type ParseResult struct {
+	// line of the start of the record, starting at 1
+	Line int
+	// parsed log, nil if the record is rejected
+	Log *database.ShuttleLog
+	// reason of the rejection
+	Err error
+}
+
+// ParseShuttleLogRecords parses every record of the remote feed. The text around the records which
+// doesn't start with "Vehicle ID:" is ignored, every record gives a result.
+func ParseShuttleLogRecords(logslice []byte) []ParseResult {
+	results := []ParseResult{}
+	line := 1
+	rest := logslice
+	for len(rest) > 0 {
+		start := bytes.Index(rest, []byte(recordStart))
+		if start < 0 {
+			break
+		}
+		line += bytes.Count(rest[:start], []byte("\n"))
+		rest = rest[start:]
+		// a record ends at its terminator or at the start of the next record
+		end := bytes.Index(rest, []byte(recordTerminator))
+		if next := bytes.Index(rest[len(recordStart):], []byte(recordStart)); next >= 0 && (end < 0 || next+len(recordStart) < end) {
+			end = next + len(recordStart)
+		} else if end >= 0 {
+			end += len(recordTerminator)
+		} else {
+			end = len(rest)
+		}
+		record := rest[:end]
+		log, err := parseRecord(bytes.TrimSpace(record))
+		results = append(results, ParseResult{Line: line, Log: log, Err: err})
+		line += bytes.Count(record, []byte("\n"))
+		rest = rest[end:]
+	}
+	return results
+}
+
+// ParseShuttleLog parses the records of the remote feed. Rejected records are counted and skipped,
+// in strict mode the first rejected record fails the whole feed.
+func ParseShuttleLog(logslice []byte, strict bool) ([]database.ShuttleLog, error) {
+	start := time.Now()
+	results := ParseShuttleLogRecords(logslice)
+	pkg.Timing("stage_parse", time.Since(start))
+	if len(results) == 0 {
+		return nil, fmt.Errorf("Failed to parse the response %s", logslice)
+	}
+	rgshuttleLog := []database.ShuttleLog{}
+	for _, result := range results {
+		if result.Err != nil {
+			pkg.Count("parser_rejected", 1)
+			if strict {
+				return nil, fmt.Errorf("Rejected record at line %d: %s", result.Line, result.Err.Error())
+			}
+			fmt.Printf("Skipped record at line %d: %s\n", result.Line, result.Err.Error())
+			continue
+		}
+		rgshuttleLog = append(rgshuttleLog, *result.Log)
+	}
+	return rgshuttleLog, nil
+}
+
+// parseRecord parses a single record "Vehicle ID:... eof"
+func parseRecord(record []byte) (*database.ShuttleLog, error) {
+	fields := logregex.FindSubmatch(record)
+	if fields == nil {
+		return nil, fmt.Errorf("malformed record '%s'", record)
+	}
+	log := &database.ShuttleLog{}
+	if !vehicleIDRegex.Match(fields[1]) {
+		return nil, fmt.Errorf("invalid vehicle id '%s'", fields[1])
+	}
+	log.VehicleID = string(fields[1])
+	v := database.Vector{}
+	var err error
+	// x is the longitude and y the latitude
+	if v.Y, err = parseFloat("lat", fields[2], -90, 90); err != nil {
+		return nil, err
+	}
+	if v.X, err = parseFloat("lon", fields[3], -180, 180); err != nil {
+		return nil, err
+	}
+	if v.Angle, err = parseFloat("dir", fields[4], 0, 360); err != nil {
+		return nil, err
+	}
+	if v.Speed, err = parseFloat("spd", fields[5], 0, 1000); err != nil {
+		return nil, err
+	}
+	log.Location = &v
+	log.FixTime, err = time.Parse(fixTimeLayout, string(fields[7])+" "+string(fields[8]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid time '%s' date '%s'", fields[7], fields[8])
+	}
+	log.Status = string(fields[9])
+	return log, nil
+}
+
+func parseFloat(name string, field []byte, min, max float64) (float64, error) {
+	f, err := strconv.ParseFloat(string(field), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s'", name, field)
+	}
+	if f < min || f > max {
+		return 0, fmt.Errorf("%s %s out of range [%v, %v]", name, field, min, max)
+	}
+	return f, nil
+}
@@ -0,0 +1,69 @@
+package yast
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the parser corpus")
+
+// formatParse renders the per-record results and the outcome of both parsing modes
+func formatParse(feed []byte) []byte {
+	var out bytes.Buffer
+	for _, result := range ParseShuttleLogRecords(feed) {
+		if result.Err != nil {
+			fmt.Fprintf(&out, "line %d: rejected: %s\n", result.Line, result.Err.Error())
+			continue
+		}
+		log, v := result.Log, result.Log.Location
+		fmt.Fprintf(&out, "line %d: vehicle %s lon %g lat %g dir %g spd %g time %s stat %s\n", result.Line,
+			log.VehicleID, v.X, v.Y, v.Angle, v.Speed, log.FixTime.Format(time.RFC3339), log.Status)
+	}
+	for _, strict := range []bool{false, true} {
+		logs, err := ParseShuttleLog(feed, strict)
+		if err != nil {
+			fmt.Fprintf(&out, "strict %t: error: %s\n", strict, err.Error())
+		} else {
+			fmt.Fprintf(&out, "strict %t: %d logs\n", strict, len(logs))
+		}
+	}
+	return out.Bytes()
+}
+
+func TestParseShuttleLogCorpus(t *testing.T) {
+	feeds, err := filepath.Glob(filepath.Join("testdata", "parser", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) == 0 {
+		t.Fatal("empty parser corpus")
+	}
+	for _, feed := range feeds {
+		t.Run(filepath.Base(feed), func(t *testing.T) {
+			input, err := ioutil.ReadFile(feed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := formatParse(input)
+			golden := strings.TrimSuffix(feed, ".txt") + ".golden"
+			if *update {
+				if err = ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("parse of %s differs from %s\ngot:\n%s\nwant:\n%s", feed, golden, got, want)
+			}
+		})
+	}
+}
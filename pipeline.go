@@ -0,0 +1,108 @@
+package yast
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// stage transforms the logs of one vehicle
+type stage struct {
+	name string
+	run  func([]*database.ShuttleLog) []*database.ShuttleLog
+}
+
+// process runs the parsed logs through the pipeline: validate -> enrich -> persist -> observe -> publish.
+// validate, enrich and observe run on a bounded pool of workers, each vehicle is assigned to one worker
+// so its logs are processed in order; persist writes the whole batch in one transaction and only the
+// stored logs are observed and published.
+func (updater *Updater) process(shuttleLog []database.ShuttleLog) {
+	// batches are processed one at a time to keep the order of the logs of a vehicle
+	updater.Lock()
+	defer updater.Unlock()
+	logs := make([]*database.ShuttleLog, len(shuttleLog))
+	for i := range shuttleLog {
+		logs[i] = &shuttleLog[i]
+	}
+	logs = updater.runStages(logs, updater.stages())
+
+	start := time.Now()
+	stored := updater.Buffer.Write(logs)
+	updater.Buffer.Extend(updater.Deduplicator.Extended())
+	pkg.Timing("stage_persist", time.Since(start))
+
+	// the events are recorded from the stored logs only, a rejected log leaves nothing behind
+	updater.runStages(stored, []stage{{"observe", updater.runObservers}})
+
+	start = time.Now()
+	updater.publish(stored)
+	pkg.Timing("stage_publish", time.Since(start))
+}
+
+// stages are the per vehicle stages of the pipeline
+func (updater *Updater) stages() []stage {
+	validate := stage{"validate", func(logs []*database.ShuttleLog) []*database.ShuttleLog {
+		logs = updater.Filter.Filter(updater.Database, logs)
+		return updater.Deduplicator.Filter(logs)
+	}}
+	enrich := stage{"enrich", updater.runProcessors}
+	return []stage{validate, enrich}
+}
+
+// runStages shards the logs by vehicle over the workers and runs the stages on each shard
+func (updater *Updater) runStages(logs []*database.ShuttleLog, stages []stage) []*database.ShuttleLog {
+	workers := updater.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	shards := make([][]*database.ShuttleLog, workers)
+	for _, log := range logs {
+		h := fnv.New32a()
+		h.Write([]byte(log.VehicleID))
+		i := int(h.Sum32() % uint32(workers))
+		shards[i] = append(shards[i], log)
+	}
+	var wg sync.WaitGroup
+	for i := range shards {
+		if len(shards[i]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, s := range stages {
+				start := time.Now()
+				shards[i] = s.run(shards[i])
+				pkg.Timing("stage_"+s.name, time.Since(start))
+			}
+		}(i)
+	}
+	wg.Wait()
+	processed := []*database.ShuttleLog{}
+	for _, shard := range shards {
+		processed = append(processed, shard...)
+	}
+	return processed
+}
+
+// publish hands the logs written to the database to the subscribers, the buffered logs are published
+// once they are replayed
+func (updater *Updater) publish(logs []*database.ShuttleLog) {
+	updater.subscribersLock.RLock()
+	defer updater.subscribersLock.RUnlock()
+	for _, log := range logs {
+		for _, subscriber := range updater.subscribers {
+			subscriber(log)
+		}
+	}
+}
+
+// Subscribe registers a function called with every log stored by the pipeline
+func (updater *Updater) Subscribe(subscriber func(*database.ShuttleLog)) {
+	updater.subscribersLock.Lock()
+	defer updater.subscribersLock.Unlock()
+	updater.subscribers = append(updater.subscribers, subscriber)
+}
@@ -0,0 +1,43 @@
+package yast
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// recordingObserver records the status of the observed logs
+type recordingObserver struct {
+	observed []string
+}
+
+func (o *recordingObserver) Observe(log *database.ShuttleLog) error {
+	o.observed = append(o.observed, log.Status)
+	return nil
+}
+
+func TestUpdaterObservesStoredLogs(t *testing.T) {
+	db := &outageDatabase{down: true}
+	updater := &Updater{Database: db, Buffer: NewWriteBuffer(db, 10, "", 0)}
+	observer := &recordingObserver{}
+	updater.RegisterObserver("recorder", 0, observer)
+	logs := func(from, to int) []database.ShuttleLog {
+		batch := []database.ShuttleLog{}
+		for _, log := range bufferLogs(from, to) {
+			log.Location.X = float64(from)
+			batch = append(batch, *log)
+		}
+		return batch
+	}
+	// the buffered logs are observed once they're stored
+	updater.process(logs(1, 1))
+	if len(observer.observed) != 0 {
+		t.Fatalf("observed %v before they were stored", observer.observed)
+	}
+	db.down = false
+	updater.process(logs(2, 2))
+	if fmt.Sprint(observer.observed) != "[1 2]" {
+		t.Fatalf("expected [1 2], got %v", observer.observed)
+	}
+}
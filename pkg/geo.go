@@ -0,0 +1,147 @@
+package pkg
+
+import "math"
+
+const (
+	// EarthRadius in meters
+	EarthRadius = 6371000.0
+	// MetersPerSecondToMph converts a speed in m/s to mph
+	MetersPerSecondToMph = 2.23693629
+)
+
+// Distance returns the great circle distance in meters between two points given in degrees
+func Distance(lon1, lat1, lon2, lat2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dphi := (lat2 - lat1) * math.Pi / 180
+	dlambda := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dphi/2)*math.Sin(dphi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dlambda/2)*math.Sin(dlambda/2)
+	return 2 * EarthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Destination returns the point reached from a point given in degrees after travelling distance meters
+// along the bearing in degrees clockwise from north
+func Destination(lon, lat, bearing, distance float64) (float64, float64) {
+	phi1 := lat * math.Pi / 180
+	lambda1 := lon * math.Pi / 180
+	theta := bearing * math.Pi / 180
+	delta := distance / EarthRadius
+	phi2 := math.Asin(math.Sin(phi1)*math.Cos(delta) + math.Cos(phi1)*math.Sin(delta)*math.Cos(theta))
+	lambda2 := lambda1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(phi1), math.Cos(delta)-math.Sin(phi1)*math.Sin(phi2))
+	return lambda2 * 180 / math.Pi, phi2 * 180 / math.Pi
+}
+
+// Point is a longitude (x) and a latitude (y) in degrees
+type Point struct {
+	X float64
+	Y float64
+}
+
+// Projection is the closest point of a path to a point
+type Projection struct {
+	// closest point on the path
+	Point Point
+	// distance in meters from the start of the path to the closest point
+	Along float64
+	// distance in meters from the point to the path
+	Offset float64
+	// length of the path in meters
+	Length float64
+}
+
+// PathLength returns the length in meters of the path, a closed path goes back to its first point
+func PathLength(path []Point, closed bool) float64 {
+	length := 0.0
+	forEachSegment(path, closed, func(a, b Point) {
+		length += Distance(a.X, a.Y, b.X, b.Y)
+	})
+	return length
+}
+
+// Project finds the closest point of the path to p, a closed path goes back to its first point.
+// Segments are projected on a plane tangent at p which is accurate at the scale of a city.
+func Project(path []Point, closed bool, p Point) Projection {
+	best := Projection{Offset: math.Inf(1)}
+	along := 0.0
+	if len(path) == 1 {
+		return Projection{Point: path[0], Offset: Distance(p.X, p.Y, path[0].X, path[0].Y)}
+	}
+	forEachSegment(path, closed, func(a, b Point) {
+		ax, ay := ToPlane(p, a)
+		bx, by := ToPlane(p, b)
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if l := dx*dx + dy*dy; l > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+		}
+		x, y := ax+t*dx, ay+t*dy
+		segment := Distance(a.X, a.Y, b.X, b.Y)
+		if offset := math.Hypot(x, y); offset < best.Offset {
+			best.Point = Point{a.X + t*(b.X-a.X), a.Y + t*(b.Y-a.Y)}
+			best.Along = along + t*segment
+			best.Offset = offset
+		}
+		along += segment
+	})
+	best.Length = along
+	return best
+}
+
+// PointAt returns the point of the path at the distance in meters from its start, the distance wraps
+// around a closed path and is clamped to the ends of an open one
+func PointAt(path []Point, closed bool, along float64) Point {
+	if len(path) == 0 {
+		return Point{}
+	}
+	if closed {
+		if length := PathLength(path, closed); length > 0 {
+			along = math.Mod(along, length)
+			if along < 0 {
+				along += length
+			}
+		}
+	}
+	result := path[0]
+	if along <= 0 {
+		return result
+	}
+	done := false
+	forEachSegment(path, closed, func(a, b Point) {
+		if done {
+			return
+		}
+		segment := Distance(a.X, a.Y, b.X, b.Y)
+		if along <= segment && segment > 0 {
+			t := along / segment
+			result = Point{a.X + t*(b.X-a.X), a.Y + t*(b.Y-a.Y)}
+			done = true
+			return
+		}
+		along -= segment
+		result = b
+	})
+	return result
+}
+
+func forEachSegment(path []Point, closed bool, f func(a, b Point)) {
+	for i := 1; i < len(path); i++ {
+		f(path[i-1], path[i])
+	}
+	if closed && len(path) > 2 {
+		f(path[len(path)-1], path[0])
+	}
+}
+
+// ToPlane maps q to meters east and north on the plane tangent at origin
+func ToPlane(origin, q Point) (float64, float64) {
+	x := (q.X - origin.X) * math.Pi / 180 * EarthRadius * math.Cos(origin.Y*math.Pi/180)
+	y := (q.Y - origin.Y) * math.Pi / 180 * EarthRadius
+	return x, y
+}
+
+// FromPlane maps meters east and north on the plane tangent at origin back to a point
+func FromPlane(origin Point, x, y float64) Point {
+	lon := origin.X + x/(EarthRadius*math.Cos(origin.Y*math.Pi/180))*180/math.Pi
+	lat := origin.Y + y/EarthRadius*180/math.Pi
+	return Point{lon, lat}
+}
@@ -0,0 +1,27 @@
+package pkg
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics holds the counters of the server, published on /debug/vars
+var Metrics = expvar.NewMap("yast")
+
+// Count adds delta to the counter of the name
+func Count(name string, delta int64) {
+	Metrics.Add(name, delta)
+}
+
+// Gauge sets the current value of the name
+func Gauge(name string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	Metrics.Set(name, v)
+}
+
+// Timing records a duration under the name, as a count and a total in microseconds
+func Timing(name string, d time.Duration) {
+	Metrics.Add(name+"_count", 1)
+	Metrics.Add(name+"_us", d.Nanoseconds()/1000)
+}
@@ -0,0 +1,95 @@
+package yast
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// LogProcessor sees every shuttle log accepted by the updater before it's stored. It can enrich the
+// log, drop it by returning no log, or fan it out by returning several logs. It doesn't write to the
+// database, except the route matcher recording the assignment which the log refers to.
+// Process is called concurrently for different vehicles, the logs of one vehicle are processed in order.
+type LogProcessor interface {
+	Process(*database.ShuttleLog) ([]*database.ShuttleLog, error)
+}
+
+// LogObserver sees every shuttle log once it's stored and records the events the log reveals, such as
+// the arrivals at the stops. It doesn't change the log.
+// Observe is called concurrently for different vehicles, the logs of one vehicle are observed in order.
+type LogObserver interface {
+	Observe(*database.ShuttleLog) error
+}
+
+// order of the built-in processors and observers
+const (
+	orderSmoother         = 0
+	orderRouteMatcher     = 10
+	orderRouteSnapper     = 20
+	orderOffRouteDetector = 25
+	orderStopDetector     = 30
+	orderHeadwayMonitor   = 40
+	orderStateMachine     = 50
+)
+
+type registeredProcessor struct {
+	name      string
+	order     int
+	processor LogProcessor
+}
+
+// RegisterProcessor adds a processor to the enrich stage, processors run by increasing order then
+// by registration. It must be called before the updater runs.
+func (updater *Updater) RegisterProcessor(name string, order int, processor LogProcessor) {
+	updater.processors = append(updater.processors, registeredProcessor{name, order, processor})
+	sort.SliceStable(updater.processors, func(i, j int) bool {
+		return updater.processors[i].order < updater.processors[j].order
+	})
+}
+
+type registeredObserver struct {
+	name     string
+	order    int
+	observer LogObserver
+}
+
+// RegisterObserver adds an observer to the observe stage, observers run by increasing order then by
+// registration. It must be called before the updater runs.
+func (updater *Updater) RegisterObserver(name string, order int, observer LogObserver) {
+	updater.observers = append(updater.observers, registeredObserver{name, order, observer})
+	sort.SliceStable(updater.observers, func(i, j int) bool {
+		return updater.observers[i].order < updater.observers[j].order
+	})
+}
+
+// runProcessors passes the logs through the registered processors in order, a log is kept
+// unchanged by a processor failing on it
+func (updater *Updater) runProcessors(logs []*database.ShuttleLog) []*database.ShuttleLog {
+	for _, p := range updater.processors {
+		processed := []*database.ShuttleLog{}
+		for _, log := range logs {
+			out, err := p.processor.Process(log)
+			if err != nil {
+				fmt.Printf("Processor %s failed on vehicle %s: %s\n", p.name, log.VehicleID, err.Error())
+				out = []*database.ShuttleLog{log}
+			}
+			processed = append(processed, out...)
+		}
+		logs = processed
+	}
+	return logs
+}
+
+// runObservers passes the stored logs to the registered observers in order, an observer failing on a log
+// doesn't stop the others
+func (updater *Updater) runObservers(logs []*database.ShuttleLog) []*database.ShuttleLog {
+	for _, log := range logs {
+		for _, o := range updater.observers {
+			if err := o.observer.Observe(log); err != nil {
+				fmt.Printf("Observer %s failed on vehicle %s: %s\n", o.name, log.VehicleID, err.Error())
+			}
+		}
+	}
+	return logs
+}
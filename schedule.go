@@ -0,0 +1,139 @@
+package yast
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/api"
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// ScheduleMatcher matches the arrivals at the stops to the closest scheduled visit of a trip of the route.
+// A vehicle keeps running its trip: its next visits of the trip win over the visits of the other trips,
+// and each visit is made by one arrival only.
+type ScheduleMatcher struct {
+	sync.Mutex
+
+	Database database.Database
+	// time zone of the schedules
+	Location *time.Location
+	// arrivals further than this from every scheduled visit are unscheduled
+	Window time.Duration
+
+	days     timedCache                // serviceDay -> trips
+	vehicles map[string]scheduledVisit // vehicle id -> last visit made
+	visits   map[scheduledVisit]bool   // visits already made
+}
+
+type serviceDay struct {
+	route string
+	day   time.Time
+}
+
+// scheduledVisit is a stop time of a trip on a service day
+type scheduledVisit struct {
+	trip     string
+	day      time.Time
+	sequence int
+}
+
+// NewScheduleMatcher creates a matcher, by default the schedules are in UTC and an arrival is matched to
+// a visit scheduled at most 30 minutes away
+func NewScheduleMatcher(db database.Database, location *time.Location, window time.Duration) *ScheduleMatcher {
+	m := &ScheduleMatcher{Database: db, Location: location, Window: window}
+	if m.Location == nil {
+		m.Location = time.UTC
+	}
+	if m.Window <= 0 {
+		m.Window = 30 * time.Minute
+	}
+	return m
+}
+
+// Match sets the scheduled visit of the arrival and its deviation, if any. It returns a function which
+// makes the visit available again, for an arrival that couldn't be stored.
+func (m *ScheduleMatcher) Match(event *database.StopEvent) (undo func()) {
+	undo = func() {}
+	if event.RouteName == "" {
+		return undo
+	}
+	today := api.ServiceDay(event.ArrivedAt, m.Location)
+	yesterday := today.AddDate(0, 0, -1)
+	// forget the past days
+	m.days.forget(func(key interface{}) bool {
+		return key.(serviceDay).day.Before(yesterday)
+	})
+	m.Lock()
+	defer m.Unlock()
+	if m.vehicles == nil {
+		m.vehicles = make(map[string]scheduledVisit)
+		m.visits = make(map[scheduledVisit]bool)
+	}
+	for visit := range m.visits {
+		if visit.day.Before(yesterday) {
+			delete(m.visits, visit)
+		}
+	}
+	last, running := m.vehicles[event.VehicleID]
+	var best scheduledVisit
+	found, bestNext, bestAbs := false, false, time.Duration(0)
+	// the trips of the previous service day may run past midnight
+	for _, midnight := range []time.Time{yesterday, today} {
+		for _, trip := range m.loadTrips(event.RouteName, midnight) {
+			for _, st := range trip.StopTimes {
+				visit := scheduledVisit{trip.TripID, midnight, st.Sequence}
+				if st.StopID != event.StopID || m.visits[visit] {
+					continue
+				}
+				scheduled := api.ScheduledAt(midnight, st.Arrival)
+				deviation := event.ArrivedAt.Sub(scheduled)
+				abs := absDuration(deviation)
+				if abs > m.Window {
+					continue
+				}
+				next := running && last.trip == visit.trip && last.day.Equal(visit.day) && visit.sequence > last.sequence
+				if !found || (next && !bestNext) || (next == bestNext && abs < bestAbs) {
+					best, found, bestNext, bestAbs = visit, true, next, abs
+					event.TripID, event.ScheduledAt, event.Deviation = trip.TripID, scheduled, deviation
+				}
+			}
+		}
+	}
+	if !found {
+		return undo
+	}
+	m.visits[best] = true
+	m.vehicles[event.VehicleID] = best
+	return func() {
+		m.Lock()
+		defer m.Unlock()
+		delete(m.visits, best)
+		if running {
+			m.vehicles[event.VehicleID] = last
+		} else {
+			delete(m.vehicles, event.VehicleID)
+		}
+	}
+}
+
+// loadTrips returns the trips of the route running on the service day
+func (m *ScheduleMatcher) loadTrips(route string, midnight time.Time) []*database.Trip {
+	trips, err := m.days.get(serviceDay{route, midnight}, func() (interface{}, error) {
+		return api.TripsOn(m.Database, route, midnight)
+	})
+	if err != nil {
+		fmt.Printf("Unable to load the schedule of route %s: %s\n", route, err.Error())
+	}
+	if trips == nil {
+		return nil
+	}
+	return trips.([]*database.Trip)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
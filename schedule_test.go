@@ -0,0 +1,76 @@
+package yast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// scheduleRoute inserts the route with stops a and b and the trips running every day
+func scheduleRoute(t *testing.T, db *database.MockDatabase, trips map[string][2]time.Duration) {
+	squareRoute(db, map[string][2]float64{"a": {0.003, 0}, "b": {0.007, 0}})
+	calendar := &database.ServiceCalendar{ServiceID: "daily", Weekdays: [7]bool{true, true, true, true, true, true, true}}
+	if err := db.UpsertCalendar(calendar); err != nil {
+		t.Fatal(err)
+	}
+	scheduled := []*database.Trip{}
+	for id, times := range trips {
+		scheduled = append(scheduled, &database.Trip{TripID: id, RouteName: "loop", ServiceID: "daily", StopTimes: []*database.StopTime{
+			{StopID: "a", Sequence: 0, Arrival: times[0], Departure: times[0]},
+			{StopID: "b", Sequence: 1, Arrival: times[1], Departure: times[1]},
+		}})
+	}
+	if err := db.InsertTrips("loop", scheduled); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduleMatcherFollowsTrips(t *testing.T) {
+	db := &database.MockDatabase{}
+	db.Open()
+	scheduleRoute(t, db, map[string][2]time.Duration{
+		"early": {12 * time.Hour, 12*time.Hour + 5*time.Minute},
+		"late":  {12*time.Hour + 3*time.Minute, 12*time.Hour + 8*time.Minute},
+	})
+	m := NewScheduleMatcher(db, time.UTC, 10*time.Minute)
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	arrivals := []struct {
+		vehicle, stop string
+		at            time.Duration
+		trip          string
+	}{
+		{"v1", "a", 12*time.Hour + time.Minute, "early"},
+		// closer to the late trip but v1 runs the early one
+		{"v1", "b", 12*time.Hour + 7*time.Minute + 30*time.Second, "early"},
+		// closer to the early trip but its visit of a was made by v1
+		{"v2", "a", 12*time.Hour + time.Minute, "late"},
+		// no visit left
+		{"v3", "a", 12*time.Hour + 2*time.Minute, ""},
+	}
+	for _, a := range arrivals {
+		event := &database.StopEvent{StopID: a.stop, VehicleID: a.vehicle, RouteName: "loop", ArrivedAt: day.Add(a.at)}
+		m.Match(event)
+		if event.TripID != a.trip {
+			t.Errorf("%s at %s: got trip %q, want %q", a.vehicle, a.stop, event.TripID, a.trip)
+		}
+	}
+}
+
+func TestScheduleMatcherDaylightSaving(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	db := &database.MockDatabase{}
+	db.Open()
+	scheduleRoute(t, db, map[string][2]time.Duration{"morning": {8 * time.Hour, 8*time.Hour + 5*time.Minute}})
+	m := NewScheduleMatcher(db, location, 10*time.Minute)
+	// the clocks go forward at 2:00 on March 8 2020, 8:00 is 7 hours after midnight
+	event := &database.StopEvent{StopID: "a", VehicleID: "v1", RouteName: "loop",
+		ArrivedAt: time.Date(2020, 3, 8, 8, 0, 0, 0, location)}
+	m.Match(event)
+	if event.TripID != "morning" || event.Deviation != 0 {
+		t.Errorf("got trip %q deviation %s, want morning on time", event.TripID, event.Deviation)
+	}
+}
@@ -0,0 +1,118 @@
+package yast
+
+import (
+	"math"
+	"sync"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+const (
+	// variance of a GPS fix in m^2
+	fixVariance = 100.0
+	// variance of the acceleration of a vehicle in (m/s^2)^2, how fast the estimated velocity may change
+	accelerationVariance = 1.0
+	// variance of the velocity reported with the first fix in (m/s)^2
+	initialVelocityVariance = 25.0
+)
+
+// Smoother applies a Kalman filter to the positions of each vehicle to reduce the GPS jitter. The state
+// of a vehicle is its position and velocity on a plane tangent at its first fix, so a moving vehicle
+// isn't pulled back towards its previous position.
+type Smoother struct {
+	sync.Mutex
+
+	states map[string]*kalmanState // vehicle id -> filter state, guarded by the smoother lock
+}
+
+// kalmanState is the filter of one vehicle, the workers of the pipeline only contend on their own vehicles
+type kalmanState struct {
+	sync.Mutex
+
+	log    *database.ShuttleLog // last filtered log, nil until the first fix
+	origin pkg.Point            // point of tangency of the plane
+	x, y   kalmanAxis           // east and north axes in meters, independent of each other
+}
+
+// kalmanAxis is the estimated position and velocity along one axis with their covariance
+type kalmanAxis struct {
+	position, velocity float64
+	p                  [2][2]float64
+}
+
+// Process replaces the location of the log by the filtered estimate
+func (s *Smoother) Process(log *database.ShuttleLog) ([]*database.ShuttleLog, error) {
+	state := s.vehicle(log.VehicleID)
+	state.Lock()
+	defer state.Unlock()
+	if state.log == nil || log.FixTime.IsZero() || !log.FixTime.After(state.log.FixTime) {
+		state.reset(log)
+		return []*database.ShuttleLog{log}, nil
+	}
+	elapsed := log.FixTime.Sub(state.log.FixTime).Seconds()
+	x, y := pkg.ToPlane(state.origin, pkg.Point{X: log.Location.X, Y: log.Location.Y})
+	state.x.predict(elapsed)
+	state.y.predict(elapsed)
+	state.x.update(x)
+	state.y.update(y)
+	p := pkg.FromPlane(state.origin, state.x.position, state.y.position)
+	location := *log.Location
+	location.X, location.Y = p.X, p.Y
+	log.Location = &location
+	state.log = log
+	return []*database.ShuttleLog{log}, nil
+}
+
+// vehicle returns the filter of the vehicle, created the first time it's seen
+func (s *Smoother) vehicle(vehicleID string) *kalmanState {
+	s.Lock()
+	defer s.Unlock()
+	if s.states == nil {
+		s.states = make(map[string]*kalmanState)
+	}
+	state, ok := s.states[vehicleID]
+	if !ok {
+		state = &kalmanState{}
+		s.states[vehicleID] = state
+	}
+	return state
+}
+
+// reset starts the filter at the fix, moving at its reported speed and heading
+func (state *kalmanState) reset(log *database.ShuttleLog) {
+	speed := log.Location.Speed / pkg.MetersPerSecondToMph
+	heading := log.Location.Angle * math.Pi / 180
+	state.log, state.origin = log, pkg.Point{X: log.Location.X, Y: log.Location.Y}
+	state.x = kalmanAxis{velocity: speed * math.Sin(heading)}
+	state.y = kalmanAxis{velocity: speed * math.Cos(heading)}
+	for _, axis := range []*kalmanAxis{&state.x, &state.y} {
+		axis.p = [2][2]float64{{fixVariance, 0}, {0, initialVelocityVariance}}
+	}
+}
+
+// predict moves the estimate dt seconds ahead at constant velocity, the covariance grows with a
+// random acceleration
+func (a *kalmanAxis) predict(dt float64) {
+	a.position += a.velocity * dt
+	p := a.p
+	dt2, dt3, dt4 := dt*dt, dt*dt*dt, dt*dt*dt*dt
+	a.p[0][0] = p[0][0] + dt*(p[0][1]+p[1][0]) + dt2*p[1][1] + dt4/4*accelerationVariance
+	a.p[0][1] = p[0][1] + dt*p[1][1] + dt3/2*accelerationVariance
+	a.p[1][0] = p[1][0] + dt*p[1][1] + dt3/2*accelerationVariance
+	a.p[1][1] = p[1][1] + dt2*accelerationVariance
+}
+
+// update corrects the estimate with a measured position
+func (a *kalmanAxis) update(z float64) {
+	p := a.p
+	s := p[0][0] + fixVariance
+	k0, k1 := p[0][0]/s, p[1][0]/s
+	residual := z - a.position
+	a.position += k0 * residual
+	a.velocity += k1 * residual
+	a.p[0][0] = (1 - k0) * p[0][0]
+	a.p[0][1] = (1 - k0) * p[0][1]
+	a.p[1][0] = p[1][0] - k1*p[0][0]
+	a.p[1][1] = p[1][1] - k1*p[0][1]
+}
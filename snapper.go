@@ -0,0 +1,40 @@
+package yast
+
+import (
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// RouteSnapper projects the fixes of the vehicles assigned to a route onto the route. It runs after the
+// route matcher when the routes are matched, the vehicles assigned manually are snapped to their stored
+// route either way.
+type RouteSnapper struct {
+	Routes *RouteCache
+}
+
+// Process sets the route of the log to the stored assignment of the vehicle if the matcher didn't set
+// it, then the snapped location and the distance along the route
+func (snapper *RouteSnapper) Process(log *database.ShuttleLog) ([]*database.ShuttleLog, error) {
+	log.Snapped, log.RouteDistance = nil, 0
+	if log.RouteName == "" {
+		// without the route matching the log takes the route stored for the vehicle
+		if vehicle := snapper.Routes.Vehicle(log.VehicleID); vehicle != nil {
+			log.RouteName = vehicle.RouteName
+		}
+	}
+	if log.RouteName == "" {
+		return []*database.ShuttleLog{log}, nil
+	}
+	route := snapper.Routes.Route(log.RouteName)
+	if route == nil {
+		return []*database.ShuttleLog{log}, nil
+	}
+	path := routePath(route)
+	if len(path) < 2 {
+		return []*database.ShuttleLog{log}, nil
+	}
+	p := pkg.Project(path, true, pkg.Point{X: log.Location.X, Y: log.Location.Y})
+	log.Snapped = &database.Vector{X: p.Point.X, Y: p.Point.Y, Angle: log.Location.Angle, Speed: log.Location.Speed}
+	log.RouteDistance = p.Along
+	return []*database.ShuttleLog{log}, nil
+}
@@ -0,0 +1,258 @@
+package yast
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// StopDetector records the arrivals and departures of the vehicles at the stops of their route. A vehicle
+// arrives at a stop with its first fix within Radius of the stop and departs with its first fix farther
+// than ExitRadius, or when its route changes. A stop passed between two fixes without any of them within
+// Radius is recorded as a visit without dwell, at the time interpolated along the route.
+type StopDetector struct {
+	sync.Mutex
+
+	Database database.Database
+	Routes   *RouteCache
+	// meters from a stop to arrive at it
+	Radius float64
+	// meters from a stop to depart from it, larger than Radius so that noise doesn't split a visit
+	ExitRadius float64
+	// compares the arrivals to the schedule, nil to ignore the schedule
+	Schedule *ScheduleMatcher
+
+	vehicles  map[string]*database.StopEvent // vehicle id -> current visit
+	positions map[string]*routePosition      // vehicle id -> last snapped fix
+}
+
+// routePosition is where a vehicle was along its route
+type routePosition struct {
+	route string
+	along float64
+	at    time.Time
+}
+
+// NewStopDetector creates a detector over the cached stops, by default a vehicle arrives within 30 m of
+// a stop and departs 1.5 times farther
+func NewStopDetector(db database.Database, routes *RouteCache, radius, exitRadius float64) *StopDetector {
+	d := &StopDetector{Database: db, Routes: routes, Radius: radius, ExitRadius: exitRadius}
+	if d.Radius <= 0 {
+		d.Radius = 30
+	}
+	if d.ExitRadius < d.Radius {
+		d.ExitRadius = d.Radius * 1.5
+	}
+	return d
+}
+
+// Observe records the departure, the stops passed since the previous fix and the arrival of the vehicle
+// in one transaction. The arrivals are matched to the schedule before they're stored. If they can't be
+// stored, the detector and the schedule are rolled back so that the next log detects them again.
+func (d *StopDetector) Observe(log *database.ShuttleLog) error {
+	departure, passed, arrival, previous := d.detect(log)
+	arrivals := passed
+	if arrival != nil {
+		arrivals = append(arrivals, arrival)
+	}
+	if departure == nil && len(arrivals) == 0 {
+		return nil
+	}
+	undo := []func(){}
+	if d.Schedule != nil {
+		for _, event := range arrivals {
+			undo = append(undo, d.Schedule.Match(event))
+		}
+	}
+	if err := d.Database.RecordStopEvents(departure, arrivals); err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		d.rollback(log.VehicleID, previous)
+		return err
+	}
+	return nil
+}
+
+// detectorState is the state of a vehicle before a log, to roll back to
+type detectorState struct {
+	visit    *database.StopEvent
+	position *routePosition
+}
+
+// rollback restores the visit and the position of the vehicle
+func (d *StopDetector) rollback(vehicleID string, previous detectorState) {
+	d.Lock()
+	defer d.Unlock()
+	if visit := previous.visit; visit != nil {
+		visit.DepartedAt, visit.Dwell = time.Time{}, 0
+		d.vehicles[vehicleID] = visit
+	} else {
+		delete(d.vehicles, vehicleID)
+	}
+	if previous.position != nil {
+		d.positions[vehicleID] = previous.position
+	} else {
+		delete(d.positions, vehicleID)
+	}
+}
+
+// detect updates the visit of the vehicle and returns the visit it ended, the stops it passed, the
+// visit it started and the state before the log. The passes are visits without dwell.
+func (d *StopDetector) detect(log *database.ShuttleLog) (departure *database.StopEvent, passed []*database.StopEvent, arrival *database.StopEvent, previous detectorState) {
+	at := log.FixTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.vehicles == nil {
+		d.vehicles = make(map[string]*database.StopEvent)
+		d.positions = make(map[string]*routePosition)
+	}
+	stops := d.Routes.Stops(log.RouteName)
+	visit, visiting := d.vehicles[log.VehicleID]
+	previous = detectorState{visit, d.positions[log.VehicleID]}
+	if visiting {
+		stop := findStop(stops, visit.StopID)
+		if visit.RouteName == log.RouteName && stop != nil && distanceTo(log, stop) <= d.ExitRadius {
+			d.move(log, at)
+			return nil, nil, nil, previous
+		}
+		delete(d.vehicles, log.VehicleID)
+		visit.DepartedAt = at
+		visit.Dwell = at.Sub(visit.ArrivedAt)
+		departure = visit
+	}
+	var nearest *database.Stop
+	for _, stop := range stops {
+		distance := distanceTo(log, stop)
+		if distance <= d.Radius && (nearest == nil || distance < distanceTo(log, nearest)) {
+			nearest = stop
+		}
+	}
+	for _, stop := range d.crossed(log, at, stops) {
+		if (visiting && stop.stop.StopID == visit.StopID) || (nearest != nil && stop.stop.StopID == nearest.StopID) {
+			continue
+		}
+		passed = append(passed, &database.StopEvent{StopID: stop.stop.StopID, VehicleID: log.VehicleID,
+			RouteName: log.RouteName, ArrivedAt: stop.at, DepartedAt: stop.at})
+	}
+	d.move(log, at)
+	if nearest == nil {
+		return departure, passed, nil, previous
+	}
+	arrival = &database.StopEvent{StopID: nearest.StopID, VehicleID: log.VehicleID, RouteName: log.RouteName, ArrivedAt: at}
+	d.vehicles[log.VehicleID] = arrival
+	return departure, passed, arrival, previous
+}
+
+// crossed returns the stops of the route between the previous snapped fix of the vehicle and the log, in
+// the order they were passed
+func (d *StopDetector) crossed(log *database.ShuttleLog, at time.Time, stops []*database.Stop) []crossedStop {
+	last, ok := d.positions[log.VehicleID]
+	if !ok || log.Snapped == nil || last.route != log.RouteName || !at.After(last.at) {
+		return nil
+	}
+	route := d.Routes.Route(log.RouteName)
+	if route == nil {
+		return nil
+	}
+	path := routePath(route)
+	if len(path) < 2 {
+		return nil
+	}
+	crossed, _ := crossStops(alongRoute(path, stops, d.ExitRadius), pkg.PathLength(path, true), last.along, last.at,
+		log.RouteDistance, at)
+	return crossed
+}
+
+// move records the snapped position of the vehicle to find the stops crossed by its next fix
+func (d *StopDetector) move(log *database.ShuttleLog, at time.Time) {
+	if log.Snapped == nil {
+		delete(d.positions, log.VehicleID)
+		return
+	}
+	d.positions[log.VehicleID] = &routePosition{log.RouteName, log.RouteDistance, at}
+}
+
+// stopAlong is a stop with its distance along the route
+type stopAlong struct {
+	stop  *database.Stop
+	along float64
+}
+
+// crossedStop is a stop passed between two fixes
+type crossedStop struct {
+	stop *database.Stop
+	at   time.Time
+}
+
+// alongRoute projects on the route the stops within maxOffset meters of it
+func alongRoute(path []pkg.Point, stops []*database.Stop, maxOffset float64) []stopAlong {
+	along := []stopAlong{}
+	for _, stop := range stops {
+		p := pkg.Project(path, true, pkg.Point{X: stop.Location.X, Y: stop.Location.Y})
+		if p.Offset <= maxOffset {
+			along = append(along, stopAlong{stop, p.Along})
+		}
+	}
+	return along
+}
+
+// crossStops returns the stops passed moving forward on a closed route of the given length from a distance
+// along it at a time to another, in the order they were passed. The times of the stops are interpolated
+// along the route. A vehicle moving back passes none, it's false if the vehicle moved over half of the
+// route and the stops it passed are unknown.
+func crossStops(stops []stopAlong, length, fromAlong float64, from time.Time, toAlong float64, to time.Time) ([]crossedStop, bool) {
+	traveled := toAlong - fromAlong
+	if traveled < -length/2 {
+		// across the end of the route
+		traveled += length
+	}
+	if traveled <= 0 {
+		return nil, true
+	}
+	if traveled > length/2 {
+		return nil, false
+	}
+	crossed := []crossedStop{}
+	for _, stop := range stops {
+		ahead := stop.along - fromAlong
+		if ahead < 0 {
+			ahead += length
+		}
+		if ahead <= 0 || ahead > traveled {
+			continue
+		}
+		elapsed := time.Duration(float64(to.Sub(from)) * ahead / traveled)
+		crossed = append(crossed, crossedStop{stop.stop, from.Add(elapsed)})
+	}
+	sort.Slice(crossed, func(i, j int) bool { return crossed[i].at.Before(crossed[j].at) })
+	return crossed, true
+}
+
+func findStop(stops []*database.Stop, stopID string) *database.Stop {
+	for _, stop := range stops {
+		if stop.StopID == stopID {
+			return stop
+		}
+	}
+	return nil
+}
+
+// distanceTo returns the distance in meters from the raw location of the log to the stop
+func distanceTo(log *database.ShuttleLog, stop *database.Stop) float64 {
+	return pkg.Distance(log.Location.X, log.Location.Y, stop.Location.X, stop.Location.Y)
+}
+
+// AtStop tells whether the vehicle is currently visiting a stop
+func (d *StopDetector) AtStop(vehicleID string) bool {
+	d.Lock()
+	defer d.Unlock()
+	_, ok := d.vehicles[vehicleID]
+	return ok
+}
@@ -0,0 +1,113 @@
+package yast
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// squareRoute inserts a closed route around a square of about 1.1 km and stops along its sides
+func squareRoute(db *database.MockDatabase, stops map[string][2]float64) {
+	route := &database.ClosedRoute{Name: "loop", RoutePoints: []*database.Vector{
+		{X: 0, Y: 0}, {X: 0.01, Y: 0}, {X: 0.01, Y: 0.01}, {X: 0, Y: 0.01},
+	}}
+	db.InsertClosedRoute(route)
+	for id, p := range stops {
+		db.InsertStop(&database.Stop{StopID: id, Route: route, Location: &database.Vector{X: p[0], Y: p[1]}})
+	}
+}
+
+func TestStopDetectorPassThrough(t *testing.T) {
+	db := &database.MockDatabase{}
+	db.Open()
+	squareRoute(db, map[string][2]float64{"a": {0.003, 0.0001}, "b": {0.006, 0}, "c": {0.0001, 0.005}})
+	routes := &RouteCache{Database: db}
+	snapper := &RouteSnapper{Routes: routes}
+	detector := NewStopDetector(db, routes, 30, 45)
+	start := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	// a is passed between two fixes, b is visited, c is passed after going around the corners
+	fixes := [][2]float64{{0.001, 0}, {0.0045, 0}, {0.006, 0.0001}, {0.0095, 0}, {0.01, 0.008}, {0, 0.009}, {0, 0.001}}
+	for i, fix := range fixes {
+		log := &database.ShuttleLog{VehicleID: "v1", RouteName: "loop", FixTime: start.Add(time.Duration(i) * time.Minute),
+			Location: &database.Vector{X: fix[0], Y: fix[1]}}
+		snapper.Process(log)
+		if err := detector.Observe(log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []struct {
+		stop  string
+		dwell time.Duration
+	}{{"a", 0}, {"b", time.Minute}, {"c", 0}}
+	if len(db.StopEvents) != len(want) {
+		t.Fatalf("got %d stop events, want %d", len(db.StopEvents), len(want))
+	}
+	for i, w := range want {
+		e := db.StopEvents[i]
+		if e.StopID != w.stop || e.Dwell != w.dwell {
+			t.Errorf("event %d: got stop %s dwell %s, want stop %s dwell %s", i, e.StopID, e.Dwell, w.stop, w.dwell)
+		}
+		if e.DepartedAt.IsZero() {
+			t.Errorf("event %d: no departure", i)
+		}
+	}
+	// a is about halfway between the first two fixes
+	if at := db.StopEvents[0].ArrivedAt; at.Before(start.Add(20*time.Second)) || at.After(start.Add(50*time.Second)) {
+		t.Errorf("passed a at %s, want about 30s after %s", at, start)
+	}
+}
+
+// failingStopEvents fails to record the stop events while down
+type failingStopEvents struct {
+	*database.MockDatabase
+
+	down bool
+}
+
+func (db *failingStopEvents) RecordStopEvents(departure *database.StopEvent, arrivals []*database.StopEvent) error {
+	if db.down {
+		return errors.New("database is down")
+	}
+	return db.MockDatabase.RecordStopEvents(departure, arrivals)
+}
+
+func TestStopDetectorRollback(t *testing.T) {
+	mock := &database.MockDatabase{}
+	mock.Open()
+	squareRoute(mock, map[string][2]float64{"a": {0.003, 0}, "b": {0.006, 0}})
+	db := &failingStopEvents{MockDatabase: mock}
+	routes := &RouteCache{Database: db}
+	snapper := &RouteSnapper{Routes: routes}
+	detector := NewStopDetector(db, routes, 30, 45)
+	start := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	observe := func(i int, x float64) error {
+		log := &database.ShuttleLog{VehicleID: "v1", RouteName: "loop", FixTime: start.Add(time.Duration(i) * time.Minute),
+			Location: &database.Vector{X: x, Y: 0}}
+		snapper.Process(log)
+		return detector.Observe(log)
+	}
+	// arrives at a, then departs, passes b and arrives nowhere while the database is down
+	if err := observe(0, 0.003); err != nil {
+		t.Fatal(err)
+	}
+	db.down = true
+	if err := observe(1, 0.008); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if !detector.AtStop("v1") {
+		t.Fatal("the visit of a was dropped")
+	}
+	// the next log detects them again
+	db.down = false
+	if err := observe(2, 0.009); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.StopEvents) != 2 || mock.StopEvents[1].StopID != "b" || mock.StopEvents[1].DepartedAt.IsZero() {
+		t.Fatalf("expected the visit of a and the pass of b, got %d events", len(mock.StopEvents))
+	}
+	if departed := mock.StopEvents[0].DepartedAt; !departed.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("departed a at %s, want %s", departed, start.Add(2*time.Minute))
+	}
+}
@@ -0,0 +1,261 @@
+package yast
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+	"github.com/keyboardnerd/yastserver/pkg"
+)
+
+// TravelTimeModel learns the usual travel times between consecutive stops from the shuttle logs, bucketed
+// by day of the week and hour. A travel goes from the arrival at a stop to the arrival at the next one, so
+// the dwell at the stops is part of the predictions. The leader samples the travels from the logs stored
+// since its last run, the whole History the first time, and rebuilds the model in the database
+// periodically. Every instance reads it to predict the arrivals.
+type TravelTimeModel struct {
+	Database database.Database
+	// only the leader rebuilds the model, nil if this instance is the only one
+	Elector *Elector
+	// time between two rebuilds of the model
+	Interval time.Duration
+	// age of the oldest shuttle logs used
+	History time.Duration
+	// time zone of the buckets
+	Location *time.Location
+	// samples required to use a bucket, fewer fall back to the whole week which requires as many
+	MinSamples int
+
+	routes timedCache // route name -> travel times
+}
+
+type routeTimes struct {
+	buckets  map[segmentBucket]*database.SegmentTime
+	segments map[[2]string]time.Duration // from, to -> travel time over the whole week
+}
+
+type segmentBucket struct {
+	from, to string
+	weekday  time.Weekday
+	hour     int
+}
+
+// samplePosition is where a vehicle was along its route and the last stop it arrived at
+type samplePosition struct {
+	route string
+	along float64
+	at    time.Time
+	last  *crossedStop
+}
+
+// sampledRoute is a route with its stops as they were when the travels are sampled
+type sampledRoute struct {
+	path   []pkg.Point
+	length float64
+	stops  []stopAlong
+}
+
+const (
+	// travel times between two stops longer than this are breaks out of service
+	maxSegmentTravel = time.Hour
+	// logs farther than this from their route, and stops as far from it, are not sampled
+	maxSampleOffset = 50
+	// the logs are sampled by periods of this time
+	samplePeriod = 6 * time.Hour
+)
+
+// NewTravelTimeModel creates a model, by default rebuilt every hour from the last 4 weeks of shuttle logs
+// bucketed in UTC
+func NewTravelTimeModel(db database.Database, elector *Elector, interval, history time.Duration, location *time.Location) *TravelTimeModel {
+	m := &TravelTimeModel{Database: db, Elector: elector, Interval: interval, History: history, Location: location, MinSamples: 3}
+	if m.Interval <= 0 {
+		m.Interval = time.Hour
+	}
+	if m.History <= 0 {
+		m.History = 28 * 24 * time.Hour
+	}
+	if m.Location == nil {
+		m.Location = time.UTC
+	}
+	return m
+}
+
+// Run rebuilds the model forever
+func (m *TravelTimeModel) Run() {
+	m.update(time.Now())
+	for now := range time.Tick(m.Interval) {
+		m.update(now)
+	}
+}
+
+func (m *TravelTimeModel) update(now time.Time) {
+	if m.Elector != nil && !m.Elector.IsLeader() {
+		return
+	}
+	start := time.Now()
+	if err := m.sample(now); err != nil {
+		fmt.Printf("Unable to sample the segment travel times: %s\n", err.Error())
+		return
+	}
+	if err := m.Database.UpdateSegmentTimes(now.Add(-m.History), m.Location); err != nil {
+		fmt.Printf("Unable to update the segment travel times: %s\n", err.Error())
+		return
+	}
+	m.routes.forget(func(interface{}) bool { return true })
+	pkg.MeasureTime(start, "Update segment travel times")
+}
+
+// sample stores the travels between the stops ended since the latest sample, or within History if there
+// is none. The logs of the preceding maxSegmentTravel only rebuild where the vehicles were.
+func (m *TravelTimeModel) sample(now time.Time) error {
+	since, err := m.Database.SelectLatestSegmentSample()
+	if err != nil {
+		return err
+	}
+	if oldest := now.Add(-m.History); since.Before(oldest) {
+		since = oldest
+	}
+	routes, err := m.sampledRoutes()
+	if err != nil {
+		return err
+	}
+	positions := map[string]*samplePosition{}
+	for from := since.Add(-maxSegmentTravel); from.Before(now); from = from.Add(samplePeriod) {
+		to := from.Add(samplePeriod)
+		if to.After(now) {
+			to = now
+		}
+		logs, err := m.Database.SelectRouteLogs(from, to)
+		if err != nil {
+			return err
+		}
+		samples := []*database.SegmentSample{}
+		for _, log := range logs {
+			samples = append(samples, sampleLog(positions, routes, log, since)...)
+		}
+		if err := m.Database.InsertSegmentSamples(samples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampledRoutes loads the routes with their stops, the travels are sampled on the routes without detours
+func (m *TravelTimeModel) sampledRoutes() (map[string]*sampledRoute, error) {
+	routes, err := m.Database.ListClosedRoutes()
+	if err != nil {
+		return nil, err
+	}
+	sampled := map[string]*sampledRoute{}
+	for _, route := range routes {
+		path := routePath(route)
+		if len(path) < 2 {
+			continue
+		}
+		stops, err := m.Database.SelectStopOnRoute(route.Name)
+		if err != nil {
+			return nil, err
+		}
+		sampled[route.Name] = &sampledRoute{path, pkg.PathLength(path, true), alongRoute(path, stops, maxSampleOffset)}
+	}
+	return sampled, nil
+}
+
+// sampleLog moves the vehicle of the log along its route and returns the travels it ended after since.
+// The log is projected on the route again so that the logs stored before the snapping are sampled too.
+func sampleLog(positions map[string]*samplePosition, routes map[string]*sampledRoute, log *database.ShuttleLog, since time.Time) []*database.SegmentSample {
+	route, ok := routes[log.RouteName]
+	if !ok || log.Location == nil {
+		delete(positions, log.VehicleID)
+		return nil
+	}
+	p := pkg.Project(route.path, true, pkg.Point{X: log.Location.X, Y: log.Location.Y})
+	if p.Offset > maxSampleOffset {
+		// the stops passed off the route are unknown
+		delete(positions, log.VehicleID)
+		return nil
+	}
+	last, ok := positions[log.VehicleID]
+	if ok && !log.FixTime.After(last.at) {
+		return nil
+	}
+	position := &samplePosition{route: log.RouteName, along: p.Along, at: log.FixTime}
+	positions[log.VehicleID] = position
+	if !ok || last.route != log.RouteName {
+		return nil
+	}
+	crossed, known := crossStops(route.stops, route.length, last.along, last.at, p.Along, log.FixTime)
+	if !known {
+		return nil
+	}
+	position.last = last.last
+	samples := []*database.SegmentSample{}
+	for i := range crossed {
+		stop := &crossed[i]
+		previous := position.last
+		if previous != nil && previous.stop.StopID == stop.stop.StopID {
+			// back at the same stop, it was reached at the first arrival
+			continue
+		}
+		position.last = stop
+		if previous == nil || !stop.at.After(since) {
+			continue
+		}
+		if travel := stop.at.Sub(previous.at); travel <= 0 || travel >= maxSegmentTravel {
+			continue
+		}
+		samples = append(samples, &database.SegmentSample{RouteName: log.RouteName, FromStop: previous.stop.StopID,
+			ToStop: stop.stop.StopID, StartedAt: previous.at, EndedAt: stop.at})
+	}
+	return samples
+}
+
+// SegmentTime returns the usual travel time from the arrival at a stop at a time to the arrival at the next
+// one of the route, false if the segment was never traveled
+func (m *TravelTimeModel) SegmentTime(route, from, to string, at time.Time) (time.Duration, bool) {
+	times := m.loadRoute(route)
+	at = at.In(m.Location)
+	if t, ok := times.buckets[segmentBucket{from, to, at.Weekday(), at.Hour()}]; ok && t.Samples >= m.MinSamples {
+		return t.TravelTime, true
+	}
+	travel, ok := times.segments[[2]string{from, to}]
+	return travel, ok
+}
+
+// loadRoute returns the travel times of the route, none if they can't be loaded
+func (m *TravelTimeModel) loadRoute(route string) *routeTimes {
+	times, err := m.routes.get(route, func() (interface{}, error) {
+		segmentTimes, err := m.Database.SelectSegmentTimes(route)
+		if err != nil {
+			return nil, err
+		}
+		return m.aggregate(segmentTimes), nil
+	})
+	if err != nil {
+		fmt.Printf("Unable to load the travel times of route %s: %s\n", route, err.Error())
+	}
+	if times == nil {
+		return m.aggregate(nil)
+	}
+	return times.(*routeTimes)
+}
+
+// aggregate indexes the travel times by bucket and averages them over the week, the week long travel
+// time is the average of the buckets weighted by their samples
+func (m *TravelTimeModel) aggregate(segmentTimes []*database.SegmentTime) *routeTimes {
+	times := &routeTimes{map[segmentBucket]*database.SegmentTime{}, map[[2]string]time.Duration{}}
+	total := map[[2]string]time.Duration{}
+	samples := map[[2]string]int{}
+	for _, t := range segmentTimes {
+		times.buckets[segmentBucket{t.FromStop, t.ToStop, t.Weekday, t.Hour}] = t
+		key := [2]string{t.FromStop, t.ToStop}
+		total[key] += t.TravelTime * time.Duration(t.Samples)
+		samples[key] += t.Samples
+	}
+	for key, n := range samples {
+		if n >= m.MinSamples {
+			times.segments[key] = total[key] / time.Duration(n)
+		}
+	}
+	return times
+}
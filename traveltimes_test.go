@@ -0,0 +1,53 @@
+package yast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+func TestTravelTimeModelSamplesLogs(t *testing.T) {
+	db := &database.MockDatabase{}
+	db.Open()
+	squareRoute(db, map[string][2]float64{"a": {0.003, 0}, "b": {0.007, 0}})
+	start := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	// the logs stored before the snapping only have a route, the shuttle drives 0.001 degree (111 m) every
+	// 10 seconds and waits 60 seconds at b on its four laps
+	at := start
+	for lap := 0; lap < 4; lap++ {
+		x := 0.0
+		for ; x < 0.0095; x += 0.001 {
+			db.InsertShuttleLog(&database.ShuttleLog{VehicleID: "v1", RouteName: "loop", FixTime: at,
+				Location: &database.Vector{X: x, Y: 0}})
+			at = at.Add(10 * time.Second)
+			if x > 0.0069 && x < 0.0071 {
+				at = at.Add(time.Minute)
+			}
+		}
+		// back to the start along the other sides
+		for _, p := range [][2]float64{{0.01, 0.005}, {0.01, 0.01}, {0.005, 0.01}, {0, 0.01}, {0, 0.005}} {
+			db.InsertShuttleLog(&database.ShuttleLog{VehicleID: "v1", RouteName: "loop", FixTime: at,
+				Location: &database.Vector{X: p[0], Y: p[1]}})
+			at = at.Add(50 * time.Second)
+		}
+	}
+	m := NewTravelTimeModel(db, nil, time.Hour, 24*time.Hour, time.UTC)
+	m.update(at)
+
+	// a to b is 4 fixes, b to a waits at b then goes around
+	if travel, ok := m.SegmentTime("loop", "a", "b", start); !ok || travel != 40*time.Second {
+		t.Errorf("a to b: got %s %v, want 40s", travel, ok)
+	}
+	want := 60*time.Second + 3*10*time.Second + 5*50*time.Second + 3*10*time.Second
+	if travel, ok := m.SegmentTime("loop", "b", "a", start); !ok || travel != want {
+		t.Errorf("b to a: got %s %v, want %s", travel, ok, want)
+	}
+
+	// the next run only samples the new logs
+	samples := len(db.SegmentSamples)
+	m.update(at.Add(time.Hour))
+	if len(db.SegmentSamples) != samples {
+		t.Errorf("got %d samples after a run without logs, want %d", len(db.SegmentSamples), samples)
+	}
+}
@@ -4,27 +4,43 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"regexp"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/keyboardnerd/yastserver/database"
 	"github.com/keyboardnerd/yastserver/pkg"
 )
 
-var (
-	logregex = regexp.MustCompile(
-		`Vehicle ID:(\d+) lat:(-?\d+.\d+) lon:(-?\d+.\d+) dir:(\d+.\d+) spd:(\d+.\d+) lck:(\d+) time:(\d+) date:(\d+) trig:(\d+) eof`)
-)
-
 type Updater struct {
-	Fetcher  Fetcher
-	Database database.Database
-	Interval int
+	sync.Mutex
+
+	Fetchers     []Fetcher
+	Database     database.Database
+	Buffer       *WriteBuffer
+	Deduplicator Deduplicator
+	Filter       OutlierFilter
+	Interval     int
+	// number of workers processing the logs, the logs of a vehicle are always processed by the same worker
+	Concurrency int
+	// only the leader polls the remote feeds, nil if this instance is the only one
+	Elector *Elector
+	// fail the whole ingested batch on a malformed record instead of skipping it
+	StrictParsing bool
+
+	processors      []registeredProcessor
+	observers       []registeredObserver
+	subscribersLock sync.RWMutex
+	subscribers     []func(*database.ShuttleLog)
 }
 
 type Fetcher struct {
+	// name of the source recorded in the logs
+	Name       string
 	RemoteSite string
+	// the fix of the lowest priority wins when two sources report a vehicle at the same time
+	Priority int
+	// fail the whole pull on a malformed record instead of skipping it
+	Strict bool
 }
 
 func (updater *Updater) RunUpdate() {
@@ -36,22 +52,90 @@ func (updater *Updater) RunUpdate() {
 }
 
 func (updater *Updater) update(now time.Time) {
-	shuttleLog, err := updater.Fetcher.Pull()
+	if updater.Elector != nil && !updater.Elector.IsLeader() {
+		return
+	}
+	shuttleLog := updater.pull(now)
 	start := time.Now()
-	if err != nil {
-		// log error
-		fmt.Printf("%v : %s", now, err.Error())
-	} else {
+	// still replay the buffered logs if no source answered
+	updater.process(shuttleLog)
+	pkg.MeasureTime(start, fmt.Sprintf("database transaction, updated %d shuttles", len(shuttleLog)))
+}
+
+// pull all the sources concurrently and merge their logs, a vehicle reported by several sources
+// keeps the freshest fix, or the fix of the source with the lowest priority on a tie
+func (updater *Updater) pull(now time.Time) []database.ShuttleLog {
+	var wg sync.WaitGroup
+	pulled := make([][]database.ShuttleLog, len(updater.Fetchers))
+	for i := range updater.Fetchers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fetcher := &updater.Fetchers[i]
+			shuttleLog, err := fetcher.Pull()
+			if err != nil {
+				// log error
+				fmt.Printf("%v : %s: %s\n", now, fetcher.Name, err.Error())
+				return
+			}
+			for j := range shuttleLog {
+				shuttleLog[j].Source = fetcher.Name
+			}
+			pulled[i] = shuttleLog
+		}(i)
+	}
+	wg.Wait()
+	merged := []database.ShuttleLog{}
+	index := map[string]int{}    // vehicle id -> index in merged
+	priority := map[string]int{} // vehicle id -> priority of the merged source
+	for i, shuttleLog := range pulled {
+		p := updater.Fetchers[i].Priority
 		for _, log := range shuttleLog {
-			func(x database.ShuttleLog) {
-				err := updater.Database.InsertShuttleLog(&x)
-				if err != nil {
-					fmt.Printf("Unable to insert shuttle log to database %s\n", err.Error())
-				}
-			}(log)
+			j, ok := index[log.VehicleID]
+			if !ok {
+				index[log.VehicleID] = len(merged)
+				priority[log.VehicleID] = p
+				merged = append(merged, log)
+				continue
+			}
+			current := merged[j]
+			if log.FixTime.After(current.FixTime) || (log.FixTime.Equal(current.FixTime) && p < priority[log.VehicleID]) {
+				merged[j] = log
+				priority[log.VehicleID] = p
+			}
 		}
 	}
-	pkg.MeasureTime(start, fmt.Sprintf("database transaction, updated %d shuttles", len(shuttleLog)))
+	return merged
+}
+
+// Ingest runs the shuttle logs pushed by the devices through the same pipeline as the polled ones
+func (updater *Updater) Ingest(shuttleLog []database.ShuttleLog) error {
+	for i, log := range shuttleLog {
+		if log.VehicleID == "" || log.Location == nil {
+			return fmt.Errorf("Shuttle log requires a vehicle id and a location")
+		}
+		if log.Source == "" {
+			shuttleLog[i].Source = "push"
+		}
+	}
+	updater.process(shuttleLog)
+	return nil
+}
+
+// IngestText parses the shuttle logs in the remote feed format and ingests them, returns the number of logs
+func (updater *Updater) IngestText(body []byte) (int, error) {
+	return updater.ingestText(body, "push")
+}
+
+func (updater *Updater) ingestText(body []byte, source string) (int, error) {
+	shuttleLog, err := ParseShuttleLog(body, updater.StrictParsing)
+	if err != nil {
+		return 0, err
+	}
+	for i := range shuttleLog {
+		shuttleLog[i].Source = source
+	}
+	return len(shuttleLog), updater.Ingest(shuttleLog)
 }
 
 // Pull the data from upper stream, this is a blocking call
@@ -69,46 +153,10 @@ func (fetcher *Fetcher) Pull() ([]database.ShuttleLog, error) {
 	if err != nil {
 		return nil, err
 	}
-	log, err := ParseShuttleLog(body)
+	log, err := ParseShuttleLog(body, fetcher.Strict)
 	if err != nil {
 		return nil, err
 	}
 	pkg.MeasureTime(start, "Pull remote shuttle log")
 	return log, err
 }
-
-func ParseShuttleLog(logslice []byte) ([]database.ShuttleLog, error) {
-	var err error
-	logVehicles := logregex.FindAllStringSubmatch(string(logslice), -1)
-	if logVehicles == nil {
-		err = fmt.Errorf("Failed to parse the response %s", logslice)
-		return nil, err
-	}
-	rgshuttleLog := make([]database.ShuttleLog, len(logVehicles))
-	for i, logVehicle := range logVehicles {
-		// skip first one because it's the whole matched string
-		log := database.ShuttleLog{}
-		log.VehicleID = logVehicle[1]
-		v := database.Vector{}
-		v.X, err = strconv.ParseFloat(logVehicle[2], 10)
-		if err != nil {
-			return nil, err
-		}
-		v.Y, err = strconv.ParseFloat(logVehicle[3], 10)
-		if err != nil {
-			return nil, err
-		}
-		v.Angle, err = strconv.ParseFloat(logVehicle[4], 10)
-		if err != nil {
-			return nil, err
-		}
-		v.Speed, err = strconv.ParseFloat(logVehicle[5], 10)
-		if err != nil {
-			return nil, err
-		}
-		log.Location = &v
-		log.Status = logVehicle[9]
-		rgshuttleLog[i] = log
-	}
-	return rgshuttleLog, nil
-}
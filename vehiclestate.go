@@ -0,0 +1,191 @@
+package yast
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+// speeds below this in mph are stopped
+const stoppedSpeed = 1.0
+
+// VehicleStateMachine derives the state of every vehicle from the age, the speed and the location of its
+// latest fix and from its assignment, and records the transitions. The states which only depend on
+// time, stale and parked, are also checked every Interval by the leader.
+type VehicleStateMachine struct {
+	sync.Mutex
+
+	Database database.Database
+	Elector  *Elector
+	// tell whether a vehicle is at a stop or off its route, nil if not detected
+	Stops    *StopDetector
+	OffRoute *OffRouteDetector
+	// a vehicle is stale without fix for StaleAfter and parked when stopped away from the stops for
+	// ParkedAfter
+	StaleAfter  time.Duration
+	ParkedAfter time.Duration
+	Interval    time.Duration
+
+	vehicles map[string]*vehicleState // vehicle id -> state
+}
+
+type vehicleState struct {
+	state string
+	// the vehicle with its activity and assignment, nil until loaded or once changed by any instance
+	vehicle *database.Vehicle
+	// time of the first fix of the current stop, zero while moving
+	stoppedSince time.Time
+}
+
+// NewVehicleStateMachine creates a state machine, by default a vehicle is stale after 5 minutes without
+// fix, parked after 10 minutes stopped and the stale vehicles are looked for every 30 seconds
+func NewVehicleStateMachine(db database.Database, elector *Elector, staleAfter, parkedAfter, interval time.Duration) *VehicleStateMachine {
+	m := &VehicleStateMachine{Database: db, Elector: elector, StaleAfter: staleAfter, ParkedAfter: parkedAfter, Interval: interval}
+	if m.StaleAfter <= 0 {
+		m.StaleAfter = 5 * time.Minute
+	}
+	if m.ParkedAfter <= 0 {
+		m.ParkedAfter = 10 * time.Minute
+	}
+	if m.Interval <= 0 {
+		m.Interval = 30 * time.Second
+	}
+	return m
+}
+
+// Observe updates the state of the vehicle from the log and records the transition, if any
+func (m *VehicleStateMachine) Observe(log *database.ShuttleLog) error {
+	at := log.FixTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+	vehicle := m.cachedVehicle(log.VehicleID)
+	if vehicle == nil {
+		// the vehicle is registered when its first log is stored
+		var err error
+		if vehicle, err = m.Database.SelectVehicle(log.VehicleID); err != nil {
+			vehicle = nil
+		}
+	}
+	if transition := m.observe(log.VehicleID, vehicle, log, at); transition != nil {
+		if err := m.Database.UpdateVehicleState(transition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedVehicle returns the vehicle loaded with a previous log, nil if it must be loaded
+func (m *VehicleStateMachine) cachedVehicle(vehicleID string) *database.Vehicle {
+	m.Lock()
+	defer m.Unlock()
+	if v, ok := m.vehicles[vehicleID]; ok {
+		return v.vehicle
+	}
+	return nil
+}
+
+// Notify loads again with its next log a vehicle changed by any instance
+func (m *VehicleStateMachine) Notify(n database.Notification) {
+	if n.Channel != database.VehicleChannel {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	if v, ok := m.vehicles[n.Key]; ok {
+		v.vehicle = nil
+	}
+}
+
+// Run checks the states of all the vehicles every Interval
+func (m *VehicleStateMachine) Run() {
+	for now := range time.Tick(m.Interval) {
+		m.check(now)
+	}
+}
+
+func (m *VehicleStateMachine) check(now time.Time) {
+	if m.Elector != nil && !m.Elector.IsLeader() {
+		return
+	}
+	vehicles, err := m.Database.ListVehicles()
+	if err != nil {
+		fmt.Printf("Unable to check the vehicle states: %s\n", err.Error())
+		return
+	}
+	for _, vehicle := range vehicles {
+		log, err := m.Database.SelectLatestLog(vehicle.VehicleID)
+		if err != nil {
+			// never reported
+			log = nil
+		}
+		if transition := m.observe(vehicle.VehicleID, vehicle, log, now); transition != nil {
+			if err := m.Database.UpdateVehicleState(transition); err != nil {
+				fmt.Printf("Unable to update the state of vehicle %s: %s\n", vehicle.VehicleID, err.Error())
+			}
+		}
+	}
+}
+
+// observe updates the state of the vehicle from its latest log, nil if unknown, and returns the transition
+// if the state changed
+func (m *VehicleStateMachine) observe(vehicleID string, vehicle *database.Vehicle, log *database.ShuttleLog, now time.Time) *database.VehicleState {
+	atStop := m.Stops != nil && m.Stops.AtStop(vehicleID)
+	offRoute := m.OffRoute != nil && m.OffRoute.OffRoute(vehicleID)
+	m.Lock()
+	defer m.Unlock()
+	if m.vehicles == nil {
+		m.vehicles = make(map[string]*vehicleState)
+	}
+	v, ok := m.vehicles[vehicleID]
+	if !ok {
+		v = &vehicleState{}
+		// continue from the recorded state
+		if vehicle != nil {
+			v.state = vehicle.State
+		}
+		m.vehicles[vehicleID] = v
+	}
+	if vehicle != nil {
+		v.vehicle = vehicle
+	}
+	if log != nil {
+		if log.Location.Speed >= stoppedSpeed && log.StationaryUntil.IsZero() {
+			v.stoppedSince = time.Time{}
+		} else if v.stoppedSince.IsZero() {
+			v.stoppedSince = log.FixTime
+		}
+	}
+	state := database.StateInService
+	switch {
+	case vehicle != nil && !vehicle.Active:
+		state = database.StateOutOfService
+	case log == nil || now.Sub(lastSeen(log)) > m.StaleAfter:
+		state = database.StateStale
+	case offRoute:
+		state = database.StateOffRoute
+	case !v.stoppedSince.IsZero() && atStop:
+		state = database.StateIdleAtStop
+	case !v.stoppedSince.IsZero() && now.Sub(v.stoppedSince) >= m.ParkedAfter:
+		state = database.StateParked
+	// checked last, a vehicle without route still goes stale or parked
+	case log.RouteName == "" && (vehicle == nil || vehicle.RouteName == ""):
+		state = database.StateOutOfService
+	}
+	if state == v.state {
+		return nil
+	}
+	transition := &database.VehicleState{VehicleID: vehicleID, Previous: v.state, State: state, At: now}
+	v.state = state
+	return transition
+}
+
+// lastSeen is the time of the latest fix summarized by the log
+func lastSeen(log *database.ShuttleLog) time.Time {
+	if log.StationaryUntil.After(log.FixTime) {
+		return log.StationaryUntil
+	}
+	return log.FixTime
+}
@@ -0,0 +1,39 @@
+package yast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keyboardnerd/yastserver/database"
+)
+
+func TestVehicleStateWithoutRoute(t *testing.T) {
+	db := &database.MockDatabase{}
+	db.Open()
+	db.UpsertVehicle(&database.Vehicle{VehicleID: "v1", Active: true})
+	machine := NewVehicleStateMachine(db, nil, 30*time.Minute, 10*time.Minute, 0)
+	start := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	log := &database.ShuttleLog{VehicleID: "v1", FixTime: start, Location: &database.Vector{X: -73.67, Y: 42.73}}
+	db.InsertShuttleLog(log)
+	if err := machine.Observe(log); err != nil {
+		t.Fatal(err)
+	}
+	// stopped without route, it's parked and then stale like any other vehicle
+	for _, step := range []struct {
+		after time.Duration
+		state string
+	}{
+		{0, database.StateOutOfService},
+		{10 * time.Minute, database.StateParked},
+		{31 * time.Minute, database.StateStale},
+	} {
+		machine.check(start.Add(step.after))
+		v, err := db.SelectVehicle("v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.State != step.state {
+			t.Errorf("after %s: got state %s, want %s", step.after, v.State, step.state)
+		}
+	}
+}